@@ -0,0 +1,363 @@
+package Common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Packet"
+)
+
+// login:
+// client -> netOpLogin:      login data, checked by the IAuthenticator of the service
+// server -> netOpLoginReply: 1 byte result + [8 bytes account ID | string reason]
+// Until the login succeeds the server accepts nothing else but the other internal ops, even
+// while the login is checked: the client waits for the reply before sending anything else.
+// With CryptoConfig the login is sealed like every frame but the handshake, and held back
+// until the handshake completes, so the token never goes out in clear.
+const (
+	loginOK     = 0
+	loginFailed = 1
+)
+
+const authReasonTimeout = "timeout"
+
+var ErrAuthFailed = errors.New("authentication failed")
+var ErrAuthTimeout = errors.New("authentication timeout")
+
+// AuthError is the failure of a login, as reported by the server.
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return "authentication failed: " + e.Reason
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthFailed || (target == ErrAuthTimeout && e.Reason == authReasonTimeout)
+}
+
+// IAuthenticator checks the login data of a session and returns its account ID. It runs on
+// its own goroutine, so it may query a database.
+type IAuthenticator interface {
+	Authenticate(player *SessionPlayerBase, login *Packet.Packet) (accountID uint64, err error)
+}
+
+// AuthConfig makes the sessions of a service log in before anything else.
+type AuthConfig struct {
+	Authenticator IAuthenticator
+
+	// Group gets the players once authenticated, nil adds them nowhere. They are removed from
+	// it when closed.
+	Group *SessionGroup
+
+	// Timeout closes the sessions not logged in in time, 0 means 10s.
+	Timeout time.Duration
+
+	// FailDelay is the time between a failure reply and the close, 0 means 1s.
+	FailDelay time.Duration
+}
+
+func (c *AuthConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return c.Timeout
+}
+
+func (c *AuthConfig) failDelay() time.Duration {
+	if c.FailDelay <= 0 {
+		return time.Second
+	}
+	return c.FailDelay
+}
+
+const (
+	authPending  = iota // waiting for the login
+	authChecking        // login being checked
+	authDone
+	authFailed
+)
+
+// authState is the login part of SessionPlayerBase.
+type authState struct {
+	mutex     sync.Mutex
+	phase     int
+	timer     *time.Timer
+	loggingIn bool                              // client side, see Login
+	cb        func(accountID uint64, err error) // client side
+}
+
+// startAuth puts the session in the pending state, from Initialize.
+func (s *SessionPlayerBase) startAuth() {
+	st := &s.auth
+	st.mutex.Lock()
+	st.phase = authPending
+	st.timer = time.AfterFunc(s.cfg.Auth.timeout(), s.authTimeout)
+	st.mutex.Unlock()
+
+	s.AddCloseHook(func() {
+		st.mutex.Lock()
+		st.timer.Stop()
+		st.mutex.Unlock()
+	})
+}
+
+// IsAuthenticated tells whether the session logged in, always true for services without AuthConfig.
+func (s *SessionPlayerBase) IsAuthenticated() bool {
+	if s.cfg.Auth == nil {
+		return true
+	}
+
+	s.auth.mutex.Lock()
+	defer s.auth.mutex.Unlock()
+
+	return s.auth.phase == authDone
+}
+
+// loginRequired tells whether a frame other than an internal op must be refused, until the
+// login succeeded.
+func (s *SessionPlayerBase) loginRequired() bool {
+	if s.cfg.Auth == nil {
+		return false
+	}
+
+	s.auth.mutex.Lock()
+	defer s.auth.mutex.Unlock()
+
+	return s.auth.phase != authDone
+}
+
+// onLogin starts checking a login, returning false when the session must be closed.
+func (s *SessionPlayerBase) onLogin(pak *Packet.Packet) bool {
+	cfg := s.cfg.Auth
+	if cfg == nil || cfg.Authenticator == nil {
+		slog.Warn("login: authentication not enabled:", s.Session.GetServiceKey(), s.GetID())
+		return false
+	}
+
+	st := &s.auth
+	st.mutex.Lock()
+	if st.phase != authPending {
+		st.mutex.Unlock()
+		slog.Warn("login: unexpected login:", s.Session.GetServiceKey(), s.GetID())
+		return false
+	}
+	st.phase = authChecking
+	st.mutex.Unlock()
+
+	go func() {
+		id, err := s.authenticate(cfg.Authenticator, pak)
+		s.finishAuth(id, err)
+	}()
+	return true
+}
+
+func (s *SessionPlayerBase) authenticate(a IAuthenticator, pak *Packet.Packet) (id uint64, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			id, err = 0, fmt.Errorf("authenticator panic: %v", e)
+		}
+	}()
+
+	id, err = a.Authenticate(s, pak)
+	if err == nil && id == 0 {
+		err = ErrAuthFailed
+	}
+	return
+}
+
+func (s *SessionPlayerBase) finishAuth(id uint64, err error) {
+	cfg := s.cfg.Auth
+	st := &s.auth
+
+	st.mutex.Lock()
+	if st.phase != authChecking {
+		// timed out meanwhile
+		st.mutex.Unlock()
+		return
+	}
+	st.mutex.Unlock()
+
+	if err == nil {
+		s.SetAccountID(id)
+		err = s.joinAuthGroup(cfg.Group)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.phase != authChecking {
+		return
+	}
+
+	var reply Packet.Packet
+	reply.WriteUint8(netOpLoginReply)
+
+	if err != nil {
+		slog.Warn("login failed:", s.Session.GetServiceKey(), s.GetID(), err)
+		st.phase = authFailed
+		st.timer.Reset(cfg.failDelay())
+
+		reply.WriteUint8(loginFailed)
+		reply.WriteString(authFailReason(err))
+		s.SendFrame(EPacketNetworkInternal, reply.GetUsedBuffer())
+		return
+	}
+
+	slog.Info("login:", s.Session.GetServiceKey(), s.GetID(), "account", id)
+	st.phase = authDone
+	st.timer.Stop()
+
+	reply.WriteUint8(loginOK)
+	reply.WriteUint64(id)
+	s.SendFrame(EPacketNetworkInternal, reply.GetUsedBuffer())
+
+	if s.cfg.Resume != nil {
+		s.issueResumeToken()
+	}
+}
+
+// authFailReason is the reason told to the client: only the ones of AuthError, the others
+// may be internal.
+func authFailReason(err error) string {
+	var ae *AuthError
+	if errors.As(err, &ae) {
+		return ae.Reason
+	}
+	return "invalid login"
+}
+
+// joinAuthGroup adds the authenticated player to its group, removing it once closed.
+func (s *SessionPlayerBase) joinAuthGroup(g *SessionGroup) error {
+	if g == nil {
+		return nil
+	}
+
+	player, ok := s.msgHandlerUpdatable.(ISessionPlayer)
+	if !ok || !g.AddSessionPlayer(player) {
+		return errors.New("cannot join the session group")
+	}
+
+	s.AddCloseHook(func() { g.RemoveSessionPlayer(player) })
+	return nil
+}
+
+// authTimeout closes a session not logged in in time, or after the delay of a failure.
+func (s *SessionPlayerBase) authTimeout() {
+	st := &s.auth
+	st.mutex.Lock()
+	phase := st.phase
+	if phase == authPending || phase == authChecking {
+		st.phase = authFailed
+
+		var reply Packet.Packet
+		reply.WriteUint8(netOpLoginReply)
+		reply.WriteUint8(loginFailed)
+		reply.WriteString(authReasonTimeout)
+		s.SendFrame(EPacketNetworkInternal, reply.GetUsedBuffer())
+	}
+	st.mutex.Unlock()
+
+	if phase == authDone {
+		return
+	}
+
+	if phase != authFailed {
+		slog.Warn("login timeout:", s.Session.GetServiceKey(), s.GetID())
+	}
+	s.Session.Shutdown(true)
+}
+
+//----------------------------------------------------------------------------
+
+// Login sends the login data to the server, cb gets the result like a CallAsync callback.
+// Nothing but the internal ops may be sent before cb reports the success, the server closes
+// the session otherwise.
+func (s *SessionPlayerBase) Login(data []byte, cb func(accountID uint64, err error)) error {
+	s.auth.mutex.Lock()
+	s.auth.loggingIn = true
+	s.auth.cb = cb
+	s.auth.mutex.Unlock()
+
+	var pak Packet.Packet
+	pak.WriteUint8(netOpLogin)
+	pak.Write(data)
+	return s.SendFrame(EPacketNetworkInternal, pak.GetUsedBuffer())
+}
+
+func (s *SessionPlayerBase) onLoginReply(pak *Packet.Packet) bool {
+	s.auth.mutex.Lock()
+	loggingIn, cb := s.auth.loggingIn, s.auth.cb
+	s.auth.loggingIn, s.auth.cb = false, nil
+	s.auth.mutex.Unlock()
+
+	if !loggingIn {
+		slog.Warn("login: unexpected login reply:", s.Session.GetServiceKey(), s.GetID())
+		return false
+	}
+
+	var id uint64
+	var err error
+	if pak.ReadUint8() == loginOK {
+		id = pak.ReadUint64()
+		s.SetAccountID(id)
+	} else {
+		err = &AuthError{Reason: pak.ReadString()}
+	}
+
+	if cb != nil {
+		s.deliverRpc(func() { cb(id, err) })
+	}
+	return true
+}
+
+//----------------------------------------------------------------------------
+
+// HMACTokenAuthenticator accepts the tokens it issues, signed with Secret. The login data
+// is the token as a string.
+type HMACTokenAuthenticator struct {
+	Secret []byte
+}
+
+// token: 8 bytes account ID + 8 bytes expiry in unix seconds + HMAC-SHA256 of them,
+// base64 url encoded
+const tokenBodyLength = 16
+
+// IssueToken returns a token for an account, valid for ttl.
+func (a *HMACTokenAuthenticator) IssueToken(accountID uint64, ttl time.Duration) string {
+	b := make([]byte, tokenBodyLength, tokenBodyLength+sha256.Size)
+	binary.LittleEndian.PutUint64(b, accountID)
+	binary.LittleEndian.PutUint64(b[8:], uint64(time.Now().Add(ttl).Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(b, a.sign(b)...))
+}
+
+func (a *HMACTokenAuthenticator) Authenticate(player *SessionPlayerBase, login *Packet.Packet) (uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(login.ReadString())
+	if err != nil || len(b) != tokenBodyLength+sha256.Size {
+		return 0, &AuthError{Reason: "malformed token"}
+	}
+
+	if !hmac.Equal(b[tokenBodyLength:], a.sign(b[:tokenBodyLength])) {
+		return 0, &AuthError{Reason: "bad token signature"}
+	}
+
+	if time.Now().Unix() > int64(binary.LittleEndian.Uint64(b[8:])) {
+		return 0, &AuthError{Reason: "token expired"}
+	}
+
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (a *HMACTokenAuthenticator) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,174 @@
+package Common_test
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+	"github.com/zhksoftGo/Packet"
+)
+
+// blockingAuth accepts every login as account 7, once release is closed.
+type blockingAuth struct {
+	release chan struct{}
+}
+
+func (a *blockingAuth) Authenticate(*Common.SessionPlayerBase, *Packet.Packet) (uint64, error) {
+	<-a.release
+	return 7, nil
+}
+
+func loginData(token string) []byte {
+	return packet(func(pak *Packet.Packet) { pak.WriteString(token) }).GetUsedBuffer()
+}
+
+func loginFrame(token string) []byte {
+	return networktest.EncodeFrame(Common.EPacketNetworkInternal, append([]byte{6}, loginData(token)...))
+}
+
+// loginResult collects the result of Login.
+type loginResult struct {
+	mutex sync.Mutex
+	done  bool
+	id    uint64
+	err   error
+}
+
+func (r *loginResult) cb(id uint64, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.done, r.id, r.err = true, id, err
+}
+
+func (r *loginResult) get() (done bool, id uint64, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.done, r.id, r.err
+}
+
+func TestLogin(t *testing.T) {
+	auth := &Common.HMACTokenAuthenticator{Secret: []byte("secret")}
+	client := newPlayer(t, "auth-ok-client", &Common.SessionConfig{})
+	server := newPlayer(t, "auth-ok-server", &Common.SessionConfig{Auth: &Common.AuthConfig{Authenticator: auth}})
+
+	var res loginResult
+	if err := client.Login(loginData(auth.IssueToken(42, time.Minute)), res.cb); err != nil {
+		t.Fatal(err)
+	}
+	link(t, client, server)
+
+	waitUntil(t, time.Second, func() bool { done, _, _ := res.get(); return done })
+	if _, id, err := res.get(); err != nil || id != 42 {
+		t.Fatalf("login returned %d, %v", id, err)
+	}
+	if !server.IsAuthenticated() || server.GetAccountID() != 42 {
+		t.Fatalf("server authenticated %v, account %d", server.IsAuthenticated(), server.GetAccountID())
+	}
+
+	if err := client.SendFrame(Common.EPacketGameLogic, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, time.Second, func() bool { return len(server.messages()) == 1 })
+}
+
+func TestLoginFailure(t *testing.T) {
+	auth := &Common.HMACTokenAuthenticator{Secret: []byte("secret")}
+	other := &Common.HMACTokenAuthenticator{Secret: []byte("other")}
+	client := newPlayer(t, "auth-fail-client", &Common.SessionConfig{})
+	server := newPlayer(t, "auth-fail-server", &Common.SessionConfig{
+		Auth: &Common.AuthConfig{Authenticator: auth, FailDelay: time.Millisecond},
+	})
+
+	var res loginResult
+	if err := client.Login(loginData(other.IssueToken(42, time.Minute)), res.cb); err != nil {
+		t.Fatal(err)
+	}
+	link(t, client, server)
+
+	waitUntil(t, time.Second, func() bool { done, _, _ := res.get(); return done })
+	if _, _, err := res.get(); !errors.Is(err, Common.ErrAuthFailed) || errors.Is(err, Common.ErrAuthTimeout) {
+		t.Fatalf("login returned %v", err)
+	}
+	if err := server.fake.WaitForShutdown(time.Second); err != nil {
+		t.Fatal("session not closed after the failure:", err)
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	server := newPlayer(t, "auth-timeout", &Common.SessionConfig{
+		Auth: &Common.AuthConfig{Authenticator: &Common.HMACTokenAuthenticator{}, Timeout: 10 * time.Millisecond},
+	})
+
+	if err := server.fake.WaitForShutdown(time.Second); err != nil {
+		t.Fatal("session not closed without login:", err)
+	}
+	frames := server.sentFrames(t)
+	if len(frames) != 1 || frames[0].Type != Common.EPacketNetworkInternal || frames[0].Body[0] != 7 {
+		t.Fatalf("sent %v", frames)
+	}
+}
+
+func TestFramesRefusedUntilLoggedIn(t *testing.T) {
+	frames := map[string][]byte{
+		"game logic": networktest.EncodeFrame(Common.EPacketGameLogic, []byte("x")),
+		"rpc":        networktest.EncodeFrame(Common.EPacketRpc, []byte{1, 0, 0, 0, 0}),
+	}
+
+	for name, frame := range frames {
+		auth := &blockingAuth{release: make(chan struct{})}
+		server := newPlayer(t, "auth-refuse", &Common.SessionConfig{Auth: &Common.AuthConfig{Authenticator: auth}})
+
+		if server.recv(frame) {
+			t.Fatalf("%s: accepted before the login", name)
+		}
+		server.OnClosed(nil)
+
+		server = newPlayer(t, "auth-refuse", nil)
+		if !server.recv(loginFrame("token")) {
+			t.Fatal("login refused")
+		}
+		refused := !server.recv(frame)
+		close(auth.release)
+		server.OnClosed(nil)
+
+		if !refused {
+			t.Fatalf("%s: accepted while the login is checked", name)
+		}
+		if len(server.messages()) != 0 {
+			t.Fatalf("%s: dispatched while the login is checked", name)
+		}
+	}
+}
+
+func TestLoginSealedWithCrypto(t *testing.T) {
+	auth := &Common.HMACTokenAuthenticator{Secret: []byte("secret")}
+	client, server := cryptoPair(t, "auth-crypto",
+		&Common.SessionConfig{}, &Common.SessionConfig{Auth: &Common.AuthConfig{Authenticator: auth}})
+
+	token := auth.IssueToken(42, time.Minute)
+	var res loginResult
+	if err := client.Login(loginData(token), res.cb); err != nil {
+		t.Fatal(err)
+	}
+	link(t, client, server)
+
+	waitUntil(t, time.Second, func() bool { done, _, _ := res.get(); return done })
+	if _, id, err := res.get(); err != nil || id != 42 {
+		t.Fatalf("login returned %d, %v", id, err)
+	}
+
+	if bytes.Contains(client.fake.SentBytes(), []byte(token)) {
+		t.Fatal("token sent in clear")
+	}
+	for _, f := range client.sentFrames(t)[1:] {
+		if f.Type != Common.EPacketGameLogicEncrypted {
+			t.Fatalf("plain frame type %#x after the handshake", f.Type)
+		}
+	}
+}
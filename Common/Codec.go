@@ -0,0 +1,291 @@
+package Common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrMalformedFrame = errors.New("malformed frame")
+var ErrFrameTooLarge = errors.New("frame too large")
+var ErrFrameRefused = errors.New("frame refused")
+
+// Frame is one message cut out of the received stream by an ICodec.
+type Frame struct {
+	Type uint16
+
+	// Data is the header followed by the payload. HeadLen is 0 for codecs without header.
+	Data    []byte
+	HeadLen int
+}
+
+func (f *Frame) Payload() []byte {
+	return f.Data[f.HeadLen:]
+}
+
+// ICodec frames the byte stream of a session. Set it per service with SessionConfig.Codec.
+type ICodec interface {
+	// Decode cuts the first frame out of buf. n is the number of bytes consumed,
+	// 0 while buf does not hold a whole frame yet. Data may alias buf.
+	// It fails with ErrFrameTooLarge as soon as it knows the payload exceeds maxSize, if not 0.
+	Decode(buf []byte, maxSize int) (frame Frame, n int, err error)
+
+	// Encode builds a frame carrying payload. Codecs whose length field is bounded implement
+	// MaxPayload, and panic here when payload exceeds it.
+	Encode(frameType uint16, payload []byte) []byte
+}
+
+// payloadLimiter is implemented by the codecs which cannot frame any payload size.
+type payloadLimiter interface {
+	MaxPayload() int
+}
+
+// maxPayload returns the largest payload codec frames, 0 if it has no limit.
+func maxPayload(codec ICodec) int {
+	if l, ok := codec.(payloadLimiter); ok {
+		return l.MaxPayload()
+	}
+	return 0
+}
+
+// typeCarrier is implemented by the codecs which may not carry the frame type.
+type typeCarrier interface {
+	CarriesType() bool
+}
+
+// carriesType tells whether codec keeps the frame type, needed by the split and compressed frames.
+func carriesType(codec ICodec) bool {
+	if c, ok := codec.(typeCarrier); ok {
+		return c.CarriesType()
+	}
+	return true
+}
+
+// encodeFrame encodes a frame, failing with ErrFrameTooLarge when payload does not fit the codec.
+func encodeFrame(codec ICodec, frameType uint16, payload []byte) ([]byte, error) {
+	if max := maxPayload(codec); max > 0 && len(payload) > max {
+		return nil, fmt.Errorf("%w: %d bytes, the codec frames %d at most", ErrFrameTooLarge, len(payload), max)
+	}
+	return codec.Encode(frameType, payload), nil
+}
+
+// DefaultCodec is the 4 bytes body length + 2 bytes type little-endian header.
+var DefaultCodec ICodec = &HeaderCodec{LengthSize: 4, TypeSize: 2, ByteOrder: binary.LittleEndian}
+
+//----------------------------------------------------------------------------
+
+// HeaderCodec frames with a fixed-length header: the body length then the frame type.
+type HeaderCodec struct {
+	LengthSize int // 1, 2 or 4
+	TypeSize   int // 0, 1 or 2; frames get EPacketGameLogic when 0
+	ByteOrder  binary.ByteOrder
+
+	// LengthIncludesHeader tells the length field counts the header too.
+	LengthIncludesHeader bool
+}
+
+func (c *HeaderCodec) headLen() int {
+	return c.LengthSize + c.TypeSize
+}
+
+// MaxPayload returns the largest payload the length field can carry.
+func (c *HeaderCodec) MaxPayload() int {
+	max := uint64(1)<<(8*uint(c.LengthSize)) - 1
+	if c.LengthIncludesHeader {
+		max -= uint64(c.headLen())
+	}
+	if max > math.MaxInt32 {
+		max = math.MaxInt32
+	}
+	return int(max)
+}
+
+// CarriesType tells whether the header has a type field.
+func (c *HeaderCodec) CarriesType() bool {
+	return c.TypeSize > 0
+}
+
+func (c *HeaderCodec) getUint(b []byte, size int) uint32 {
+	switch size {
+	case 1:
+		return uint32(b[0])
+	case 2:
+		return uint32(c.ByteOrder.Uint16(b))
+	case 4:
+		return c.ByteOrder.Uint32(b)
+	}
+	return 0
+}
+
+func (c *HeaderCodec) putUint(b []byte, size int, v uint32) {
+	switch size {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		c.ByteOrder.PutUint16(b, uint16(v))
+	case 4:
+		c.ByteOrder.PutUint32(b, v)
+	}
+}
+
+func (c *HeaderCodec) Decode(buf []byte, maxSize int) (frame Frame, n int, err error) {
+	headLen := c.headLen()
+	if len(buf) < headLen {
+		return
+	}
+
+	length := int(c.getUint(buf, c.LengthSize))
+	if c.LengthIncludesHeader {
+		if length < headLen {
+			return frame, 0, ErrMalformedFrame
+		}
+		length -= headLen
+	}
+
+	if maxSize > 0 && length > maxSize {
+		return frame, 0, ErrFrameTooLarge
+	}
+
+	frame.Type = EPacketGameLogic
+	if c.TypeSize > 0 {
+		frame.Type = uint16(c.getUint(buf[c.LengthSize:], c.TypeSize))
+	}
+
+	if len(buf) < headLen+length {
+		return frame, 0, nil
+	}
+
+	frame.Data = buf[:headLen+length]
+	frame.HeadLen = headLen
+	return frame, headLen + length, nil
+}
+
+func (c *HeaderCodec) Encode(frameType uint16, payload []byte) []byte {
+	if max := c.MaxPayload(); len(payload) > max {
+		panic(fmt.Errorf("HeaderCodec: %w: %d bytes for a %d bytes length", ErrFrameTooLarge, len(payload), c.LengthSize))
+	}
+
+	headLen := c.headLen()
+	frame := make([]byte, headLen+len(payload))
+
+	length := len(payload)
+	if c.LengthIncludesHeader {
+		length += headLen
+	}
+
+	c.putUint(frame, c.LengthSize, uint32(length))
+	c.putUint(frame[c.LengthSize:], c.TypeSize, uint32(frameType))
+	copy(frame[headLen:], payload)
+	return frame
+}
+
+//----------------------------------------------------------------------------
+
+// VarintCodec frames with an unsigned varint body length, followed by a varint frame type
+// if WithType is set. Frames get EPacketGameLogic otherwise.
+type VarintCodec struct {
+	WithType bool
+}
+
+func (c *VarintCodec) CarriesType() bool {
+	return c.WithType
+}
+
+func (c *VarintCodec) Decode(buf []byte, maxSize int) (frame Frame, n int, err error) {
+	length, n1 := binary.Uvarint(buf)
+	if n1 == 0 {
+		return
+	}
+	if n1 < 0 || length > uint64(^uint32(0)) {
+		return frame, 0, ErrMalformedFrame
+	}
+
+	if maxSize > 0 && length > uint64(maxSize) {
+		return frame, 0, ErrFrameTooLarge
+	}
+
+	headLen := n1
+	frame.Type = EPacketGameLogic
+	if c.WithType {
+		t, n2 := binary.Uvarint(buf[n1:])
+		if n2 == 0 {
+			return frame, 0, nil
+		}
+		if n2 < 0 || t > 0xFFFF {
+			return frame, 0, ErrMalformedFrame
+		}
+		frame.Type = uint16(t)
+		headLen += n2
+	}
+
+	if uint64(len(buf)-headLen) < length {
+		return frame, 0, nil
+	}
+
+	n = headLen + int(length)
+	frame.Data = buf[:n]
+	frame.HeadLen = headLen
+	return frame, n, nil
+}
+
+func (c *VarintCodec) Encode(frameType uint16, payload []byte) []byte {
+	frame := make([]byte, 0, 2*binary.MaxVarintLen32+len(payload))
+	frame = appendUvarint(frame, uint64(len(payload)))
+	if c.WithType {
+		frame = appendUvarint(frame, uint64(frameType))
+	}
+	return append(frame, payload...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
+
+//----------------------------------------------------------------------------
+
+// DelimiterCodec frames with a terminator, a newline for line protocols like
+// newline-delimited JSON. Frames have no header and get EPacketGameLogic.
+type DelimiterCodec struct {
+	Delimiter []byte
+}
+
+// NewLineCodec returns a DelimiterCodec splitting on "\n".
+func NewLineCodec() *DelimiterCodec {
+	return &DelimiterCodec{Delimiter: []byte("\n")}
+}
+
+func (c *DelimiterCodec) CarriesType() bool {
+	return false
+}
+
+func (c *DelimiterCodec) Decode(buf []byte, maxSize int) (frame Frame, n int, err error) {
+	if len(c.Delimiter) == 0 {
+		return frame, 0, ErrMalformedFrame
+	}
+
+	i := bytes.Index(buf, c.Delimiter)
+	if i < 0 {
+		if maxSize > 0 && len(buf) > maxSize+len(c.Delimiter) {
+			return frame, 0, ErrFrameTooLarge
+		}
+		return
+	}
+
+	if maxSize > 0 && i > maxSize {
+		return frame, 0, ErrFrameTooLarge
+	}
+
+	frame.Type = EPacketGameLogic
+	frame.Data = buf[:i]
+	return frame, i + len(c.Delimiter), nil
+}
+
+func (c *DelimiterCodec) Encode(frameType uint16, payload []byte) []byte {
+	frame := make([]byte, 0, len(payload)+len(c.Delimiter))
+	frame = append(frame, payload...)
+	return append(frame, c.Delimiter...)
+}
@@ -0,0 +1,164 @@
+package Common_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+	"github.com/zhksoftGo/Packet"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := map[string]Common.ICodec{
+		"default":        Common.DefaultCodec,
+		"header 2+1 big": &Common.HeaderCodec{LengthSize: 2, TypeSize: 1, ByteOrder: binary.BigEndian},
+		"header 1+0":     &Common.HeaderCodec{LengthSize: 1, ByteOrder: binary.LittleEndian},
+		"header incl":    &Common.HeaderCodec{LengthSize: 4, TypeSize: 2, ByteOrder: binary.BigEndian, LengthIncludesHeader: true},
+		"varint":         &Common.VarintCodec{},
+		"varint typed":   &Common.VarintCodec{WithType: true},
+		"lines":          Common.NewLineCodec(),
+	}
+	typed := map[string]bool{"default": true, "header 2+1 big": true, "header incl": true, "varint typed": true}
+
+	for name, codec := range codecs {
+		payload := []byte("hello world")
+		data := codec.Encode(Common.EPacketRpc, payload)
+		// followed by the beginning of another frame
+		stream := append(append([]byte{}, data...), codec.Encode(Common.EPacketRpc, payload)[:2]...)
+
+		frame, n, err := codec.Decode(stream, 0)
+		if err != nil || n != len(data) {
+			t.Fatalf("%s: decoded %d bytes of %d, %v", name, n, len(data), err)
+		}
+		if !bytes.Equal(frame.Payload(), payload) {
+			t.Fatalf("%s: payload %q", name, frame.Payload())
+		}
+
+		wantType := uint16(Common.EPacketGameLogic)
+		if typed[name] {
+			wantType = Common.EPacketRpc
+		}
+		if frame.Type != wantType {
+			t.Fatalf("%s: type %#x, want %#x", name, frame.Type, wantType)
+		}
+
+		// incomplete frames wait for more
+		if _, n, err := codec.Decode(data[:len(data)-1], 0); n != 0 || err != nil {
+			t.Fatalf("%s: partial frame decoded %d bytes, %v", name, n, err)
+		}
+
+		if _, _, err := codec.Decode(data, len(payload)-1); !errors.Is(err, Common.ErrFrameTooLarge) {
+			t.Fatalf("%s: frame over maxSize returned %v", name, err)
+		}
+	}
+}
+
+func TestHeaderCodecLengthOverflow(t *testing.T) {
+	tests := []struct {
+		codec *Common.HeaderCodec
+		max   int
+	}{
+		{&Common.HeaderCodec{LengthSize: 1, TypeSize: 2, ByteOrder: binary.LittleEndian}, 255},
+		{&Common.HeaderCodec{LengthSize: 2, TypeSize: 2, ByteOrder: binary.LittleEndian}, 65535},
+		{&Common.HeaderCodec{LengthSize: 2, TypeSize: 2, ByteOrder: binary.LittleEndian, LengthIncludesHeader: true}, 65531},
+	}
+
+	for _, tt := range tests {
+		if max := tt.codec.MaxPayload(); max != tt.max {
+			t.Fatalf("MaxPayload of %+v is %d, want %d", tt.codec, max, tt.max)
+		}
+
+		data := tt.codec.Encode(Common.EPacketGameLogic, make([]byte, tt.max))
+		if _, n, err := tt.codec.Decode(data, 0); err != nil || n != len(data) {
+			t.Fatalf("largest frame of %+v decoded %d bytes of %d, %v", tt.codec, n, len(data), err)
+		}
+
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, Common.ErrFrameTooLarge) {
+					t.Fatalf("Encode of %d bytes with %+v did not panic with ErrFrameTooLarge", tt.max+1, tt.codec)
+				}
+			}()
+			tt.codec.Encode(Common.EPacketGameLogic, make([]byte, tt.max+1))
+		}()
+	}
+}
+
+func TestHeaderCodecMalformedLength(t *testing.T) {
+	codec := &Common.HeaderCodec{LengthSize: 2, TypeSize: 2, ByteOrder: binary.LittleEndian, LengthIncludesHeader: true}
+	if _, _, err := codec.Decode([]byte{3, 0, 0, 0}, 0); !errors.Is(err, Common.ErrMalformedFrame) {
+		t.Fatalf("length shorter than the header returned %v", err)
+	}
+}
+
+func TestSendRefusesOversizedFrames(t *testing.T) {
+	codec := &Common.HeaderCodec{LengthSize: 2, TypeSize: 2, ByteOrder: binary.LittleEndian}
+	p := newPlayer(t, "codec-overflow", &Common.SessionConfig{Codec: codec, SplitSize: -1})
+
+	if err := p.SendFrame(Common.EPacketGameLogic, make([]byte, 70000)); !errors.Is(err, Common.ErrFrameTooLarge) {
+		t.Fatalf("SendFrame returned %v", err)
+	}
+
+	// a frame built by hand whose length wrapped around
+	var pak Packet.Packet
+	pak.WriteUint16(70000 & 0xFFFF)
+	pak.WriteUint16(Common.EPacketGameLogic)
+	pak.Write(make([]byte, 70000))
+	if err := p.SendPacket(pak); !errors.Is(err, Common.ErrMalformedFrame) {
+		t.Fatalf("SendPacket returned %v", err)
+	}
+
+	if sent := p.fake.Sent(); len(sent) != 0 {
+		t.Fatalf("%d buffers sent", len(sent))
+	}
+
+	if err := p.SendFrame(Common.EPacketGameLogic, make([]byte, 65535)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionWithVarintCodec(t *testing.T) {
+	codec := &Common.VarintCodec{WithType: true}
+	p := newPlayer(t, "codec-varint", &Common.SessionConfig{Codec: codec})
+
+	stream := append(codec.Encode(Common.EPacketGameLogic, []byte("one")), codec.Encode(Common.EPacketGameLogic, []byte("two"))...)
+	for i := range stream {
+		if !p.recv(stream[i : i+1]) {
+			t.Fatal("session closed")
+		}
+	}
+	p.OnUpdate(0)
+
+	msgs := p.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages", len(msgs))
+	}
+	if b := msgs[1].GetUsedBuffer()[msgs[1].GetReadPos():]; string(b) != "two" {
+		t.Fatalf("second message %q", b)
+	}
+
+	// an unknown frame type closes the session
+	if p.recv(codec.Encode(0x99, []byte("x"))) {
+		t.Fatal("unknown frame type accepted")
+	}
+}
+
+func TestRecvErrorIsCloseCause(t *testing.T) {
+	p := newPlayer(t, "codec-cause", &Common.SessionConfig{MaxFrameSize: 16})
+	if p.recv(networktest.EncodeFrame(0x99, []byte("x"))) || !errors.Is(p.CloseCause(), Common.ErrMalformedFrame) {
+		t.Fatalf("unknown type closed with %v", p.CloseCause())
+	}
+
+	p = newPlayer(t, "codec-cause", nil)
+	if p.recv(networktest.EncodeFrame(Common.EPacketGameLogic, make([]byte, 17))) || !errors.Is(p.CloseCause(), Common.ErrFrameTooLarge) {
+		t.Fatalf("large frame closed with %v", p.CloseCause())
+	}
+
+	p = newPlayer(t, "codec-cause", nil)
+	if p.recv(networktest.EncodeFrame(Common.EPacketRpc, []byte{1})) || !errors.Is(p.CloseCause(), Common.ErrFrameRefused) {
+		t.Fatalf("bad rpc closed with %v", p.CloseCause())
+	}
+}
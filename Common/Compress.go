@@ -0,0 +1,226 @@
+package Common
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Packet"
+)
+
+// EPacketCompressed is or-ed into the action type of a frame whose payload is compressed,
+// decrypted first for EPacketGameLogicEncrypted. Compressed payload:
+// 1 byte algorithm + 4 bytes decompressed size + compressed data
+const EPacketCompressed = 0x80
+
+const compressHeadLength = 5
+
+// netOpCompress body: 1 byte mask of the algorithms the sender decompresses.
+// A side compresses only after receiving it.
+
+type CompressAlgorithm uint8
+
+const (
+	CompressFlate CompressAlgorithm = 1
+	CompressZlib  CompressAlgorithm = 2
+)
+
+const compressSupported = 1<<CompressFlate | 1<<CompressZlib
+
+var ErrDecompressedTooLarge = errors.New("decompressed payload too large")
+
+// CompressionConfig enables the compression of large frames of a service.
+type CompressionConfig struct {
+	Algorithm CompressAlgorithm // 0 means CompressFlate
+	Level     int               // flate level, 0 means flate.DefaultCompression
+
+	// Threshold is the smallest payload compressed, 0 means 1024.
+	Threshold int
+
+	// MaxDecompressedSize caps a received payload once decompressed, 0 means the MaxFrameSize
+	// of the service, which caps it anyway.
+	MaxDecompressedSize int
+
+	stats CompressionStats
+}
+
+// CompressionStats counts the frames of a service, updated atomically.
+type CompressionStats struct {
+	Compressed   int64 // frames sent compressed
+	RawBytes     int64 // their size before compression
+	PackedBytes  int64 // their size after compression
+	Skipped      int64 // frames above the threshold sent raw, compression did not make them smaller
+	Decompressed int64 // frames received compressed
+}
+
+// Ratio returns the compressed size over the raw size of the frames sent, 1 when none was compressed.
+func (st CompressionStats) Ratio() float64 {
+	if st.RawBytes == 0 {
+		return 1
+	}
+	return float64(st.PackedBytes) / float64(st.RawBytes)
+}
+
+// Stats returns a snapshot of the counters of the service.
+func (c *CompressionConfig) Stats() CompressionStats {
+	return CompressionStats{
+		Compressed:   atomic.LoadInt64(&c.stats.Compressed),
+		RawBytes:     atomic.LoadInt64(&c.stats.RawBytes),
+		PackedBytes:  atomic.LoadInt64(&c.stats.PackedBytes),
+		Skipped:      atomic.LoadInt64(&c.stats.Skipped),
+		Decompressed: atomic.LoadInt64(&c.stats.Decompressed),
+	}
+}
+
+func (c *CompressionConfig) algorithm() CompressAlgorithm {
+	if c.Algorithm == 0 {
+		return CompressFlate
+	}
+	return c.Algorithm
+}
+
+func (c *CompressionConfig) threshold() int {
+	if c.Threshold <= 0 {
+		return 1024
+	}
+	return c.Threshold
+}
+
+func (cfg *SessionConfig) maxDecompressedSize() int {
+	max := cfg.maxFrameSize()
+	if c := cfg.Compression; c != nil && c.MaxDecompressedSize > 0 && c.MaxDecompressedSize < max {
+		return c.MaxDecompressedSize
+	}
+	return max
+}
+
+func isCompressible(actionType uint16) bool {
+	switch actionType {
+	case EPacketGameLogic, EPacketBroadcast, EPacketGameLogicEncrypted, EPacketRpc:
+		return true
+	}
+	return false
+}
+
+// announceCompression tells the peer it may send compressed frames, when the codec carries the flag.
+func (s *SessionPlayerBase) announceCompression() {
+	if !carriesType(s.codec) {
+		return
+	}
+
+	var pak Packet.Packet
+	pak.WriteUint8(netOpCompress)
+	pak.WriteUint8(compressSupported)
+	s.SendFrame(EPacketNetworkInternal, pak.GetUsedBuffer())
+}
+
+func (s *SessionPlayerBase) onCompressAnnounce(pak *Packet.Packet) bool {
+	atomic.StoreInt32(&s.peerCompress, int32(pak.ReadUint8()))
+	return true
+}
+
+// compress returns the payload to send and the flag to or into its action type. Nothing is
+// compressed with a codec not carrying the flag.
+func (s *SessionPlayerBase) compress(payload []byte) ([]byte, uint16) {
+	cfg := s.cfg.Compression
+	if cfg == nil || len(payload) < cfg.threshold() || !carriesType(s.codec) {
+		return payload, 0
+	}
+
+	algo := cfg.algorithm()
+	if atomic.LoadInt32(&s.peerCompress)&(1<<algo) == 0 {
+		return payload, 0
+	}
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, compressHeadLength))
+
+	level := cfg.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	var w io.WriteCloser
+	var err error
+	if algo == CompressZlib {
+		w, err = zlib.NewWriterLevel(&buf, level)
+	} else {
+		w, err = flate.NewWriter(&buf, level)
+	}
+	if err == nil {
+		_, err = w.Write(payload)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		slog.Warn("compress failed:", err)
+		return payload, 0
+	}
+
+	out := buf.Bytes()
+	if len(out) >= len(payload) {
+		atomic.AddInt64(&cfg.stats.Skipped, 1)
+		return payload, 0
+	}
+
+	out[0] = byte(algo)
+	binary.LittleEndian.PutUint32(out[1:compressHeadLength], uint32(len(payload)))
+
+	atomic.AddInt64(&cfg.stats.Compressed, 1)
+	atomic.AddInt64(&cfg.stats.RawBytes, int64(len(payload)))
+	atomic.AddInt64(&cfg.stats.PackedBytes, int64(len(out)))
+	return out, EPacketCompressed
+}
+
+// decompress inflates a compressed payload, refusing more than MaxDecompressedSize.
+func (s *SessionPlayerBase) decompress(data []byte) ([]byte, error) {
+	if len(data) < compressHeadLength {
+		return nil, ErrMalformedFrame
+	}
+
+	maxSize := s.cfg.maxDecompressedSize()
+	size := int(binary.LittleEndian.Uint32(data[1:compressHeadLength]))
+	if size > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	src := bytes.NewReader(data[compressHeadLength:])
+	var r io.ReadCloser
+	var err error
+	switch CompressAlgorithm(data[0]) {
+	case CompressFlate:
+		r = flate.NewReader(src)
+	case CompressZlib:
+		r, err = zlib.NewReader(src)
+	default:
+		err = ErrMalformedFrame
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out := make([]byte, 0, size)
+	buf := bytes.NewBuffer(out)
+	n, err := io.Copy(buf, io.LimitReader(r, int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+	if int(n) != size {
+		if int(n) > size {
+			return nil, ErrDecompressedTooLarge
+		}
+		return nil, ErrMalformedFrame
+	}
+
+	if cfg := s.cfg.Compression; cfg != nil {
+		atomic.AddInt64(&cfg.stats.Decompressed, 1)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,119 @@
+package Common_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+// deflated returns payload compressed with CompressFlate, with its 5-byte header.
+func deflated(t *testing.T, payload []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(Common.CompressFlate))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(payload)))
+
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(payload)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	cfg := &Common.SessionConfig{Compression: &Common.CompressionConfig{}}
+	a := newPlayer(t, "compress-round", cfg)
+	b := newPlayer(t, "compress-round", nil)
+	pump(a, b)
+	a.fake.ClearSent()
+	a.read = 0
+
+	payload := bytes.Repeat([]byte("compress me "), 1000)
+	if err := a.SendFrame(Common.EPacketGameLogic, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := a.sentFrames(t)
+	if len(frames) != 1 || frames[0].Type != Common.EPacketGameLogic|Common.EPacketCompressed || len(frames[0].Body) >= len(payload) {
+		t.Fatalf("sent %d frames", len(frames))
+	}
+
+	pump(a, b)
+	b.OnUpdate(0)
+	if msgs := b.messages(); len(msgs) != 1 || !bytes.Equal(payloadOf(msgs[0]), payload) {
+		t.Fatalf("%d messages", len(msgs))
+	}
+
+	if st := cfg.Compression.Stats(); st.Compressed != 1 || st.Decompressed != 1 || st.Ratio() >= 1 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestCompressedFramesRefusedWithoutCompression(t *testing.T) {
+	p := newPlayer(t, "compress-none", nil)
+
+	frame := networktest.EncodeFrame(Common.EPacketGameLogic|Common.EPacketCompressed, deflated(t, []byte("hello")))
+	if p.recv(frame) {
+		t.Fatal("compressed frame accepted")
+	}
+}
+
+func TestDecompressionCappedByMaxFrameSize(t *testing.T) {
+	cfg := &Common.SessionConfig{MaxFrameSize: 1000, Compression: &Common.CompressionConfig{MaxDecompressedSize: 1 << 20}}
+
+	p := newPlayer(t, "compress-cap", cfg)
+	if !p.recv(networktest.EncodeFrame(Common.EPacketGameLogic|Common.EPacketCompressed, deflated(t, make([]byte, 1000)))) {
+		t.Fatal("frame of MaxFrameSize refused")
+	}
+
+	if p.recv(networktest.EncodeFrame(Common.EPacketGameLogic|Common.EPacketCompressed, deflated(t, make([]byte, 1001)))) {
+		t.Fatal("frame above MaxFrameSize accepted")
+	}
+}
+
+func TestNoCompressionWithTypelessCodecs(t *testing.T) {
+	codec := &Common.VarintCodec{}
+	p := newPlayer(t, "compress-typeless", &Common.SessionConfig{Codec: codec, Compression: &Common.CompressionConfig{}})
+	if sent := p.fake.Sent(); len(sent) != 0 {
+		t.Fatalf("%d buffers sent on open", len(sent))
+	}
+
+	payload := bytes.Repeat([]byte("x"), 4096)
+	if err := p.SendFrame(Common.EPacketGameLogic, payload); err != nil {
+		t.Fatal(err)
+	}
+	if sent := p.fake.Sent(); len(sent) != 1 || !bytes.Equal(sent[0], codec.Encode(Common.EPacketGameLogic, payload)) {
+		t.Fatal("not sent raw")
+	}
+}
+
+func TestSealedCompressedFlagIsAuthenticated(t *testing.T) {
+	client, server := cryptoPair(t, "compress-sealed",
+		&Common.SessionConfig{Compression: &Common.CompressionConfig{}},
+		&Common.SessionConfig{Compression: &Common.CompressionConfig{}})
+	pump(client, server)
+
+	payload := bytes.Repeat([]byte("sealed "), 1000)
+	if err := client.SendFrame(Common.EPacketGameLogic, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := client.fake.Sent()
+	frame := append([]byte{}, sent[len(sent)-1]...)
+	if typ := binary.LittleEndian.Uint16(frame[4:]); typ != Common.EPacketGameLogicEncrypted|Common.EPacketCompressed {
+		t.Fatalf("sent type %#x", typ)
+	}
+
+	// the flag cleared, the payload would be taken as raw
+	binary.LittleEndian.PutUint16(frame[4:], Common.EPacketGameLogicEncrypted)
+	if server.recv(frame) {
+		t.Fatal("frame with its flag cleared accepted")
+	}
+}
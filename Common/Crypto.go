@@ -0,0 +1,358 @@
+package Common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Packet"
+)
+
+// handshake:
+// initiator -> netOpHello:      32 bytes X25519 public key
+// responder -> netOpHelloReply: 32 bytes X25519 public key + [64 bytes ed25519 signature]
+// The responder signs handshakeLabel + initiator key + responder key with its static key.
+//
+// EPacketGameLogicEncrypted body:
+// 8 bytes sequence + AES-GCM sealed (2 bytes frame type + payload), the sequence is the nonce,
+// the additional data is the sequence + the 2 bytes type of the outer frame, compressed flag
+// included. Each direction has its own key and its sequence starts at 1.
+// Once the service has a CryptoConfig every frame but the handshake goes sealed.
+const handshakeLabel = "Cactus handshake v1"
+
+const sealSeqLength = 8
+const sealTypeLength = 2
+
+var ErrHandshakeFailed = errors.New("handshake failed")
+
+// CryptoConfig enables the encryption of the frames of a service. Both sides must
+// set it, one of them as Initiator.
+type CryptoConfig struct {
+	// Initiator sends the hello as soon as the session is opened, normally the client.
+	Initiator bool
+
+	// StaticKey, on the responder, signs the handshake so the initiator can authenticate it.
+	StaticKey ed25519.PrivateKey
+
+	// PeerKey, on the initiator, is the static key the responder must sign with. nil accepts
+	// any responder.
+	PeerKey ed25519.PublicKey
+
+	// HandshakeTimeout closes the session when the handshake is not done in time, 0 means 10s.
+	HandshakeTimeout time.Duration
+}
+
+func (c *CryptoConfig) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return c.HandshakeTimeout
+}
+
+// cryptoState is the encryption part of SessionPlayerBase.
+type cryptoState struct {
+	mutex   sync.Mutex
+	started time.Time
+	key     *ecdh.PrivateKey
+	ready   bool
+	failed  bool
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+	queue   []sealedFrame // frames sent before the handshake completed
+}
+
+type sealedFrame struct {
+	actionType uint16
+	payload    []byte
+}
+
+// startHandshake sends the hello of the initiator, from OnOpened.
+func (s *SessionPlayerBase) startHandshake() {
+	st := &s.crypto
+	if !s.cfg.Crypto.Initiator {
+		return
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		slog.Error("handshake:", err)
+		return
+	}
+
+	st.mutex.Lock()
+	st.key = key
+	st.mutex.Unlock()
+
+	var pak Packet.Packet
+	pak.WriteUint8(netOpHello)
+	pak.Write(key.PublicKey().Bytes())
+	s.SendFrame(EPacketNetworkInternal, pak.GetUsedBuffer())
+}
+
+// onHandshake handles a handshake op, returning false when the session must be closed.
+func (s *SessionPlayerBase) onHandshake(op uint8, pak *Packet.Packet) bool {
+	cfg := s.cfg.Crypto
+	if cfg == nil {
+		slog.Warn("handshake: encryption not enabled:", s.Session.GetServiceKey(), s.GetID())
+		return false
+	}
+
+	data := packetPayload(pak)
+	if len(data) < 32 {
+		return s.failHandshake("short handshake packet")
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(data[:32])
+	if err != nil {
+		return s.failHandshake(err.Error())
+	}
+
+	st := &s.crypto
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.ready || st.failed {
+		return s.failHandshakeLocked("unexpected handshake packet")
+	}
+
+	var initPub, respPub []byte
+	switch {
+	case op == netOpHello && !cfg.Initiator && st.key == nil:
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return s.failHandshakeLocked(err.Error())
+		}
+		st.key = key
+		initPub, respPub = peer.Bytes(), key.PublicKey().Bytes()
+
+		var reply Packet.Packet
+		reply.WriteUint8(netOpHelloReply)
+		reply.Write(respPub)
+		if cfg.StaticKey != nil {
+			reply.Write(ed25519.Sign(cfg.StaticKey, handshakeTranscript(initPub, respPub)))
+		}
+		if err := s.SendFrame(EPacketNetworkInternal, reply.GetUsedBuffer()); err != nil {
+			return s.failHandshakeLocked(err.Error())
+		}
+
+	case op == netOpHelloReply && cfg.Initiator && st.key != nil:
+		initPub, respPub = st.key.PublicKey().Bytes(), peer.Bytes()
+
+		if cfg.PeerKey != nil {
+			sig := data[32:]
+			if len(sig) != ed25519.SignatureSize || !ed25519.Verify(cfg.PeerKey, handshakeTranscript(initPub, respPub), sig) {
+				return s.failHandshakeLocked("bad peer signature")
+			}
+		}
+
+	default:
+		return s.failHandshakeLocked("unexpected handshake packet")
+	}
+
+	shared, err := st.key.ECDH(peer)
+	if err != nil {
+		return s.failHandshakeLocked(err.Error())
+	}
+	st.key = nil
+
+	i2r, err := newSealer(shared, "initiator", initPub, respPub)
+	if err != nil {
+		return s.failHandshakeLocked(err.Error())
+	}
+	r2i, err := newSealer(shared, "responder", initPub, respPub)
+	if err != nil {
+		return s.failHandshakeLocked(err.Error())
+	}
+
+	if cfg.Initiator {
+		st.send, st.recv = i2r, r2i
+	} else {
+		st.send, st.recv = r2i, i2r
+	}
+	st.ready = true
+
+	queue := st.queue
+	st.queue = nil
+	for _, f := range queue {
+		if err := s.sealAndSendLocked(f.actionType, f.payload); err != nil {
+			slog.Warn("send queued packet failed:", err)
+		}
+	}
+
+	return true
+}
+
+func (s *SessionPlayerBase) failHandshake(reason string) bool {
+	s.crypto.mutex.Lock()
+	defer s.crypto.mutex.Unlock()
+
+	return s.failHandshakeLocked(reason)
+}
+
+func (s *SessionPlayerBase) failHandshakeLocked(reason string) bool {
+	slog.Warn("handshake failed:", s.Session.GetServiceKey(), s.GetID(), reason)
+	s.crypto.failed = true
+	s.crypto.queue = nil
+	return false
+}
+
+// checkHandshake closes the session when the handshake takes too long, from OnUpdate.
+func (s *SessionPlayerBase) checkHandshake() {
+	if s.cfg.Crypto == nil {
+		return
+	}
+
+	st := &s.crypto
+	st.mutex.Lock()
+	expired := !st.ready && !st.failed && time.Since(st.started) > s.cfg.Crypto.handshakeTimeout()
+	if expired {
+		st.failed = true
+		st.queue = nil
+	}
+	st.mutex.Unlock()
+
+	if expired {
+		slog.Warn("handshake timeout:", s.Session.GetServiceKey(), s.GetID())
+		s.Session.Shutdown(true)
+	}
+}
+
+func handshakeTranscript(initPub, respPub []byte) []byte {
+	b := make([]byte, 0, len(handshakeLabel)+len(initPub)+len(respPub))
+	b = append(b, handshakeLabel...)
+	b = append(b, initPub...)
+	return append(b, respPub...)
+}
+
+// newSealer derives the key of one direction from the shared secret.
+func newSealer(shared []byte, direction string, initPub, respPub []byte) (cipher.AEAD, error) {
+	prk := hmac.New(sha256.New, []byte(handshakeLabel))
+	prk.Write(shared)
+
+	mac := hmac.New(sha256.New, prk.Sum(nil))
+	mac.Write([]byte(direction))
+	mac.Write(initPub)
+	mac.Write(respPub)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// isHandshake tells whether a frame is a handshake op, the only one going plain with a CryptoConfig.
+func isHandshake(actionType uint16, payload []byte) bool {
+	return actionType == EPacketNetworkInternal && len(payload) > 0 &&
+		(payload[0] == netOpHello || payload[0] == netOpHelloReply)
+}
+
+// mustSeal tells whether a frame goes encrypted.
+func (s *SessionPlayerBase) mustSeal(actionType uint16, payload []byte) bool {
+	return s.cfg.Crypto != nil && !isHandshake(actionType, payload)
+}
+
+// sendSealed encrypts a frame into an EPacketGameLogicEncrypted frame. Before the handshake
+// completes the frame is queued.
+func (s *SessionPlayerBase) sendSealed(actionType uint16, payload []byte) error {
+	st := &s.crypto
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.failed {
+		return ErrHandshakeFailed
+	}
+
+	if !st.ready {
+		st.queue = append(st.queue, sealedFrame{actionType, append([]byte{}, payload...)})
+		return nil
+	}
+
+	return s.sealAndSendLocked(actionType, payload)
+}
+
+// sealAndSendLocked runs under the crypto lock, so frames go out in sequence order. A sealed
+// frame larger than SplitSize goes out in parts, not sealed again.
+func (s *SessionPlayerBase) sealAndSendLocked(actionType uint16, payload []byte) error {
+	st := &s.crypto
+	st.sendSeq++
+
+	// compressed before, ciphertext does not compress
+	var flag uint16
+	if isCompressible(actionType) {
+		payload, flag = s.compress(payload)
+	}
+
+	plain := make([]byte, sealTypeLength+len(payload))
+	binary.LittleEndian.PutUint16(plain, actionType)
+	copy(plain[sealTypeLength:], payload)
+
+	body := make([]byte, sealSeqLength, sealSeqLength+len(plain)+st.send.Overhead())
+	binary.LittleEndian.PutUint64(body, st.sendSeq)
+	body = st.send.Seal(body, sealNonce(st.send, st.sendSeq), plain, sealAdditionalData(body, EPacketGameLogicEncrypted|flag))
+
+	b, err := encodeFrame(s.codec, EPacketGameLogicEncrypted|flag, body)
+	if err != nil {
+		return err
+	}
+	return s.sendFrameData(b)
+}
+
+// openSealed decrypts the body of an EPacketGameLogicEncrypted frame of type frameType, ok is
+// false when it is forged or replayed.
+func (s *SessionPlayerBase) openSealed(frameType uint16, body []byte) (actionType uint16, payload []byte, ok bool) {
+	st := &s.crypto
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if !st.ready || len(body) < sealSeqLength {
+		return
+	}
+
+	seq := binary.LittleEndian.Uint64(body)
+	if seq <= st.recvSeq {
+		return
+	}
+
+	plain, err := st.recv.Open(nil, sealNonce(st.recv, seq), body[sealSeqLength:], sealAdditionalData(body, frameType))
+	if err != nil || len(plain) < sealTypeLength {
+		return
+	}
+
+	st.recvSeq = seq
+	return binary.LittleEndian.Uint16(plain), plain[sealTypeLength:], true
+}
+
+// sealAdditionalData returns the sequence at the front of body followed by the frame type.
+func sealAdditionalData(body []byte, frameType uint16) []byte {
+	ad := make([]byte, sealSeqLength+2)
+	copy(ad, body[:sealSeqLength])
+	binary.LittleEndian.PutUint16(ad[sealSeqLength:], frameType)
+	return ad
+}
+
+func sealNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// isSealable tells whether a frame type may be found inside an EPacketGameLogicEncrypted frame.
+func isSealable(actionType uint16) bool {
+	switch actionType {
+	case EPacketNetworkInternal, EPacketGameLogic, EPacketBroadcast, EPacketRpc:
+		return true
+	}
+	return false
+}
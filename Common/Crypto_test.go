@@ -0,0 +1,166 @@
+package Common_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+	"github.com/zhksoftGo/Packet"
+)
+
+// cryptoPair returns an initiator and a responder of the services svc-client and svc-server.
+func cryptoPair(t *testing.T, svc string, client, server *Common.SessionConfig) (*testPlayer, *testPlayer) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Crypto = &Common.CryptoConfig{Initiator: true, PeerKey: pub}
+	server.Crypto = &Common.CryptoConfig{StaticKey: priv}
+
+	return newPlayer(t, svc+"-client", client), newPlayer(t, svc+"-server", server)
+}
+
+func TestHandshakeStartsOnOpened(t *testing.T) {
+	Common.SetSessionConfig("crypto-open", &Common.SessionConfig{Crypto: &Common.CryptoConfig{Initiator: true}})
+
+	p := &testPlayer{fake: networktest.NewFakeSession("crypto-open")}
+	p.Initialize(p.fake, p)
+	if sent := p.fake.Sent(); len(sent) != 0 {
+		t.Fatalf("%d buffers sent before OnOpened", len(sent))
+	}
+
+	p.OnOpened()
+	frames := p.sentFrames(t)
+	if len(frames) != 1 || frames[0].Type != Common.EPacketNetworkInternal || frames[0].Body[0] != 1 {
+		t.Fatalf("sent %v", frames)
+	}
+}
+
+func TestCryptoSealsEveryFrame(t *testing.T) {
+	rpc := Common.NewRpcServer()
+	rpc.Register("echo", func(call *Common.RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+		s := req.ReadString()
+		return packet(func(pak *Packet.Packet) { pak.WriteString(s) }), nil
+	})
+	client, server := cryptoPair(t, "crypto-seal",
+		&Common.SessionConfig{RpcTimeout: time.Second}, &Common.SessionConfig{Rpc: rpc})
+
+	// sent before the handshake, held back until it is done
+	if err := client.SendFrame(Common.EPacketGameLogic, []byte("early")); err != nil {
+		t.Fatal(err)
+	}
+	link(t, client, server)
+
+	resp, err := client.Call(context.Background(), "echo", packet(func(pak *Packet.Packet) { pak.WriteString("secret") }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := resp.ReadString(); s != "secret" {
+		t.Fatalf("echo returned %q", s)
+	}
+
+	if err := client.SendPacket(framePacket(Common.DefaultCodec, Common.EPacketBroadcast, []byte("all"))); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, time.Second, func() bool { return len(server.messages()) == 2 })
+
+	msgs := server.messages()
+	if string(payloadOf(msgs[0])) != "early" || string(payloadOf(msgs[1])) != "all" {
+		t.Fatalf("received %q, %q", payloadOf(msgs[0]), payloadOf(msgs[1]))
+	}
+
+	for _, p := range []*testPlayer{client, server} {
+		frames := p.sentFrames(t)
+		if frames[0].Type != Common.EPacketNetworkInternal {
+			t.Fatalf("first frame type %#x", frames[0].Type)
+		}
+		for _, f := range frames[1:] {
+			if f.Type != Common.EPacketGameLogicEncrypted {
+				t.Fatalf("plain frame type %#x after the handshake", f.Type)
+			}
+		}
+	}
+}
+
+func TestCryptoRefusesPlainFrames(t *testing.T) {
+	plain := map[string][]byte{
+		"game logic": networktest.EncodeFrame(Common.EPacketGameLogic, []byte("x")),
+		"broadcast":  networktest.EncodeFrame(Common.EPacketBroadcast, []byte("x")),
+		"rpc":        networktest.EncodeFrame(Common.EPacketRpc, []byte{1, 0, 0, 0, 0}),
+		"ping":       networktest.EncodeFrame(Common.EPacketNetworkInternal, []byte{3, 0, 0, 0, 0, 0, 0, 0, 0}),
+		"compressed": networktest.EncodeFrame(Common.EPacketGameLogic|Common.EPacketCompressed, []byte{1, 'x'}),
+	}
+
+	for name, frame := range plain {
+		client, server := cryptoPair(t, "crypto-plain", &Common.SessionConfig{}, &Common.SessionConfig{})
+		pump(client, server)
+
+		if server.recv(frame) {
+			t.Fatalf("%s: accepted by the responder", name)
+		}
+		if client.recv(frame) {
+			t.Fatalf("%s: accepted by the initiator", name)
+		}
+	}
+}
+
+func TestCryptoRefusesWrongPeerKey(t *testing.T) {
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Common.SessionConfig{}
+	client, server := cryptoPair(t, "crypto-peer", cfg, &Common.SessionConfig{})
+	cfg.Crypto.PeerKey = other
+
+	client.forward(server)
+	server.forward(client)
+	if shutdown, _ := client.fake.IsShutdown(); !shutdown {
+		t.Fatal("wrong responder accepted")
+	}
+}
+
+func TestCryptoSplitsSealedFrames(t *testing.T) {
+	client, server := cryptoPair(t, "crypto-split",
+		&Common.SessionConfig{SplitSize: 64}, &Common.SessionConfig{SplitSize: 64})
+	pump(client, server)
+
+	payload := bytes.Repeat([]byte("secret"), 50)
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendPacket(framePacket(Common.DefaultCodec, Common.EPacketGameLogic, payload)) }()
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SendPacket blocked")
+	}
+
+	frames := client.sentFrames(t)[1:]
+	if len(frames) < 2 {
+		t.Fatalf("sent %d frames", len(frames))
+	}
+	for _, f := range frames {
+		if f.Type != Common.EPacketAutoSplitLarge {
+			t.Fatalf("frame type %#x", f.Type)
+		}
+	}
+	if bytes.Contains(client.fake.SentBytes(), []byte("secret")) {
+		t.Fatal("payload sent in clear")
+	}
+
+	pump(client, server)
+	server.OnUpdate(0)
+	if msgs := server.messages(); len(msgs) != 1 || !bytes.Equal(payloadOf(msgs[0]), payload) {
+		t.Fatalf("received %d messages", len(msgs))
+	}
+}
@@ -0,0 +1,123 @@
+package Common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Packet"
+)
+
+// heartbeat:
+// netOpPing: 8 bytes send time in unix nanoseconds
+// netOpPong: the ping data echoed back
+
+// heartbeatState is the heartbeat part of SessionPlayerBase.
+type heartbeatState struct {
+	mutex    sync.Mutex
+	elapsed  time.Duration // since the last ping
+	missed   int           // pings without pong
+	lastSeen time.Time
+	srtt     time.Duration
+	rttvar   time.Duration
+}
+
+// RTT returns the smoothed round trip time measured by the heartbeat, 0 before the first pong.
+func (s *SessionPlayerBase) RTT() time.Duration {
+	s.heartbeat.mutex.Lock()
+	defer s.heartbeat.mutex.Unlock()
+
+	return s.heartbeat.srtt
+}
+
+// Jitter returns the smoothed deviation of the round trip time.
+func (s *SessionPlayerBase) Jitter() time.Duration {
+	s.heartbeat.mutex.Lock()
+	defer s.heartbeat.mutex.Unlock()
+
+	return s.heartbeat.rttvar
+}
+
+// LastSeen returns when data was last received from the peer.
+func (s *SessionPlayerBase) LastSeen() time.Time {
+	s.heartbeat.mutex.Lock()
+	defer s.heartbeat.mutex.Unlock()
+
+	return s.heartbeat.lastSeen
+}
+
+func (s *SessionPlayerBase) markSeen() {
+	s.heartbeat.mutex.Lock()
+	s.heartbeat.lastSeen = time.Now()
+	s.heartbeat.mutex.Unlock()
+}
+
+// updateHeartbeat sends the pings and closes the session after too many missed pongs, from OnUpdate.
+func (s *SessionPlayerBase) updateHeartbeat(dt time.Duration) {
+	interval := s.cfg.HeartbeatInterval
+	if interval <= 0 {
+		return
+	}
+
+	hb := &s.heartbeat
+	hb.mutex.Lock()
+	hb.elapsed += dt
+	if hb.elapsed < interval {
+		hb.mutex.Unlock()
+		return
+	}
+	hb.elapsed = 0
+
+	missed := hb.missed
+	if missed < s.cfg.heartbeatMaxMissed() {
+		hb.missed++
+	}
+	hb.mutex.Unlock()
+
+	if missed >= s.cfg.heartbeatMaxMissed() {
+		slog.Warn("heartbeat timeout:", s.Session.GetServiceKey(), s.GetID(), missed)
+		s.Session.Shutdown(true)
+		return
+	}
+
+	var pak Packet.Packet
+	pak.WriteUint8(netOpPing)
+	pak.WriteInt64(time.Now().UnixNano())
+	s.SendFrame(EPacketNetworkInternal, pak.GetUsedBuffer())
+}
+
+// onHeartbeat handles a ping or a pong, on the network goroutine.
+func (s *SessionPlayerBase) onHeartbeat(op uint8, pak *Packet.Packet) bool {
+	if op == netOpPing {
+		var pong Packet.Packet
+		pong.WriteUint8(netOpPong)
+		pong.Write(packetPayload(pak))
+		s.SendFrame(EPacketNetworkInternal, pong.GetUsedBuffer())
+		return true
+	}
+
+	rtt := time.Since(time.Unix(0, pak.ReadInt64()))
+	if rtt < 0 {
+		rtt = 0
+	}
+
+	hb := &s.heartbeat
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+
+	hb.missed = 0
+	if hb.srtt == 0 {
+		hb.srtt = rtt
+		hb.rttvar = rtt / 2
+		return true
+	}
+
+	// RFC 6298 smoothing
+	diff := hb.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	hb.rttvar = (3*hb.rttvar + diff) / 4
+	hb.srtt = (7*hb.srtt + rtt) / 8
+	return true
+}
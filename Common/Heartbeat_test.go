@@ -0,0 +1,72 @@
+package Common_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+func TestPingIsAnswered(t *testing.T) {
+	p := newPlayer(t, "heartbeat-pong", nil)
+
+	ping := []byte{3, 1, 2, 3, 4, 5, 6, 7, 8}
+	if !p.recv(networktest.EncodeFrame(Common.EPacketNetworkInternal, ping)) {
+		t.Fatal("session closed")
+	}
+
+	frames := p.sentFrames(t)
+	if len(frames) != 1 || frames[0].Type != Common.EPacketNetworkInternal || frames[0].Body[0] != 4 || !bytes.Equal(frames[0].Body[1:], ping[1:]) {
+		t.Fatalf("answered %v", frames)
+	}
+	p.OnUpdate(0)
+	if msgs := p.messages(); len(msgs) != 0 {
+		t.Fatalf("%d messages", len(msgs))
+	}
+}
+
+func TestUnknownInternalOpCloses(t *testing.T) {
+	for _, op := range []byte{0, 12, 0xFF} {
+		p := newPlayer(t, "heartbeat-unknown", nil)
+		if p.recv(networktest.EncodeFrame(Common.EPacketNetworkInternal, []byte{op, 1, 2})) {
+			t.Fatalf("op %d accepted", op)
+		}
+
+		p.OnUpdate(0)
+		if msgs := p.messages(); len(msgs) != 0 {
+			t.Fatalf("op %d reached HandleInComingMsg", op)
+		}
+	}
+}
+
+func TestHeartbeatMeasuresRTT(t *testing.T) {
+	a := newPlayer(t, "heartbeat-rtt", &Common.SessionConfig{HeartbeatInterval: 5 * time.Millisecond})
+	b := newPlayer(t, "heartbeat-rtt", nil)
+	link(t, a, b)
+
+	waitUntil(t, time.Second, func() bool { return a.RTT() > 0 })
+	if shutdown, _ := a.fake.IsShutdown(); shutdown {
+		t.Fatal("session closed")
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	p := newPlayer(t, "heartbeat-timeout", &Common.SessionConfig{HeartbeatInterval: time.Second, HeartbeatMaxMissed: 2})
+
+	for i := 0; i < 2; i++ {
+		p.OnUpdate(time.Second)
+		if shutdown, _ := p.fake.IsShutdown(); shutdown {
+			t.Fatalf("closed after %d pings", i+1)
+		}
+	}
+	if frames := p.sentFrames(t); len(frames) != 2 {
+		t.Fatalf("%d pings sent", len(frames))
+	}
+
+	p.OnUpdate(time.Second)
+	if shutdown, _ := p.fake.IsShutdown(); !shutdown {
+		t.Fatal("not closed after the missed pongs")
+	}
+}
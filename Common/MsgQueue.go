@@ -0,0 +1,176 @@
+package Common
+
+import (
+	"time"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Packet"
+)
+
+// MsgPriority is the class of a received message, the higher ones are handled first.
+type MsgPriority int
+
+const (
+	MsgPriorityNormal MsgPriority = iota
+	MsgPriorityHigh
+	msgPriorityCount
+)
+
+// QueueOverflowPolicy is what a session does with a message received when its queue is full.
+type QueueOverflowPolicy int
+
+const (
+	// OverflowDrop drops the message.
+	OverflowDrop QueueOverflowPolicy = iota
+
+	// OverflowKick closes the session.
+	OverflowKick
+
+	// OverflowPauseRead queues the message and pauses reading the connection, as if
+	// QueueHighWatermark were MaxQueuedMsgs.
+	OverflowPauseRead
+)
+
+const DefaultMaxMsgPerUpdate = 5
+
+// QueueStats describes the queue of the messages received by a session.
+type QueueStats struct {
+	Depth    int   // messages waiting for OnUpdate
+	MaxDepth int   // highest depth reached
+	Dropped  int64 // messages dropped on overflow
+	Paused   bool  // reading is paused
+}
+
+// queuedMsg is a received message waiting for OnUpdate, with the type of its frame.
+type queuedMsg struct {
+	pak       *Packet.Packet
+	frameType uint16
+}
+
+// queueMsg queues a received message for OnUpdate, returning false when the session must be
+// closed.
+func (s *SessionPlayerBase) queueMsg(m queuedMsg) bool {
+	// a connection carrying a resumed player feeds its queue
+	if owner := s.resumeOwner(); owner != nil {
+		return owner.queueMsg(m)
+	}
+
+	prio := s.msgPriority(m)
+	if prio < 0 || prio >= msgPriorityCount {
+		prio = MsgPriorityNormal
+	}
+
+	s.pakQueueMutex.Lock()
+	defer s.pakQueueMutex.Unlock()
+
+	st := &s.queueStats
+	if max := s.cfg.MaxQueuedMsgs; max > 0 && st.Depth >= max && !st.Paused {
+		switch s.cfg.QueueOverflow {
+		case OverflowKick:
+			slog.Warn("message queue full, kicked:", s.Session.GetServiceKey(), s.GetID())
+			return false
+
+		case OverflowPauseRead:
+			s.GetNetworkSession().PauseRead()
+			st.Paused = true
+
+		default:
+			if st.Dropped == 0 {
+				slog.Warn("message queue full, dropping:", s.Session.GetServiceKey(), s.GetID())
+			}
+			st.Dropped++
+			return true
+		}
+	}
+
+	s.inbox[prio].PushBack(m)
+	st.Depth++
+	if st.Depth > st.MaxDepth {
+		st.MaxDepth = st.Depth
+	}
+
+	if high := s.cfg.pauseReadAt(); !st.Paused && high > 0 && st.Depth >= high {
+		s.GetNetworkSession().PauseRead()
+		st.Paused = true
+	}
+	return true
+}
+
+func (s *SessionPlayerBase) msgPriority(m queuedMsg) MsgPriority {
+	if s.cfg.Priority != nil {
+		return s.cfg.Priority(m.pak)
+	}
+	if r := s.cfg.Router; r != nil {
+		if id, ok := peekMsgID(m); ok {
+			return r.priorityOf(id)
+		}
+	}
+	return MsgPriorityNormal
+}
+
+// nextMsg pops the next message to handle, ok is false when none.
+func (s *SessionPlayerBase) nextMsg() (m queuedMsg, ok bool) {
+	s.pakQueueMutex.Lock()
+	defer s.pakQueueMutex.Unlock()
+
+	for prio := msgPriorityCount - 1; prio >= 0; prio-- {
+		if e := s.inbox[prio].Front(); e != nil {
+			s.inbox[prio].Remove(e)
+			s.queueStats.Depth--
+			return e.Value.(queuedMsg), true
+		}
+	}
+	return
+}
+
+// handleQueued handles the queued messages within the budget of the service, from OnUpdate.
+func (s *SessionPlayerBase) handleQueued() {
+	maxCount := s.cfg.maxMsgPerUpdate()
+	maxTime := s.cfg.MaxUpdateTime
+
+	var start time.Time
+	if maxTime > 0 {
+		start = time.Now()
+	}
+
+	for n := 0; n < maxCount; n++ {
+		if maxTime > 0 && n > 0 && time.Since(start) >= maxTime {
+			break
+		}
+
+		m, ok := s.nextMsg()
+		if !ok {
+			break
+		}
+		s.handleMsg(m)
+	}
+
+	// the network session is paused and resumed under the lock, so it follows queueStats.Paused
+	s.pakQueueMutex.Lock()
+	if s.queueStats.Paused && s.queueStats.Depth <= s.cfg.resumeReadAt() {
+		s.queueStats.Paused = false
+		s.GetNetworkSession().ResumeRead()
+	}
+	s.pakQueueMutex.Unlock()
+}
+
+// isReadPaused tells OnRecvMsg to keep the bytes received undecoded, until the network
+// delivers them again on resume.
+func (s *SessionPlayerBase) isReadPaused() bool {
+	if owner := s.resumeOwner(); owner != nil {
+		return owner.isReadPaused()
+	}
+
+	s.pakQueueMutex.Lock()
+	defer s.pakQueueMutex.Unlock()
+
+	return s.queueStats.Paused
+}
+
+// GetQueueStats returns the state of the queue of received messages.
+func (s *SessionPlayerBase) GetQueueStats() QueueStats {
+	s.pakQueueMutex.Lock()
+	defer s.pakQueueMutex.Unlock()
+
+	return s.queueStats
+}
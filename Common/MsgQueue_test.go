@@ -0,0 +1,171 @@
+package Common_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Packet"
+)
+
+func TestQueueUnboundedByDefault(t *testing.T) {
+	p := newPlayer(t, "queue-default", nil)
+
+	for i := 0; i < 5000; i++ {
+		if !p.recv(message(1, "")) {
+			t.Fatal("session closed")
+		}
+	}
+	if st := p.GetQueueStats(); st.Depth != 5000 || st.Dropped != 0 || st.Paused {
+		t.Fatalf("stats %+v", st)
+	}
+
+	// DefaultMaxMsgPerUpdate per tick
+	p.OnUpdate(0)
+	if n := len(p.messages()); n != Common.DefaultMaxMsgPerUpdate {
+		t.Fatalf("%d messages handled", n)
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	drop := newPlayer(t, "queue-drop", &Common.SessionConfig{MaxQueuedMsgs: 3})
+	for i := 0; i < 5; i++ {
+		if !drop.recv(message(1, "")) {
+			t.Fatal("session closed")
+		}
+	}
+	if st := drop.GetQueueStats(); st.Depth != 3 || st.MaxDepth != 3 || st.Dropped != 2 {
+		t.Fatalf("stats %+v", st)
+	}
+
+	kick := newPlayer(t, "queue-kick", &Common.SessionConfig{MaxQueuedMsgs: 3, QueueOverflow: Common.OverflowKick})
+	for i := 0; i < 3; i++ {
+		kick.recv(message(1, ""))
+	}
+	if kick.recv(message(1, "")) {
+		t.Fatal("not kicked")
+	}
+}
+
+func TestQueuePriorities(t *testing.T) {
+	r := Common.NewMessageRouter()
+	var order []string
+	handler := func(msg *Common.Msg, pak *Packet.Packet) { order = append(order, restOf(pak)) }
+	r.Handle(1, handler)
+	r.Handle(2, handler)
+	r.SetPriority(2, Common.MsgPriorityHigh)
+
+	p := newPlayer(t, "queue-prio", &Common.SessionConfig{Router: r, MaxMsgPerUpdate: 2})
+	for _, m := range [][]byte{message(1, "a"), message(1, "b"), message(2, "ctl1"), message(1, "c"), message(2, "ctl2")} {
+		p.recv(m)
+	}
+
+	p.OnUpdate(0)
+	if fmt.Sprint(order) != "[ctl1 ctl2]" {
+		t.Fatalf("first tick %v", order)
+	}
+	p.OnUpdate(0)
+	p.OnUpdate(0)
+	if fmt.Sprint(order) != "[ctl1 ctl2 a b c]" {
+		t.Fatalf("handled %v", order)
+	}
+}
+
+func TestQueueCustomPriority(t *testing.T) {
+	cfg := &Common.SessionConfig{
+		MaxMsgPerUpdate: 1,
+		Priority: func(pak *Packet.Packet) Common.MsgPriority {
+			if restOf(pak)[2:] == "urgent" {
+				return Common.MsgPriorityHigh
+			}
+			return Common.MsgPriorityNormal
+		},
+	}
+	p := newPlayer(t, "queue-custom", cfg)
+	p.recv(message(1, "late"))
+	p.recv(message(1, "urgent"))
+
+	p.OnUpdate(0)
+	if msgs := p.messages(); len(msgs) != 1 || restOf(msgs[0])[2:] != "urgent" {
+		t.Fatal("urgent message not first")
+	}
+}
+
+func TestOnRecvPacketIsRouted(t *testing.T) {
+	r := Common.NewMessageRouter()
+	var got []string
+	r.Handle(5, func(msg *Common.Msg, pak *Packet.Packet) { got = append(got, restOf(pak)) })
+
+	p := newPlayer(t, "queue-recvpacket", &Common.SessionConfig{Router: r})
+
+	pak := new(Packet.Packet)
+	pak.FromBuff(message(5, "routed"))
+	p.OnRecvPacket(pak)
+
+	// an RPC frame is not routed, though its payload starts like message 5
+	rpc := new(Packet.Packet)
+	rpc.FromBuff(append([]byte{2, 0, 0, 0, Common.EPacketRpc, 0}, 5, 0))
+	p.OnRecvPacket(rpc)
+
+	p.OnUpdate(0)
+	if fmt.Sprint(got) != "[routed]" || len(p.messages()) != 1 {
+		t.Fatalf("routed %v, %d to HandleInComingMsg", got, len(p.messages()))
+	}
+}
+
+func TestQueueWatermarksPauseReading(t *testing.T) {
+	p := newPlayer(t, "queue-watermarks", &Common.SessionConfig{QueueHighWatermark: 4, QueueLowWatermark: 2, MaxMsgPerUpdate: 1})
+
+	for i := 0; i < 4; i++ {
+		p.recv(message(1, fmt.Sprint(i)))
+	}
+	if !p.fake.IsReadPaused() || !p.GetQueueStats().Paused {
+		t.Fatal("not paused at the high watermark")
+	}
+
+	// received while paused, kept undecoded
+	p.recv(append(message(1, "4"), message(1, "5")...))
+	if st := p.GetQueueStats(); st.Depth != 4 {
+		t.Fatalf("depth %d while paused", st.Depth)
+	}
+
+	p.OnUpdate(0)
+	if !p.fake.IsReadPaused() {
+		t.Fatal("resumed above the low watermark")
+	}
+	p.OnUpdate(0)
+	if p.fake.IsReadPaused() || p.GetQueueStats().Paused {
+		t.Fatal("not resumed at the low watermark")
+	}
+
+	// the network delivers the held data again on resume
+	p.recv(nil)
+	for i := 0; i < 4; i++ {
+		p.OnUpdate(0)
+	}
+	var got []string
+	for _, m := range p.messages() {
+		got = append(got, restOf(m)[2:])
+	}
+	if fmt.Sprint(got) != "[0 1 2 3 4 5]" {
+		t.Fatalf("handled %v", got)
+	}
+}
+
+func TestOverflowPauseRead(t *testing.T) {
+	p := newPlayer(t, "queue-overflow-pause", &Common.SessionConfig{MaxQueuedMsgs: 2, QueueOverflow: Common.OverflowPauseRead})
+
+	p.recv(message(1, "a"))
+	if p.fake.IsReadPaused() {
+		t.Fatal("paused early")
+	}
+	p.recv(message(1, "b"))
+	if !p.fake.IsReadPaused() {
+		t.Fatal("not paused when full")
+	}
+
+	p.OnUpdate(0)
+	if p.fake.IsReadPaused() || p.GetQueueStats().Dropped != 0 {
+		t.Fatal("not resumed once handled")
+	}
+}
@@ -0,0 +1,697 @@
+package Common
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Packet"
+)
+
+// resumption:
+// server -> netOpResumeToken: string token, once logged in; without AuthConfig, once a game
+// logic or broadcast frame is sent or a frame other than an internal op is received
+// client -> netOpResumeAck:   8 bytes count of the game logic and broadcast frames received
+// client -> netOpResume:      string token + 8 bytes count received, on a new connection
+// server -> netOpResumeReply: 1 byte result + [8 bytes account ID | string reason]
+// The server keeps the game logic and broadcast frames sent to a player until acked. When its
+// connection drops the player is parked: it stays in its groups and its frames are kept, until
+// a new connection resumes it or the grace period ends and it closes for good. The new
+// connection carries the player from then on, the frames not acked are sent again first.
+// A connection failing to resume stays as it is, to log in.
+const (
+	resumeOK     = 0
+	resumeFailed = 1
+)
+
+// the client acks every resumeAckEvery frames, and from OnUpdate at most resumeAckInterval
+// after the last one
+const (
+	resumeAckEvery    = 32
+	resumeAckInterval = time.Second
+)
+
+const resumeTokenLength = 16
+
+var ErrResumeFailed = errors.New("resume failed")
+
+// ResumeError is the failure of a resume, as reported by the server.
+type ResumeError struct {
+	Reason string
+}
+
+func (e *ResumeError) Error() string {
+	return "resume failed: " + e.Reason
+}
+
+func (e *ResumeError) Is(target error) bool {
+	return target == ErrResumeFailed
+}
+
+// ResumeConfig parks the players whose connection drops, for a new connection to resume them.
+type ResumeConfig struct {
+	// GracePeriod is how long a parked player waits for a resume, 0 means 30s.
+	GracePeriod time.Duration
+
+	// MaxReplayBytes bounds the frames kept for a player until acked, 0 means 1MB. A player
+	// going beyond cannot be resumed anymore.
+	MaxReplayBytes int
+
+	mutex   sync.Mutex
+	players map[string]*SessionPlayerBase // by token
+}
+
+func (c *ResumeConfig) gracePeriod() time.Duration {
+	if c.GracePeriod <= 0 {
+		return 30 * time.Second
+	}
+	return c.GracePeriod
+}
+
+func (c *ResumeConfig) maxReplayBytes() int {
+	if c.MaxReplayBytes <= 0 {
+		return 1 << 20
+	}
+	return c.MaxReplayBytes
+}
+
+func (c *ResumeConfig) register(token string, s *SessionPlayerBase) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.players == nil {
+		c.players = make(map[string]*SessionPlayerBase)
+	}
+	c.players[token] = s
+}
+
+func (c *ResumeConfig) unregister(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.players, token)
+}
+
+func (c *ResumeConfig) lookup(token string) *SessionPlayerBase {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.players[token]
+}
+
+// replayEntry is a frame kept until acked, sent again on resume.
+type replayEntry struct {
+	data   []byte                // encoded frame, sent again with SendPacket
+	shared *Network.SharedBuffer // or a shared frame, sent again as is
+}
+
+func (e *replayEntry) size() int {
+	if e.shared != nil {
+		return len(e.shared.Bytes())
+	}
+	return len(e.data)
+}
+
+// resumeState is the resumption part of SessionPlayerBase. Its lock is held while sending,
+// so the frames are recorded in the order they go out.
+type resumeState struct {
+	mutex sync.Mutex
+
+	// server side
+	token     string
+	sent      uint64        // frames recorded
+	acked     uint64        // frames the client got
+	replay    []replayEntry // frames acked+1..sent
+	bytes     int
+	lost      bool // replay overflowed, cannot resume
+	kicked    bool // Shutdown called, the player closes with its connection
+	ended     bool // closed for good
+	parked    bool
+	timer     *time.Timer
+	transport *SessionPlayerBase // connection carrying the player since a resume
+	replaying *SessionPlayerBase // connection the kept frames are sent again on, new ones wait
+	owner     *SessionPlayerBase // player carried by this connection
+
+	// client side
+	peerToken  string
+	received   uint64
+	ackSent    uint64
+	ackElapsed time.Duration
+	resuming   bool
+	cb         func(accountID uint64, err error)
+}
+
+func (r *resumeState) dropReplay(n int) {
+	for i := 0; i < n; i++ {
+		e := &r.replay[i]
+		r.bytes -= e.size()
+		if e.shared != nil {
+			e.shared.Release()
+		}
+	}
+
+	rest := copy(r.replay, r.replay[n:])
+	for i := rest; i < len(r.replay); i++ {
+		r.replay[i] = replayEntry{}
+	}
+	r.replay = r.replay[:rest]
+}
+
+// issueResumeToken makes the player resumable, sending it its token.
+func (s *SessionPlayerBase) issueResumeToken() {
+	s.resume.mutex.Lock()
+	defer s.resume.mutex.Unlock()
+
+	s.issueResumeTokenLocked()
+}
+
+// issueResumeTokenLocked runs under the resume lock, so the client counts the frames recorded
+// from the token on. A connection carrying a resumed player gets none.
+func (s *SessionPlayerBase) issueResumeTokenLocked() {
+	r := &s.resume
+	if r.token != "" || r.ended || r.owner != nil {
+		return
+	}
+
+	b := make([]byte, resumeTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		slog.Error("resume token:", s.Session.GetServiceKey(), s.GetID(), err)
+		return
+	}
+	r.token = base64.RawURLEncoding.EncodeToString(b)
+	s.cfg.Resume.register(r.token, s)
+
+	var pak Packet.Packet
+	pak.WriteUint8(netOpResumeToken)
+	pak.WriteString(r.token)
+	s.sendFrame(EPacketNetworkInternal, pak.GetUsedBuffer())
+}
+
+// resumeWithoutAuth tells whether the token is issued without login, once the connection is
+// known not to resume another player.
+func (s *SessionPlayerBase) resumeWithoutAuth() bool {
+	return s.cfg.Resume != nil && s.cfg.Auth == nil
+}
+
+// resumeSend runs send on the connection carrying the player, recording the game logic and
+// broadcast frames of a resumable player. While parked they are only recorded, like while the
+// kept frames are sent again on a resume, to follow them. send runs under the resume lock, so
+// it must not come back here: the parts of a split frame go out as they are, see sendSplit.
+func (s *SessionPlayerBase) resumeSend(actionType uint16, entry func() replayEntry, send func(conn *SessionPlayerBase) error) error {
+	r := &s.resume
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	recorded := actionType == EPacketGameLogic || actionType == EPacketBroadcast
+	if recorded && s.resumeWithoutAuth() {
+		s.issueResumeTokenLocked()
+	}
+
+	if r.token == "" || r.ended {
+		return send(s)
+	}
+
+	if recorded {
+		s.recordLocked(entry())
+	}
+
+	if r.parked || (recorded && r.replaying != nil) {
+		return nil
+	}
+	if r.transport != nil {
+		return send(r.transport)
+	}
+	return send(s)
+}
+
+func (s *SessionPlayerBase) recordLocked(e replayEntry) {
+	r := &s.resume
+	if r.lost {
+		return
+	}
+
+	if r.bytes+e.size() > s.cfg.Resume.maxReplayBytes() {
+		slog.Warn("resume replay full, cannot resume:", s.Session.GetServiceKey(), s.GetID(), r.bytes)
+		r.lost = true
+		r.dropReplay(len(r.replay))
+		s.cfg.Resume.unregister(r.token)
+		return
+	}
+
+	if e.shared != nil {
+		e.shared.Retain()
+	}
+	r.replay = append(r.replay, e)
+	r.bytes += e.size()
+	r.sent++
+}
+
+// frameType returns the type of an encoded frame, EPacketNetworkInternal when undecodable so it
+// is not recorded.
+func (s *SessionPlayerBase) frameType(b []byte) uint16 {
+	frame, n, err := s.codec.Decode(b, 0)
+	if err != nil || n != len(b) {
+		return EPacketNetworkInternal
+	}
+	return frame.Type
+}
+
+func (s *SessionPlayerBase) resumeOwner() *SessionPlayerBase {
+	if s.cfg.Resume == nil {
+		return nil
+	}
+
+	s.resume.mutex.Lock()
+	defer s.resume.mutex.Unlock()
+
+	return s.resume.owner
+}
+
+// resumeConn returns the connection carrying the player, nil while parked.
+func (s *SessionPlayerBase) resumeConn() *SessionPlayerBase {
+	if s.cfg.Resume == nil {
+		return s
+	}
+
+	r := &s.resume
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.parked {
+		return nil
+	}
+	if r.transport != nil {
+		return r.transport
+	}
+	return s
+}
+
+// GetNetworkSession returns the connection carrying the session: Session, or the one it was
+// resumed on. The ID of the session stays the one of Session.
+func (s *SessionPlayerBase) GetNetworkSession() Network.INetworkSession {
+	if conn := s.resumeConn(); conn != nil {
+		return conn.Session
+	}
+	return s.Session
+}
+
+// IsParked tells whether the player lost its connection and waits for a resume.
+func (s *SessionPlayerBase) IsParked() bool {
+	s.resume.mutex.Lock()
+	defer s.resume.mutex.Unlock()
+
+	return s.resume.parked
+}
+
+// holdForResume is called when conn, the connection carrying the player, closes. It returns
+// false when the player must close for good, true when it is parked or already carried by
+// another connection.
+func (s *SessionPlayerBase) holdForResume(conn *SessionPlayerBase) bool {
+	cfg := s.cfg.Resume
+	if cfg == nil {
+		return false
+	}
+
+	r := &s.resume
+	r.mutex.Lock()
+	current := r.transport
+	if current == nil {
+		current = s
+	}
+	if conn != current {
+		r.mutex.Unlock()
+		return true
+	}
+
+	if r.token == "" || r.lost || r.kicked || r.ended || r.parked {
+		r.mutex.Unlock()
+		return false
+	}
+
+	r.parked = true
+	r.transport = nil
+	r.timer = time.AfterFunc(cfg.gracePeriod(), s.resumeExpired)
+	r.mutex.Unlock()
+
+	slog.Info("connection lost, waiting for resume:", s.Session.GetServiceKey(), s.GetID())
+	s.failRpcCalls(ErrRpcDisconnected)
+	return true
+}
+
+func (s *SessionPlayerBase) resumeExpired() {
+	s.resume.mutex.Lock()
+	parked := s.resume.parked
+	s.resume.mutex.Unlock()
+
+	if parked {
+		slog.Info("resume timeout:", s.Session.GetServiceKey(), s.GetID())
+		s.closeSession()
+	}
+}
+
+// kickResume keeps the player from being parked, returning true if it already is.
+func (s *SessionPlayerBase) kickResume() bool {
+	if s.cfg.Resume == nil {
+		return false
+	}
+
+	s.resume.mutex.Lock()
+	defer s.resume.mutex.Unlock()
+
+	s.resume.kicked = true
+	return s.resume.parked
+}
+
+// endResume forgets the token and the kept frames of a player closing for good.
+func (s *SessionPlayerBase) endResume() {
+	r := &s.resume
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.ended {
+		return
+	}
+	r.ended = true
+	r.parked = false
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.token != "" {
+		s.cfg.Resume.unregister(r.token)
+	}
+	r.dropReplay(len(r.replay))
+}
+
+// resumeOn makes conn carry the player, sending the reply and again the frames after received.
+func (s *SessionPlayerBase) resumeOn(conn *SessionPlayerBase, received uint64) error {
+	r := &s.resume
+	r.mutex.Lock()
+
+	if r.ended || r.lost || r.kicked {
+		r.mutex.Unlock()
+		return &ResumeError{Reason: "session closed"}
+	}
+	if received < r.acked || received > r.sent {
+		r.mutex.Unlock()
+		return &ResumeError{Reason: "bad sequence"}
+	}
+	r.dropReplay(int(received - r.acked))
+	r.acked = received
+
+	// a connection not noticed as lost yet is replaced
+	var old Network.INetworkSession
+	if !r.parked {
+		old = s.Session
+		if r.transport != nil {
+			old = r.transport.Session
+		}
+	}
+
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.parked = false
+	r.transport = conn
+	r.replaying = conn
+
+	conn.resume.mutex.Lock()
+	conn.resume.owner = s
+	conn.resume.mutex.Unlock()
+
+	replay, upTo := r.snapshotLocked(0), r.sent
+	r.mutex.Unlock()
+
+	var reply Packet.Packet
+	reply.WriteUint8(netOpResumeReply)
+	reply.WriteUint8(resumeOK)
+	reply.WriteUint64(s.GetAccountID())
+	conn.SendFrame(EPacketNetworkInternal, reply.GetUsedBuffer())
+
+	// sent without the lock, the frames recorded meanwhile wait and are sent next
+	for {
+		conn.sendReplay(replay)
+
+		r.mutex.Lock()
+		n := int(r.sent - upTo)
+		if n == 0 || r.lost || r.transport != conn {
+			if r.replaying == conn {
+				r.replaying = nil
+			}
+			r.mutex.Unlock()
+			break
+		}
+		replay, upTo = r.snapshotLocked(len(r.replay)-n), r.sent
+		r.mutex.Unlock()
+	}
+
+	// the new connection follows the queue of the player
+	s.pakQueueMutex.Lock()
+	if s.queueStats.Paused {
+		conn.Session.PauseRead()
+	}
+	s.pakQueueMutex.Unlock()
+
+	if old != nil {
+		old.Shutdown(true)
+	}
+	return nil
+}
+
+// snapshotLocked returns the kept frames from index from on, the shared ones retained until
+// sendReplay.
+func (r *resumeState) snapshotLocked(from int) []replayEntry {
+	if from < 0 {
+		from = 0
+	}
+
+	entries := append([]replayEntry(nil), r.replay[from:]...)
+	for i := range entries {
+		if entries[i].shared != nil {
+			entries[i].shared.Retain()
+		}
+	}
+	return entries
+}
+
+// sendReplay sends again the frames of a snapshot.
+func (s *SessionPlayerBase) sendReplay(entries []replayEntry) {
+	for i := range entries {
+		if e := &entries[i]; e.shared != nil {
+			s.sendShared(e.shared)
+			e.shared.Release()
+		} else {
+			s.sendPacket(e.data)
+		}
+	}
+}
+
+// onResume resumes the player of a token on this connection, on the server.
+func (s *SessionPlayerBase) onResume(pak *Packet.Packet) bool {
+	cfg := s.cfg.Resume
+	if cfg == nil {
+		slog.Warn("resume: resumption not enabled:", s.Session.GetServiceKey(), s.GetID())
+		return false
+	}
+
+	token, received := pak.ReadString(), pak.ReadUint64()
+
+	s.resume.mutex.Lock()
+	fresh := s.resume.token == "" && s.resume.owner == nil
+	s.resume.mutex.Unlock()
+
+	if !fresh || !s.authNotStarted() {
+		slog.Warn("resume: unexpected resume:", s.Session.GetServiceKey(), s.GetID())
+		return false
+	}
+
+	var err error
+	if player := cfg.lookup(token); player == nil {
+		err = &ResumeError{Reason: "unknown token"}
+	} else if err = player.resumeOn(s, received); err == nil {
+		s.authResumed()
+		slog.Info("resumed:", s.Session.GetServiceKey(), player.GetID(), "on", s.GetID(), "from", received)
+		return true
+	}
+
+	slog.Warn("resume failed:", s.Session.GetServiceKey(), s.GetID(), err)
+
+	var reply Packet.Packet
+	reply.WriteUint8(netOpResumeReply)
+	reply.WriteUint8(resumeFailed)
+	reply.WriteString(err.(*ResumeError).Reason)
+	s.SendFrame(EPacketNetworkInternal, reply.GetUsedBuffer())
+	return true
+}
+
+// authNotStarted tells whether no login was sent on the connection.
+func (s *SessionPlayerBase) authNotStarted() bool {
+	if s.cfg.Auth == nil {
+		return true
+	}
+
+	s.auth.mutex.Lock()
+	defer s.auth.mutex.Unlock()
+
+	return s.auth.phase == authPending
+}
+
+// authResumed lets a connection carrying a resumed player in without login.
+func (s *SessionPlayerBase) authResumed() {
+	if s.cfg.Auth == nil {
+		return
+	}
+
+	s.auth.mutex.Lock()
+	defer s.auth.mutex.Unlock()
+
+	if s.auth.phase == authPending {
+		s.auth.phase = authDone
+		s.auth.timer.Stop()
+	}
+}
+
+func (s *SessionPlayerBase) onResumeAck(pak *Packet.Packet) bool {
+	p := s.resumeOwner()
+	if p == nil {
+		p = s
+	}
+	n := pak.ReadUint64()
+
+	r := &p.resume
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.token == "" {
+		slog.Warn("resume: unexpected ack:", s.Session.GetServiceKey(), s.GetID())
+		return false
+	}
+
+	// stale, or beyond what was kept once lost
+	if n > r.acked && n <= r.sent {
+		r.dropReplay(int(n - r.acked))
+		r.acked = n
+	}
+	return true
+}
+
+//----------------------------------------------------------------------------
+
+// GetResumeToken returns the token the server gave and the count of frames received since, to
+// Resume on a new connection. The token is empty when the server does not resume.
+func (s *SessionPlayerBase) GetResumeToken() (token string, received uint64) {
+	s.resume.mutex.Lock()
+	defer s.resume.mutex.Unlock()
+
+	return s.resume.peerToken, s.resume.received
+}
+
+// Resume asks the server to carry the player of token on this connection, instead of a Login.
+// cb gets the result like a CallAsync callback, the frames missed arrive after it.
+func (s *SessionPlayerBase) Resume(token string, received uint64, cb func(accountID uint64, err error)) error {
+	r := &s.resume
+	r.mutex.Lock()
+	r.peerToken, r.received, r.ackSent = token, received, received
+	r.resuming, r.cb = true, cb
+	r.mutex.Unlock()
+
+	var pak Packet.Packet
+	pak.WriteUint8(netOpResume)
+	pak.WriteString(token)
+	pak.WriteUint64(received)
+	return s.SendFrame(EPacketNetworkInternal, pak.GetUsedBuffer())
+}
+
+func (s *SessionPlayerBase) onResumeToken(pak *Packet.Packet) bool {
+	r := &s.resume
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.peerToken = pak.ReadString()
+	r.received, r.ackSent = 0, 0
+	return true
+}
+
+func (s *SessionPlayerBase) onResumeReply(pak *Packet.Packet) bool {
+	r := &s.resume
+	r.mutex.Lock()
+	resuming, cb := r.resuming, r.cb
+	r.resuming, r.cb = false, nil
+	r.mutex.Unlock()
+
+	if !resuming {
+		slog.Warn("resume: unexpected resume reply:", s.Session.GetServiceKey(), s.GetID())
+		return false
+	}
+
+	var id uint64
+	var err error
+	if pak.ReadUint8() == resumeOK {
+		id = pak.ReadUint64()
+		s.SetAccountID(id)
+	} else {
+		err = &ResumeError{Reason: pak.ReadString()}
+
+		r.mutex.Lock()
+		r.peerToken = ""
+		r.mutex.Unlock()
+	}
+
+	if cb != nil {
+		s.deliverRpc(func() { cb(id, err) })
+	}
+	return true
+}
+
+// countReceived counts a game logic or broadcast frame received, acking every resumeAckEvery.
+func (s *SessionPlayerBase) countReceived() {
+	r := &s.resume
+	r.mutex.Lock()
+	if r.peerToken == "" {
+		r.mutex.Unlock()
+		return
+	}
+	r.received++
+	n := r.received
+	ack := n-r.ackSent >= resumeAckEvery
+	if ack {
+		r.ackSent, r.ackElapsed = n, 0
+	}
+	r.mutex.Unlock()
+
+	if ack {
+		s.sendResumeAck(n)
+	}
+}
+
+// updateResumeAck acks the frames received since the last ack, from OnUpdate.
+func (s *SessionPlayerBase) updateResumeAck(dt time.Duration) {
+	r := &s.resume
+	r.mutex.Lock()
+	if r.peerToken == "" || r.received == r.ackSent {
+		r.mutex.Unlock()
+		return
+	}
+
+	r.ackElapsed += dt
+	if r.ackElapsed < resumeAckInterval {
+		r.mutex.Unlock()
+		return
+	}
+	n := r.received
+	r.ackSent, r.ackElapsed = n, 0
+	r.mutex.Unlock()
+
+	s.sendResumeAck(n)
+}
+
+func (s *SessionPlayerBase) sendResumeAck(n uint64) {
+	var pak Packet.Packet
+	pak.WriteUint8(netOpResumeAck)
+	pak.WriteUint64(n)
+	s.SendFrame(EPacketNetworkInternal, pak.GetUsedBuffer())
+}
@@ -0,0 +1,245 @@
+package Common_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+)
+
+// resumePair returns a client and a server of the services svc-client and svc-server, the
+// server resuming with cfg. A nil cfg keeps the configs, for a new connection.
+func resumePair(t *testing.T, svc string, cfg *Common.ResumeConfig) (*testPlayer, *testPlayer) {
+	t.Helper()
+
+	if cfg == nil {
+		return newPlayer(t, svc+"-client", nil), newPlayer(t, svc+"-server", nil)
+	}
+	return newPlayer(t, svc+"-client", &Common.SessionConfig{}), newPlayer(t, svc+"-server", &Common.SessionConfig{Resume: cfg})
+}
+
+// sendGame sends one game logic frame per byte of b.
+func sendGame(t *testing.T, p *testPlayer, b ...byte) {
+	t.Helper()
+
+	for _, c := range b {
+		if err := p.SendFrame(Common.EPacketGameLogic, []byte{c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// received returns the first byte of each message p got.
+func received(p *testPlayer) []byte {
+	var b []byte
+	for _, pak := range p.messages() {
+		b = append(b, payloadOf(pak)[0])
+	}
+	return b
+}
+
+func seq(from, to int) []byte {
+	var b []byte
+	for i := from; i < to; i++ {
+		b = append(b, byte(i))
+	}
+	return b
+}
+
+// resume asks the server of the new connection client, server for the player of token,
+// returning the result.
+func resume(t *testing.T, client, server *testPlayer, token string, n uint64) (uint64, error) {
+	t.Helper()
+
+	var res loginResult
+	if err := client.Resume(token, n, res.cb); err != nil {
+		t.Fatal(err)
+	}
+	pump(client, server)
+	client.OnUpdate(0)
+
+	done, id, err := res.get()
+	if !done {
+		t.Fatal("no resume reply")
+	}
+	return id, err
+}
+
+func TestResumeWithoutAuth(t *testing.T) {
+	client, server := resumePair(t, "resume-noauth", &Common.ResumeConfig{})
+	pump(client, server)
+	if token, _ := client.GetResumeToken(); token != "" {
+		t.Fatal("token issued before any frame")
+	}
+
+	sendGame(t, server, 0)
+	pump(client, server)
+	token, n := client.GetResumeToken()
+	if token == "" || n != 1 {
+		t.Fatalf("token %q, %d received", token, n)
+	}
+
+	server.OnClosed(nil)
+	if !server.IsParked() {
+		t.Fatal("player not parked")
+	}
+	sendGame(t, server, 1, 2)
+
+	client2, server2 := resumePair(t, "resume-noauth", nil)
+	if _, err := resume(t, client2, server2, token, n); err != nil {
+		t.Fatal(err)
+	}
+	client2.OnUpdate(0)
+
+	if b := received(client2); !bytes.Equal(b, []byte{1, 2}) {
+		t.Fatalf("replayed %v", b)
+	}
+	if server.IsParked() || server.GetNetworkSession() != server2.fake {
+		t.Fatal("player not carried by the new connection")
+	}
+
+	sendGame(t, server, 3)
+	pump(client2, server2)
+	client2.OnUpdate(0)
+	if b := received(client2); !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Fatalf("received %v", b)
+	}
+}
+
+func TestResumeReplaysFromAck(t *testing.T) {
+	client, server := resumePair(t, "resume-ack", &Common.ResumeConfig{})
+	sendGame(t, server, seq(0, 40)...)
+	pump(client, server)
+	token, _ := client.GetResumeToken()
+
+	server.OnClosed(nil)
+
+	// the client acked 32 frames, the ones before are gone
+	client2, server2 := resumePair(t, "resume-ack", nil)
+	if _, err := resume(t, client2, server2, token, 31); !errors.Is(err, Common.ErrResumeFailed) {
+		t.Fatalf("resumed before the ack: %v", err)
+	}
+	if !server.IsParked() {
+		t.Fatal("player not parked after a failed resume")
+	}
+
+	client3, server3 := resumePair(t, "resume-ack", nil)
+	if _, err := resume(t, client3, server3, token, 35); err != nil {
+		t.Fatal(err)
+	}
+	client3.OnUpdate(0)
+	if b := received(client3); !bytes.Equal(b, seq(35, 40)) {
+		t.Fatalf("replayed %v", b)
+	}
+}
+
+func TestResumeExpires(t *testing.T) {
+	client, server := resumePair(t, "resume-expire", &Common.ResumeConfig{GracePeriod: 10 * time.Millisecond})
+	sendGame(t, server, 0)
+	pump(client, server)
+	token, n := client.GetResumeToken()
+
+	closed := make(chan struct{})
+	server.AddCloseHook(func() { close(closed) })
+	server.OnClosed(nil)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("parked player not closed after the grace period")
+	}
+
+	client2, server2 := resumePair(t, "resume-expire", nil)
+	if _, err := resume(t, client2, server2, token, n); !errors.Is(err, Common.ErrResumeFailed) {
+		t.Fatalf("resumed an expired player: %v", err)
+	}
+}
+
+func TestResumeTokenSealed(t *testing.T) {
+	client, server := cryptoPair(t, "resume-crypto",
+		&Common.SessionConfig{}, &Common.SessionConfig{Resume: &Common.ResumeConfig{}})
+	sendGame(t, server, 0)
+	pump(client, server)
+
+	token, n := client.GetResumeToken()
+	if token == "" || n != 1 {
+		t.Fatalf("token %q, %d received", token, n)
+	}
+	if bytes.Contains(server.fake.SentBytes(), []byte(token)) {
+		t.Fatal("token sent in clear")
+	}
+}
+
+func TestResumeKeepsOrderWhileReplaying(t *testing.T) {
+	client, server := resumePair(t, "resume-order", &Common.ResumeConfig{})
+	sendGame(t, server, 0)
+	pump(client, server)
+	token, n := client.GetResumeToken()
+
+	server.OnClosed(nil)
+	sendGame(t, server, seq(1, 100)...)
+
+	client2, server2 := resumePair(t, "resume-order", nil)
+	if err := client2.Resume(token, n, nil); err != nil {
+		t.Fatal(err)
+	}
+	link(t, client2, server2)
+
+	// sent while the kept frames go out again
+	sendGame(t, server, seq(100, 200)...)
+
+	waitUntil(t, time.Second, func() bool { return len(client2.messages()) == 199 })
+	if b := received(client2); !bytes.Equal(b, seq(1, 200)) {
+		t.Fatalf("received %v", b)
+	}
+}
+
+func TestResumeSplitsLargeFrames(t *testing.T) {
+	client := newPlayer(t, "resume-split-client", &Common.SessionConfig{})
+	server := newPlayer(t, "resume-split-server", &Common.SessionConfig{Resume: &Common.ResumeConfig{}, SplitSize: 64})
+
+	payload := bytes.Repeat([]byte{7}, 300)
+	send := func() {
+		t.Helper()
+
+		sent := make(chan error, 1)
+		go func() { sent <- server.SendPacket(framePacket(Common.DefaultCodec, Common.EPacketGameLogic, payload)) }()
+		select {
+		case err := <-sent:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("SendPacket blocked")
+		}
+	}
+
+	send()
+	pump(client, server)
+	token, n := client.GetResumeToken()
+	if token == "" || n != 1 {
+		t.Fatalf("token %q, %d received", token, n)
+	}
+
+	// kept whole while parked, split again on the new connection
+	server.OnClosed(nil)
+	send()
+
+	client2 := newPlayer(t, "resume-split-client", nil)
+	server2 := newPlayer(t, "resume-split-server", nil)
+	if _, err := resume(t, client2, server2, token, n); err != nil {
+		t.Fatal(err)
+	}
+	client2.OnUpdate(0)
+
+	if msgs := client2.messages(); len(msgs) != 1 || !bytes.Equal(payloadOf(msgs[0]), payload) {
+		t.Fatalf("replayed %d messages", len(msgs))
+	}
+	for _, f := range server2.sentFrames(t)[1:] {
+		if f.Type != Common.EPacketAutoSplitLarge {
+			t.Fatalf("frame type %#x", f.Type)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package Common
+
+// RoomHooks are called on the changes of the rooms of a SessionGroup. They run with the
+// group locked and may call the group and room methods; any of them may be nil.
+type RoomHooks struct {
+	OnCreated   func(r *Room)
+	OnDestroyed func(r *Room)
+	OnJoined    func(r *Room, p ISessionPlayer)
+	OnLeft      func(r *Room, p ISessionPlayer)
+}
+
+// Room is a named subset of the players of a SessionGroup: a map instance, a guild channel...
+// Players leave their rooms when they are removed from the group.
+type Room struct {
+	name    string
+	group   *SessionGroup
+	members map[uint64]ISessionPlayer // guarded by the group lock
+
+	// DestroyWhenEmpty destroys the room once its last member leaves.
+	DestroyWhenEmpty bool
+
+	// Data is free for the game code.
+	Data interface{}
+}
+
+func (r *Room) GetName() string {
+	return r.name
+}
+
+// Join adds a player of the group to the room. It returns false if the player is not in the
+// group, or already in the room.
+func (r *Room) Join(id uint64) bool {
+	g := r.group
+	g.sMutex.Lock()
+	defer g.sMutex.Unlock()
+
+	p, ok := g.SessionPlayers[id]
+	if !ok || r.members == nil {
+		return false
+	}
+	if _, ok := r.members[id]; ok {
+		return false
+	}
+
+	r.members[id] = p
+	rooms, ok := g.playerRooms[id]
+	if !ok {
+		rooms = make(map[string]*Room)
+		g.playerRooms[id] = rooms
+	}
+	rooms[r.name] = r
+
+	if g.RoomHooks.OnJoined != nil {
+		g.RoomHooks.OnJoined(r, p)
+	}
+	return true
+}
+
+// Leave removes a player from the room, returning false if it was not in it.
+func (r *Room) Leave(id uint64) bool {
+	g := r.group
+	g.sMutex.Lock()
+	defer g.sMutex.Unlock()
+
+	return g.leaveRoom(r, id)
+}
+
+func (r *Room) Has(id uint64) bool {
+	r.group.sMutex.Lock()
+	defer r.group.sMutex.Unlock()
+
+	_, ok := r.members[id]
+	return ok
+}
+
+func (r *Room) Count() int {
+	r.group.sMutex.Lock()
+	defer r.group.sMutex.Unlock()
+
+	return len(r.members)
+}
+
+// Members returns the players in the room.
+func (r *Room) Members() []ISessionPlayer {
+	return r.snapshot(nil, nil)
+}
+
+// Broadcast sends body to the members of the room like SessionGroup.Broadcast.
+func (r *Room) Broadcast(body []byte, filter func(p ISessionPlayer) bool, exclude ...uint64) int {
+	return broadcastTo(r.snapshot(filter, exclude), body)
+}
+
+func (r *Room) snapshot(filter func(p ISessionPlayer) bool, exclude []uint64) []ISessionPlayer {
+	r.group.sMutex.Lock()
+	defer r.group.sMutex.Unlock()
+
+	return filterPlayers(r.members, filter, exclude)
+}
+
+//----------------------------------------------------------------------------
+
+// CreateRoom creates a room, nil if the name is taken.
+func (evMgr *SessionGroup) CreateRoom(name string) *Room {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	if _, ok := evMgr.rooms[name]; ok {
+		return nil
+	}
+	return evMgr.createRoom(name)
+}
+
+// GetOrCreateRoom returns the room of a name, created if needed.
+func (evMgr *SessionGroup) GetOrCreateRoom(name string) *Room {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	if r, ok := evMgr.rooms[name]; ok {
+		return r
+	}
+	return evMgr.createRoom(name)
+}
+
+func (evMgr *SessionGroup) GetRoom(name string) *Room {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	return evMgr.rooms[name]
+}
+
+// GetRoomNames returns the names of all the rooms.
+func (evMgr *SessionGroup) GetRoomNames() []string {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	names := make([]string, 0, len(evMgr.rooms))
+	for name := range evMgr.rooms {
+		names = append(names, name)
+	}
+	return names
+}
+
+// DestroyRoom makes the members leave the room and removes it.
+func (evMgr *SessionGroup) DestroyRoom(name string) {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	if r, ok := evMgr.rooms[name]; ok {
+		evMgr.destroyRoom(r)
+	}
+}
+
+// JoinRoom adds a player to a room, created if needed.
+func (evMgr *SessionGroup) JoinRoom(name string, id uint64) bool {
+	return evMgr.GetOrCreateRoom(name).Join(id)
+}
+
+// LeaveRoom removes a player from a room.
+func (evMgr *SessionGroup) LeaveRoom(name string, id uint64) bool {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	r, ok := evMgr.rooms[name]
+	if !ok {
+		return false
+	}
+	return evMgr.leaveRoom(r, id)
+}
+
+// GetPlayerRooms returns the rooms a player is in.
+func (evMgr *SessionGroup) GetPlayerRooms(id uint64) []*Room {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	rooms := make([]*Room, 0, len(evMgr.playerRooms[id]))
+	for _, r := range evMgr.playerRooms[id] {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+func (evMgr *SessionGroup) createRoom(name string) *Room {
+	if evMgr.rooms == nil {
+		evMgr.rooms = make(map[string]*Room)
+		evMgr.playerRooms = make(map[uint64]map[string]*Room)
+	}
+
+	r := &Room{name: name, group: evMgr, members: make(map[uint64]ISessionPlayer)}
+	evMgr.rooms[name] = r
+
+	if evMgr.RoomHooks.OnCreated != nil {
+		evMgr.RoomHooks.OnCreated(r)
+	}
+	return r
+}
+
+func (evMgr *SessionGroup) destroyRoom(r *Room) {
+	if evMgr.rooms[r.name] != r {
+		return
+	}
+
+	for id := range r.members {
+		evMgr.leaveRoom(r, id)
+	}
+
+	// leaving may have destroyed it already
+	if evMgr.rooms[r.name] != r {
+		return
+	}
+	delete(evMgr.rooms, r.name)
+	r.members = nil
+
+	if evMgr.RoomHooks.OnDestroyed != nil {
+		evMgr.RoomHooks.OnDestroyed(r)
+	}
+}
+
+func (evMgr *SessionGroup) leaveRoom(r *Room, id uint64) bool {
+	p, ok := r.members[id]
+	if !ok {
+		return false
+	}
+
+	delete(r.members, id)
+	if rooms := evMgr.playerRooms[id]; rooms != nil {
+		delete(rooms, r.name)
+		if len(rooms) == 0 {
+			delete(evMgr.playerRooms, id)
+		}
+	}
+
+	if evMgr.RoomHooks.OnLeft != nil {
+		evMgr.RoomHooks.OnLeft(r, p)
+	}
+
+	if r.DestroyWhenEmpty && len(r.members) == 0 {
+		evMgr.destroyRoom(r)
+	}
+	return true
+}
+
+// leaveAllRooms runs when a player is removed from the group.
+func (evMgr *SessionGroup) leaveAllRooms(id uint64) {
+	for _, r := range evMgr.playerRooms[id] {
+		evMgr.leaveRoom(r, id)
+	}
+}
@@ -0,0 +1,116 @@
+package Common_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/zhksoftGo/Cactus/Common"
+)
+
+func TestRoomMembership(t *testing.T) {
+	a := newPlayer(t, "room-members", nil)
+	b := newPlayer(t, "room-members", nil)
+	g := newGroup(a, b)
+
+	r := g.CreateRoom("map1")
+	if r == nil || g.CreateRoom("map1") != nil || g.GetOrCreateRoom("map1") != r || g.GetRoom("map1") != r {
+		t.Fatal("room not unique by name")
+	}
+
+	if !r.Join(a.GetID()) || r.Join(a.GetID()) || r.Join(12345678) {
+		t.Fatal("join of a member or of a stranger")
+	}
+	if !g.JoinRoom("guild", a.GetID()) || !g.JoinRoom("guild", b.GetID()) {
+		t.Fatal("JoinRoom failed")
+	}
+
+	if !r.Has(a.GetID()) || r.Has(b.GetID()) || r.Count() != 1 || len(r.Members()) != 1 {
+		t.Fatal("wrong members")
+	}
+	if rooms := g.GetPlayerRooms(a.GetID()); len(rooms) != 2 {
+		t.Fatalf("a is in %d rooms", len(rooms))
+	}
+
+	names := g.GetRoomNames()
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[guild map1]" {
+		t.Fatalf("rooms %v", names)
+	}
+
+	if !g.LeaveRoom("map1", a.GetID()) || g.LeaveRoom("map1", a.GetID()) || g.LeaveRoom("none", a.GetID()) {
+		t.Fatal("leave of a non member")
+	}
+
+	// removed from the group, the player leaves its rooms
+	g.RemoveSessionPlayer(b)
+	if g.GetRoom("guild").Has(b.GetID()) || len(g.GetPlayerRooms(b.GetID())) != 0 {
+		t.Fatal("removed player still in its rooms")
+	}
+}
+
+func TestRoomHooksAndDestroy(t *testing.T) {
+	a := newPlayer(t, "room-hooks", nil)
+	b := newPlayer(t, "room-hooks", nil)
+	g := newGroup(a, b)
+
+	var events []string
+	g.RoomHooks = Common.RoomHooks{
+		OnCreated:   func(r *Common.Room) { events = append(events, "created "+r.GetName()) },
+		OnDestroyed: func(r *Common.Room) { events = append(events, "destroyed "+r.GetName()) },
+		OnJoined: func(r *Common.Room, p Common.ISessionPlayer) {
+			events = append(events, fmt.Sprint("joined ", p.GetID() == a.GetID()))
+			// hooks may call the group
+			g.GetPlayerRooms(p.GetID())
+		},
+		OnLeft: func(r *Common.Room, p Common.ISessionPlayer) {
+			events = append(events, fmt.Sprint("left ", p.GetID() == a.GetID()))
+		},
+	}
+
+	r := g.CreateRoom("lobby")
+	r.DestroyWhenEmpty = true
+	r.Join(a.GetID())
+	r.Join(b.GetID())
+	r.Leave(a.GetID())
+	r.Leave(b.GetID())
+
+	want := "[created lobby joined true joined false left true left false destroyed lobby]"
+	if fmt.Sprint(events) != want {
+		t.Fatalf("events %v", events)
+	}
+	if g.GetRoom("lobby") != nil || r.Join(a.GetID()) {
+		t.Fatal("destroyed room still usable")
+	}
+
+	events = nil
+	g.JoinRoom("arena", a.GetID())
+	g.DestroyRoom("arena")
+	if fmt.Sprint(events) != "[created arena joined true left true destroyed arena]" {
+		t.Fatalf("events %v", events)
+	}
+	if len(g.GetPlayerRooms(a.GetID())) != 0 {
+		t.Fatal("member of a destroyed room")
+	}
+}
+
+func TestRoomBroadcast(t *testing.T) {
+	a := newPlayer(t, "room-broadcast", nil)
+	b := newPlayer(t, "room-broadcast", nil)
+	c := newPlayer(t, "room-broadcast", nil)
+	g := newGroup(a, b, c)
+
+	r := g.CreateRoom("channel")
+	r.Join(a.GetID())
+	r.Join(b.GetID())
+
+	if n := r.Broadcast([]byte("hi"), nil, a.GetID()); n != 1 {
+		t.Fatalf("reached %d players", n)
+	}
+	if len(a.fake.Sent()) != 0 || len(c.fake.Sent()) != 0 {
+		t.Fatal("sent outside the room or to the excluded")
+	}
+	if frames := b.sentFrames(t); len(frames) != 1 || frames[0].Type != Common.EPacketBroadcast || string(frames[0].Body) != "hi" {
+		t.Fatalf("b got %v", frames)
+	}
+}
@@ -0,0 +1,307 @@
+package Common
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Packet"
+)
+
+// routed message payload, in EPacketGameLogic and EPacketBroadcast frames:
+// 2 bytes message ID + body
+const msgIDLength = 2
+
+// Msg is a routed message being handled.
+type Msg struct {
+	ID     uint16
+	Player *SessionPlayerBase
+	// Handler is the handler given to Initialize, normally the session type of the game.
+	Handler IMessageHandle
+}
+
+// MsgHandler handles one message ID, pak is read from the body.
+type MsgHandler func(msg *Msg, pak *Packet.Packet)
+
+// MsgMiddleware wraps the handler of a route, it may drop the message by not calling next.
+type MsgMiddleware func(next MsgHandler) MsgHandler
+
+// RouteStats counts the messages of a route.
+type RouteStats struct {
+	Calls     int64
+	Handled   int64 // reached the handler, the others were dropped by a middleware
+	Panics    int64
+	TotalTime time.Duration // time spent in the route, middleware included
+	MaxTime   time.Duration
+}
+
+// Average returns the mean time spent per call.
+func (st RouteStats) Average() time.Duration {
+	if st.Calls == 0 {
+		return 0
+	}
+	return st.TotalTime / time.Duration(st.Calls)
+}
+
+type msgRoute struct {
+	handler    MsgHandler // middleware chain
+	stats      RouteStats
+	statsMutex sync.Mutex
+}
+
+// MessageRouter dispatches the game logic messages of the sessions of a service by message
+// ID, shared by them through SessionConfig. Handlers run in OnUpdate.
+type MessageRouter struct {
+	mutex      sync.RWMutex
+	routes     map[uint16]*msgRoute
+	priorities map[uint16]MsgPriority
+	middleware []MsgMiddleware
+	unknown    MsgHandler
+	unknowns   int64
+}
+
+func NewMessageRouter() *MessageRouter {
+	return &MessageRouter{routes: make(map[uint16]*msgRoute), priorities: make(map[uint16]MsgPriority)}
+}
+
+// Use adds middleware to the routes registered afterwards, run before their own.
+func (r *MessageRouter) Use(mw ...MsgMiddleware) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Handle registers the handler of a message ID, wrapped by mw in order.
+func (r *MessageRouter) Handle(id uint16, h MsgHandler, mw ...MsgMiddleware) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	route := &msgRoute{}
+	handler := func(msg *Msg, pak *Packet.Packet) {
+		route.statsMutex.Lock()
+		route.stats.Handled++
+		route.statsMutex.Unlock()
+
+		h(msg, pak)
+	}
+
+	chain := append(append([]MsgMiddleware{}, r.middleware...), mw...)
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	route.handler = handler
+
+	r.routes[id] = route
+}
+
+func (r *MessageRouter) Unhandle(id uint16) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.routes, id)
+}
+
+// SetPriority sets the priority of a message ID, MsgPriorityNormal by default. Control
+// messages set high are handled before the normal ones queued.
+func (r *MessageRouter) SetPriority(id uint16, prio MsgPriority) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.priorities[id] = prio
+}
+
+func (r *MessageRouter) priorityOf(id uint16) MsgPriority {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.priorities[id]
+}
+
+// SetUnknownHandler handles the IDs without route. With none, such messages and the ones too
+// short to carry an ID go to HandleInComingMsg, read from the payload.
+func (r *MessageRouter) SetUnknownHandler(h MsgHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.unknown = h
+}
+
+// Stats returns the counters of every route.
+func (r *MessageRouter) Stats() map[uint16]RouteStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	out := make(map[uint16]RouteStats, len(r.routes))
+	for id, route := range r.routes {
+		route.statsMutex.Lock()
+		out[id] = route.stats
+		route.statsMutex.Unlock()
+	}
+	return out
+}
+
+// GetUnknownCount returns the number of messages received without route.
+func (r *MessageRouter) GetUnknownCount() int64 {
+	return atomic.LoadInt64(&r.unknowns)
+}
+
+// dispatch routes a message, returning false when it goes to HandleInComingMsg.
+func (r *MessageRouter) dispatch(s *SessionPlayerBase, pak *Packet.Packet) bool {
+	pos := pak.GetReadPos()
+	if len(pak.GetUsedBuffer())-pos < msgIDLength {
+		return false
+	}
+
+	msg := &Msg{ID: pak.ReadUint16(), Player: s, Handler: s.msgHandlerUpdatable}
+
+	r.mutex.RLock()
+	route, ok := r.routes[msg.ID]
+	unknown := r.unknown
+	r.mutex.RUnlock()
+
+	if !ok {
+		atomic.AddInt64(&r.unknowns, 1)
+		if unknown == nil {
+			pak.SetReadPos(pos)
+			return false
+		}
+
+		runMsgHandler(unknown, msg, pak)
+		return true
+	}
+
+	start := time.Now()
+	panicked := runMsgHandler(route.handler, msg, pak)
+	elapsed := time.Since(start)
+
+	route.statsMutex.Lock()
+	st := &route.stats
+	st.Calls++
+	st.TotalTime += elapsed
+	if elapsed > st.MaxTime {
+		st.MaxTime = elapsed
+	}
+	if panicked {
+		st.Panics++
+	}
+	route.statsMutex.Unlock()
+
+	return true
+}
+
+func runMsgHandler(h MsgHandler, msg *Msg, pak *Packet.Packet) (panicked bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("message", msg.ID, "panic:", err)
+			slog.Debug("\n" + pak.ToHexViewString())
+			panicked = true
+		}
+	}()
+
+	h(msg, pak)
+	return
+}
+
+// SendMessage sends a game logic message for the MessageRouter of the peer.
+func (s *SessionPlayerBase) SendMessage(id uint16, body []byte) error {
+	var pak Packet.Packet
+	pak.WriteUint16(id)
+	pak.Write(body)
+	return s.SendFrame(EPacketGameLogic, pak.GetUsedBuffer())
+}
+
+// isRoutable tells whether a queued message is a game logic or broadcast one.
+func (m queuedMsg) isRoutable() bool {
+	return m.frameType == EPacketGameLogic || m.frameType == EPacketBroadcast
+}
+
+// peekMsgID returns the ID of a routable message without reading it.
+func peekMsgID(m queuedMsg) (uint16, bool) {
+	pak := m.pak
+	pos := pak.GetReadPos()
+	if len(pak.GetUsedBuffer())-pos < msgIDLength || !m.isRoutable() {
+		return 0, false
+	}
+
+	id := pak.ReadUint16()
+	pak.SetReadPos(pos)
+	return id, true
+}
+
+// handleMsg hands a queued message to the router of the service, or to HandleInComingMsg.
+func (s *SessionPlayerBase) handleMsg(m queuedMsg) {
+	if r := s.cfg.Router; r != nil && m.isRoutable() && r.dispatch(s, m.pak) {
+		return
+	}
+
+	s.msgHandlerUpdatable.HandleInComingMsg(m.pak)
+}
+
+//----------------------------------------------------------------------------
+
+// RequireAuth drops the messages of sessions without account, see SetAccountID.
+func RequireAuth() MsgMiddleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(msg *Msg, pak *Packet.Packet) {
+			if msg.Player.GetAccountID() == 0 {
+				slog.Warn("message", msg.ID, "refused, not authenticated:", msg.Player.GetID())
+				return
+			}
+			next(msg, pak)
+		}
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit drops the messages of a session above perSecond on average, allowing bursts of
+// burst messages. Each route it wraps has its own limit.
+func RateLimit(perSecond float64, burst int) MsgMiddleware {
+	return func(next MsgHandler) MsgHandler {
+		var mutex sync.Mutex
+		buckets := make(map[*SessionPlayerBase]*tokenBucket)
+
+		return func(msg *Msg, pak *Packet.Packet) {
+			now := time.Now()
+
+			mutex.Lock()
+			b, ok := buckets[msg.Player]
+			if !ok {
+				b = &tokenBucket{tokens: float64(burst), last: now}
+				buckets[msg.Player] = b
+			}
+
+			b.tokens += now.Sub(b.last).Seconds() * perSecond
+			if b.tokens > float64(burst) {
+				b.tokens = float64(burst)
+			}
+			b.last = now
+
+			allowed := b.tokens >= 1
+			if allowed {
+				b.tokens--
+			}
+			mutex.Unlock()
+
+			if !ok {
+				player := msg.Player
+				player.AddCloseHook(func() {
+					mutex.Lock()
+					delete(buckets, player)
+					mutex.Unlock()
+				})
+			}
+
+			if !allowed {
+				slog.Warn("message", msg.ID, "rate limited:", msg.Player.GetID())
+				return
+			}
+			next(msg, pak)
+		}
+	}
+}
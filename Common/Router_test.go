@@ -0,0 +1,146 @@
+package Common_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+	"github.com/zhksoftGo/Packet"
+)
+
+// message returns the frame of a routed message.
+func message(id uint16, body string) []byte {
+	return networktest.EncodeFrame(Common.EPacketGameLogic, packet(func(pak *Packet.Packet) {
+		pak.WriteUint16(id)
+		pak.Write([]byte(body))
+	}).GetUsedBuffer())
+}
+
+func restOf(pak *Packet.Packet) string {
+	return string(pak.GetUsedBuffer()[pak.GetReadPos():])
+}
+
+func TestRouterDispatch(t *testing.T) {
+	r := Common.NewMessageRouter()
+	var trace []string
+	tag := func(name string) Common.MsgMiddleware {
+		return func(next Common.MsgHandler) Common.MsgHandler {
+			return func(msg *Common.Msg, pak *Packet.Packet) {
+				trace = append(trace, name)
+				next(msg, pak)
+			}
+		}
+	}
+	r.Use(tag("global"))
+	r.Handle(1, func(msg *Common.Msg, pak *Packet.Packet) {
+		trace = append(trace, fmt.Sprint("handler ", msg.ID, " ", restOf(pak)))
+	}, tag("route"))
+	r.Handle(2, func(msg *Common.Msg, pak *Packet.Packet) { panic("boom") })
+
+	p := newPlayer(t, "router-dispatch", &Common.SessionConfig{Router: r})
+	for _, b := range [][]byte{message(1, "one"), message(2, ""), message(9, "unknown"), networktest.EncodeFrame(Common.EPacketGameLogic, []byte{1})} {
+		if !p.recv(b) {
+			t.Fatal("session closed")
+		}
+	}
+	p.OnUpdate(0)
+
+	if fmt.Sprint(trace) != "[global route handler 1 one global]" {
+		t.Fatalf("trace %v", trace)
+	}
+
+	// the unknown and the short messages, read from the payload
+	msgs := p.messages()
+	if len(msgs) != 2 || restOf(msgs[0])[2:] != "unknown" || len(restOf(msgs[1])) != 1 {
+		t.Fatalf("%d messages to HandleInComingMsg", len(msgs))
+	}
+	if n := r.GetUnknownCount(); n != 1 {
+		t.Fatalf("%d unknown", n)
+	}
+
+	stats := r.Stats()
+	if st := stats[1]; st.Calls != 1 || st.Handled != 1 || st.Panics != 0 {
+		t.Fatalf("route 1 stats %+v", st)
+	}
+	if st := stats[2]; st.Calls != 1 || st.Panics != 1 {
+		t.Fatalf("route 2 stats %+v", st)
+	}
+
+	r.Unhandle(1)
+	p.recv(message(1, "again"))
+	p.OnUpdate(0)
+	if len(p.messages()) != 3 {
+		t.Fatal("unhandled route still used")
+	}
+}
+
+func TestRouterUnknownHandler(t *testing.T) {
+	r := Common.NewMessageRouter()
+	var ids []uint16
+	r.SetUnknownHandler(func(msg *Common.Msg, pak *Packet.Packet) { ids = append(ids, msg.ID) })
+
+	p := newPlayer(t, "router-unknown", &Common.SessionConfig{Router: r})
+	p.recv(message(7, "x"))
+	p.recv(networktest.EncodeFrame(Common.EPacketBroadcast, packet(func(pak *Packet.Packet) { pak.WriteUint16(8) }).GetUsedBuffer()))
+	p.OnUpdate(0)
+
+	if fmt.Sprint(ids) != "[7 8]" || len(p.messages()) != 0 {
+		t.Fatalf("unknown handler got %v", ids)
+	}
+}
+
+func TestRouterMiddlewares(t *testing.T) {
+	r := Common.NewMessageRouter()
+	handled := 0
+	r.Handle(1, func(*Common.Msg, *Packet.Packet) { handled++ }, Common.RequireAuth())
+	r.Handle(2, func(*Common.Msg, *Packet.Packet) { handled++ }, Common.RateLimit(0.001, 2))
+
+	p := newPlayer(t, "router-mw", &Common.SessionConfig{Router: r})
+	p.recv(message(1, ""))
+	p.OnUpdate(0)
+	if handled != 0 {
+		t.Fatal("message handled without account")
+	}
+
+	p.SetAccountID(1)
+	p.recv(message(1, ""))
+	p.OnUpdate(0)
+	if handled != 1 {
+		t.Fatal("message refused with an account")
+	}
+
+	for i := 0; i < 5; i++ {
+		p.recv(message(2, ""))
+	}
+	p.OnUpdate(0)
+	if handled != 3 {
+		t.Fatalf("%d handled past the burst", handled-1)
+	}
+	if st := r.Stats()[2]; st.Calls != 5 || st.Handled != 2 {
+		t.Fatalf("route 2 stats %+v", st)
+	}
+}
+
+func TestSendMessageIsRouted(t *testing.T) {
+	r := Common.NewMessageRouter()
+	got := make(chan string, 1)
+	r.Handle(42, func(msg *Common.Msg, pak *Packet.Packet) { got <- restOf(pak) })
+
+	a := newPlayer(t, "router-send", nil)
+	b := newPlayer(t, "router-recv", &Common.SessionConfig{Router: r})
+	if err := a.SendMessage(42, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	pump(a, b)
+	b.OnUpdate(0)
+
+	select {
+	case s := <-got:
+		if s != "hello" {
+			t.Fatalf("handler got %q", s)
+		}
+	default:
+		t.Fatal("message not routed")
+	}
+}
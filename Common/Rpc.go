@@ -0,0 +1,437 @@
+package Common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Packet"
+)
+
+// rpc packet body:
+// 1 byte kind + 4 bytes call ID + [string method, for requests and notifications] + payload
+const (
+	rpcRequest  = 1
+	rpcResponse = 2
+	rpcError    = 3
+	rpcCancel   = 4
+	rpcNotify   = 5 // a request without response, call ID is 0
+)
+
+// error codes of RpcError
+const (
+	RpcErrHandler     = 1
+	RpcErrNotFound    = 2
+	RpcErrPanic       = 3
+	RpcErrDuplicateID = 4 // the ID of a request still being served
+)
+
+var ErrRpcClosed = errors.New("rpc: session closed")
+var ErrRpcDisconnected = errors.New("rpc: connection lost")
+var ErrRpcMethodNotFound = errors.New("rpc: method not found")
+
+// RpcError is the error returned by a remote handler.
+type RpcError struct {
+	Method  string
+	Code    uint16
+	Message string
+}
+
+func (e *RpcError) Error() string {
+	return fmt.Sprintf("rpc %s: %s", e.Method, e.Message)
+}
+
+func (e *RpcError) Is(target error) bool {
+	return target == ErrRpcMethodNotFound && e.Code == RpcErrNotFound
+}
+
+// RpcCall describes a request being served.
+type RpcCall struct {
+	Method string
+	Player *SessionPlayerBase
+	// Ctx is canceled when the caller cancels or the session closes.
+	Ctx context.Context
+}
+
+// RpcHandler serves one method. A non nil error is sent back to the caller as an RpcError.
+type RpcHandler func(call *RpcCall, req *Packet.Packet) (*Packet.Packet, error)
+
+// RpcServer is a table of RPC handlers, shared by the sessions of a service through SessionConfig.
+type RpcServer struct {
+	mutex    sync.RWMutex
+	handlers map[string]RpcHandler
+}
+
+func NewRpcServer() *RpcServer {
+	return &RpcServer{handlers: make(map[string]RpcHandler)}
+}
+
+func (r *RpcServer) Register(method string, h RpcHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.handlers[method] = h
+}
+
+func (r *RpcServer) Unregister(method string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.handlers, method)
+}
+
+func (r *RpcServer) getHandler(method string) RpcHandler {
+	if r == nil {
+		return nil
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.handlers[method]
+}
+
+//----------------------------------------------------------------------------
+
+type rpcPending struct {
+	method string
+	ch     chan rpcResult                       // for Call
+	cb     func(resp *Packet.Packet, err error) // for CallAsync
+}
+
+type rpcResult struct {
+	resp *Packet.Packet
+	err  error
+}
+
+// rpcState is the RPC part of SessionPlayerBase.
+type rpcState struct {
+	mutex    sync.Mutex
+	nextID   uint32
+	pending  map[uint32]*rpcPending
+	inflight map[uint32]context.CancelFunc
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closed   bool
+}
+
+func (r *rpcState) init() {
+	r.pending = make(map[uint32]*rpcPending)
+	r.inflight = make(map[uint32]context.CancelFunc)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+}
+
+func (r *rpcState) add(p *rpcPending) (uint32, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return 0, ErrRpcClosed
+	}
+
+	r.nextID++
+	r.pending[r.nextID] = p
+	return r.nextID, nil
+}
+
+func (r *rpcState) take(id uint32) *rpcPending {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	p, ok := r.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(r.pending, id)
+	return p
+}
+
+func encodeRpc(kind uint8, id uint32, method string, payload []byte) []byte {
+	var pak Packet.Packet
+	pak.WriteUint8(kind)
+	pak.WriteUint32(id)
+	if kind == rpcRequest || kind == rpcNotify {
+		pak.WriteString(method)
+	}
+	pak.Write(payload)
+	return pak.GetUsedBuffer()
+}
+
+func packetPayload(pak *Packet.Packet) []byte {
+	if pak == nil {
+		return nil
+	}
+	return pak.GetUsedBuffer()[pak.GetReadPos():]
+}
+
+// readString reads a string written by Packet.WriteString. Unlike Packet.ReadString it refuses
+// a length beyond the bytes left, instead of allocating whatever the peer announced.
+func readString(pak *Packet.Packet) (string, bool) {
+	if pak.Remaining() < 4 {
+		return "", false
+	}
+
+	n := pak.ReadInt32()
+	if n < 0 || int(n) > pak.Remaining() {
+		return "", false
+	}
+
+	b := make([]byte, n)
+	pak.Read(b)
+	return string(b), true
+}
+
+// Call invokes a method on the peer and waits for its response. A context without deadline
+// gets the RpcTimeout of the service. Do not call it from OnUpdate when it may take long,
+// use CallAsync there.
+func (s *SessionPlayerBase) Call(ctx context.Context, method string, req *Packet.Packet) (*Packet.Packet, error) {
+	if _, ok := ctx.Deadline(); !ok && s.cfg.RpcTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.RpcTimeout)
+		defer cancel()
+	}
+
+	p := &rpcPending{method: method, ch: make(chan rpcResult, 1)}
+	id, err := s.rpc.add(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.SendFrame(EPacketRpc, encodeRpc(rpcRequest, id, method, packetPayload(req))); err != nil {
+		s.rpc.take(id)
+		return nil, err
+	}
+
+	select {
+	case res := <-p.ch:
+		return res.resp, res.err
+
+	case <-ctx.Done():
+		if s.rpc.take(id) != nil {
+			s.SendFrame(EPacketRpc, encodeRpc(rpcCancel, id, "", nil))
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Notify invokes a method on the peer without expecting a response.
+func (s *SessionPlayerBase) Notify(method string, req *Packet.Packet) error {
+	return s.SendFrame(EPacketRpc, encodeRpc(rpcNotify, 0, method, packetPayload(req)))
+}
+
+// CallAsync invokes a method on the peer without waiting. cb runs once, with the response
+// or an error, on the network goroutine if RpcInline is set, otherwise in OnUpdate.
+func (s *SessionPlayerBase) CallAsync(ctx context.Context, method string, req *Packet.Packet, cb func(resp *Packet.Packet, err error)) {
+	var cancel context.CancelFunc = func() {}
+	if _, ok := ctx.Deadline(); !ok && s.cfg.RpcTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.RpcTimeout)
+	}
+
+	done := make(chan struct{})
+	p := &rpcPending{method: method, cb: func(resp *Packet.Packet, err error) {
+		close(done)
+		cancel()
+		s.deliverRpc(func() { cb(resp, err) })
+	}}
+
+	id, err := s.rpc.add(p)
+	if err != nil {
+		p.cb(nil, err)
+		return
+	}
+
+	if err := s.SendFrame(EPacketRpc, encodeRpc(rpcRequest, id, method, packetPayload(req))); err != nil {
+		if s.rpc.take(id) != nil {
+			p.cb(nil, err)
+		}
+		return
+	}
+
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if s.rpc.take(id) != nil {
+				s.SendFrame(EPacketRpc, encodeRpc(rpcCancel, id, "", nil))
+				p.cb(nil, ctx.Err())
+			}
+		}
+	}()
+}
+
+// deliverRpc runs fn inline or queues it for OnUpdate, following RpcInline.
+func (s *SessionPlayerBase) deliverRpc(fn func()) {
+	if s.cfg.RpcInline {
+		fn()
+		return
+	}
+
+	s.pakQueueMutex.Lock()
+	s.tasks = append(s.tasks, fn)
+	s.pakQueueMutex.Unlock()
+}
+
+func (p *rpcPending) resolve(resp *Packet.Packet, err error) {
+	if p.ch != nil {
+		p.ch <- rpcResult{resp, err}
+	} else {
+		p.cb(resp, err)
+	}
+}
+
+// onRpcPacket handles a received EPacketRpc body, on the network goroutine. It returns false
+// for a malformed body.
+func (s *SessionPlayerBase) onRpcPacket(pak *Packet.Packet) bool {
+	if pak.Remaining() < 5 {
+		return false
+	}
+	kind := pak.ReadUint8()
+	id := pak.ReadUint32()
+
+	switch kind {
+	case rpcRequest, rpcNotify:
+		method, ok := readString(pak)
+		if !ok {
+			return false
+		}
+		if kind == rpcNotify {
+			id = 0
+		}
+		s.serveRpc(id, method, pak)
+
+	case rpcResponse:
+		if p := s.rpc.take(id); p != nil {
+			resp := new(Packet.Packet)
+			resp.FromBuff(append([]byte{}, packetPayload(pak)...))
+			p.resolve(resp, nil)
+		}
+
+	case rpcError:
+		if pak.Remaining() < 2 {
+			return false
+		}
+		code := pak.ReadUint16()
+		msg, ok := readString(pak)
+		if !ok {
+			return false
+		}
+		if p := s.rpc.take(id); p != nil {
+			p.resolve(nil, &RpcError{Method: p.method, Code: code, Message: msg})
+		}
+
+	case rpcCancel:
+		s.rpc.mutex.Lock()
+		cancel, ok := s.rpc.inflight[id]
+		s.rpc.mutex.Unlock()
+		if ok {
+			cancel()
+		}
+
+	default:
+		slog.Warn("unknown rpc packet:", kind, id)
+	}
+	return true
+}
+
+// serveRpc runs the handler of a request, id is 0 for a notification which gets no response.
+func (s *SessionPlayerBase) serveRpc(id uint32, method string, pak *Packet.Packet) {
+	handler := s.cfg.Rpc.getHandler(method)
+	if handler == nil {
+		s.replyRpcError(id, RpcErrNotFound, "method not found: "+method)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.rpc.ctx)
+	if id != 0 {
+		s.rpc.mutex.Lock()
+		_, busy := s.rpc.inflight[id]
+		if !busy {
+			s.rpc.inflight[id] = cancel
+		}
+		s.rpc.mutex.Unlock()
+
+		if busy {
+			cancel()
+			s.replyRpcError(id, RpcErrDuplicateID, "request ID in use")
+			return
+		}
+	}
+
+	req := new(Packet.Packet)
+	req.FromBuff(append([]byte{}, packetPayload(pak)...))
+	call := &RpcCall{Method: method, Player: s, Ctx: ctx}
+
+	s.deliverRpc(func() {
+		defer func() {
+			s.rpc.mutex.Lock()
+			delete(s.rpc.inflight, id)
+			s.rpc.mutex.Unlock()
+			cancel()
+
+			if err := recover(); err != nil {
+				slog.Error("rpc handler panic:", method, err)
+				s.replyRpcError(id, RpcErrPanic, fmt.Sprint(err))
+			}
+		}()
+
+		if ctx.Err() != nil {
+			// canceled before it could run
+			return
+		}
+
+		resp, err := handler(call, req)
+		if err != nil {
+			s.replyRpcError(id, RpcErrHandler, err.Error())
+			return
+		}
+
+		if id != 0 {
+			s.SendFrame(EPacketRpc, encodeRpc(rpcResponse, id, "", packetPayload(resp)))
+		}
+	})
+}
+
+func (s *SessionPlayerBase) replyRpcError(id uint32, code uint16, msg string) {
+	if id == 0 {
+		slog.Warn("rpc notification failed:", msg)
+		return
+	}
+
+	var pak Packet.Packet
+	pak.WriteUint16(code)
+	pak.WriteString(msg)
+	s.SendFrame(EPacketRpc, encodeRpc(rpcError, id, "", pak.GetUsedBuffer()))
+}
+
+// closeRpc fails the pending calls and cancels the requests being served.
+func (s *SessionPlayerBase) closeRpc() {
+	s.rpc.mutex.Lock()
+	if s.rpc.closed {
+		s.rpc.mutex.Unlock()
+		return
+	}
+	s.rpc.closed = true
+	pending := s.rpc.pending
+	s.rpc.pending = make(map[uint32]*rpcPending)
+	s.rpc.mutex.Unlock()
+
+	s.rpc.cancel()
+	for _, p := range pending {
+		p.resolve(nil, ErrRpcClosed)
+	}
+}
+
+// failRpcCalls fails the pending calls, whose replies are lost with the connection. The
+// session keeps serving and making calls, see Resume.go.
+func (s *SessionPlayerBase) failRpcCalls(err error) {
+	s.rpc.mutex.Lock()
+	pending := s.rpc.pending
+	s.rpc.pending = make(map[uint32]*rpcPending)
+	s.rpc.mutex.Unlock()
+
+	for _, p := range pending {
+		p.resolve(nil, err)
+	}
+}
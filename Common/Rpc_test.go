@@ -0,0 +1,175 @@
+package Common_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+	"github.com/zhksoftGo/Packet"
+)
+
+func TestRpcCall(t *testing.T) {
+	rpc := Common.NewRpcServer()
+	rpc.Register("add", func(call *Common.RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+		a, b := req.ReadUint32(), req.ReadUint32()
+		return packet(func(pak *Packet.Packet) { pak.WriteUint32(a + b) }), nil
+	})
+	rpc.Register("fail", func(call *Common.RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+		return nil, errors.New("no way")
+	})
+	notified := make(chan string, 1)
+	rpc.Register("note", func(call *Common.RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+		notified <- req.ReadString()
+		return nil, nil
+	})
+
+	server := newPlayer(t, "rpc-server", &Common.SessionConfig{Rpc: rpc})
+	client := newPlayer(t, "rpc-client", &Common.SessionConfig{RpcTimeout: time.Second})
+	link(t, client, server)
+
+	resp, err := client.Call(context.Background(), "add", packet(func(pak *Packet.Packet) {
+		pak.WriteUint32(40)
+		pak.WriteUint32(2)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := resp.ReadUint32(); sum != 42 {
+		t.Fatalf("add returned %d", sum)
+	}
+
+	var rpcErr *Common.RpcError
+	_, err = client.Call(context.Background(), "fail", nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != Common.RpcErrHandler || rpcErr.Message != "no way" || rpcErr.Method != "fail" {
+		t.Fatalf("fail returned %v", err)
+	}
+
+	if _, err = client.Call(context.Background(), "nothing", nil); !errors.Is(err, Common.ErrRpcMethodNotFound) {
+		t.Fatalf("unknown method returned %v", err)
+	}
+
+	if err := client.Notify("note", packet(func(pak *Packet.Packet) { pak.WriteString("hi") })); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-notified:
+		if s != "hi" {
+			t.Fatalf("notified %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notification not served")
+	}
+
+	done := make(chan error, 1)
+	client.CallAsync(context.Background(), "add", packet(func(pak *Packet.Packet) {
+		pak.WriteUint32(1)
+		pak.WriteUint32(1)
+	}), func(resp *Packet.Packet, err error) {
+		if err == nil && resp.ReadUint32() != 2 {
+			err = errors.New("wrong sum")
+		}
+		done <- err
+	})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CallAsync did not complete")
+	}
+}
+
+func TestRpcCallFailsOnClose(t *testing.T) {
+	client := newPlayer(t, "rpc-close", &Common.SessionConfig{})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Call(context.Background(), "slow", nil)
+		done <- err
+	}()
+
+	if _, err := client.fake.WaitForFrames(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	client.OnClosed(nil)
+
+	if err := <-done; !errors.Is(err, Common.ErrRpcClosed) {
+		t.Fatalf("Call returned %v after close", err)
+	}
+	if _, err := client.Call(context.Background(), "late", nil); !errors.Is(err, Common.ErrRpcClosed) {
+		t.Fatalf("Call after close returned %v", err)
+	}
+}
+
+// rpcBody builds an EPacketRpc body announcing a string of length n, followed by have bytes.
+func rpcBody(kind uint8, n int32, have int) []byte {
+	b := []byte{kind, 1, 0, 0, 0}
+	if kind == 3 {
+		// rpcError code
+		b = append(b, 1, 0)
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(n))
+	return append(b, make([]byte, have)...)
+}
+
+func TestRpcRefusesBadStrings(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		ok   bool
+	}{
+		{"request", rpcBody(1, 3, 3), true},
+		{"request with payload", rpcBody(1, 3, 10), true},
+		{"huge method", rpcBody(1, 0x7fffffff, 3), false},
+		{"negative method", rpcBody(1, -1, 3), false},
+		{"method past the end", rpcBody(1, 4, 3), false},
+		{"notify past the end", rpcBody(5, 100, 0), false},
+		{"error message past the end", rpcBody(3, 1<<30, 0), false},
+		{"short header", []byte{1, 1, 0}, false},
+		{"no method length", []byte{1, 1, 0, 0, 0, 9}, false},
+		{"error without code", []byte{3, 1, 0, 0, 0, 1}, false},
+	}
+
+	for i, tt := range tests {
+		p := newPlayer(t, "rpc-bad", &Common.SessionConfig{})
+		if ok := p.recv(networktest.EncodeFrame(Common.EPacketRpc, tt.body)); ok != tt.ok {
+			t.Errorf("%d %s: recv returned %v, want %v", i, tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestRpcRefusesReusedID(t *testing.T) {
+	rpc := Common.NewRpcServer()
+	rpc.Register("echo", func(call *Common.RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+		return packet(func(pak *Packet.Packet) { pak.WriteString("first") }), nil
+	})
+	server := newPlayer(t, "rpc-reused", &Common.SessionConfig{Rpc: rpc})
+
+	request := networktest.EncodeFrame(Common.EPacketRpc, packet(func(pak *Packet.Packet) {
+		pak.WriteUint8(1)
+		pak.WriteUint32(7)
+		pak.WriteString("echo")
+	}).GetUsedBuffer())
+
+	// the first is served from OnUpdate, the second comes meanwhile
+	if !server.recv(request) || !server.recv(request) {
+		t.Fatal("request refused")
+	}
+	server.OnUpdate(0)
+
+	frames := server.sentFrames(t)
+	if len(frames) != 2 {
+		t.Fatalf("sent %d frames", len(frames))
+	}
+	if b := frames[0].Body; b[0] != 3 || binary.LittleEndian.Uint32(b[1:]) != 7 || binary.LittleEndian.Uint16(b[5:]) != Common.RpcErrDuplicateID {
+		t.Fatalf("reused ID answered %v", b)
+	}
+	if b := frames[1].Body; b[0] != 2 || binary.LittleEndian.Uint32(b[1:]) != 7 {
+		t.Fatalf("first request answered %v", b)
+	}
+}
@@ -0,0 +1,535 @@
+package Common
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Packet"
+)
+
+// registry RPC methods, served by the CenterServer except Registry.Event which is pushed to subscribers.
+const (
+	rpcRegistryRegister   = "Registry.Register"
+	rpcRegistryHeartbeat  = "Registry.Heartbeat"
+	rpcRegistryUnregister = "Registry.Unregister"
+	rpcRegistryQuery      = "Registry.Query"
+	rpcRegistrySubscribe  = "Registry.Subscribe"
+	rpcRegistryEvent      = "Registry.Event"
+)
+
+var ErrRegistryNoRpc = errors.New("registry: service has no RpcServer to receive events")
+var ErrRegistryMalformed = errors.New("registry: malformed packet")
+
+// ServiceEntry is what a server announces about itself.
+type ServiceEntry struct {
+	ID       uint64
+	Type     string // GameServer, GMServer...
+	Address  string // public address clients connect to
+	Capacity int
+	Load     int
+	LastSeen time.Time // set by the registry
+}
+
+func (e *ServiceEntry) write(pak *Packet.Packet) {
+	pak.WriteUint64(e.ID)
+	pak.WriteString(e.Type)
+	pak.WriteString(e.Address)
+	pak.WriteInt32(int32(e.Capacity))
+	pak.WriteInt32(int32(e.Load))
+	pak.WriteInt64(e.LastSeen.UnixNano())
+}
+
+// serviceEntryMinSize is the size of a written ServiceEntry with empty strings.
+const serviceEntryMinSize = 8 + 4 + 4 + 4 + 4 + 8
+
+func (e *ServiceEntry) read(pak *Packet.Packet) error {
+	if pak.Remaining() < serviceEntryMinSize {
+		return ErrRegistryMalformed
+	}
+	e.ID = pak.ReadUint64()
+
+	var ok bool
+	if e.Type, ok = readString(pak); !ok {
+		return ErrRegistryMalformed
+	}
+	if e.Address, ok = readString(pak); !ok || pak.Remaining() < 16 {
+		return ErrRegistryMalformed
+	}
+	e.Capacity = int(pak.ReadInt32())
+	e.Load = int(pak.ReadInt32())
+	e.LastSeen = time.Unix(0, pak.ReadInt64())
+	return nil
+}
+
+type RegistryEventKind uint8
+
+const (
+	RegistryAdded RegistryEventKind = iota + 1
+	RegistryUpdated
+	RegistryRemoved
+)
+
+// RegistryEvent reports a change of the registry.
+type RegistryEvent struct {
+	Kind  RegistryEventKind
+	Entry ServiceEntry
+}
+
+//----------------------------------------------------------------------------
+
+type registryItem struct {
+	entry ServiceEntry
+	owner *SessionPlayerBase // nil for local entries
+}
+
+type registrySub struct {
+	svcType string // empty for every type
+	fn      func(ev RegistryEvent)
+}
+
+// ServiceRegistry is the live list of servers kept by the CenterServer. Servers register and
+// heartbeat through RegistryClient; entries go away when their session closes, when they
+// unregister, or when no heartbeat came within the TTL.
+type ServiceRegistry struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	items   map[uint64]*registryItem
+	subs    map[int]registrySub
+	nextSub int
+	remote  map[*SessionPlayerBase]map[string]bool // subscribed sessions and their types
+	hooked  map[*SessionPlayerBase]bool
+}
+
+// NewServiceRegistry creates a registry expiring entries not refreshed within ttl, 0 means never.
+func NewServiceRegistry(ttl time.Duration) *ServiceRegistry {
+	return &ServiceRegistry{
+		ttl:    ttl,
+		items:  make(map[uint64]*registryItem),
+		subs:   make(map[int]registrySub),
+		remote: make(map[*SessionPlayerBase]map[string]bool),
+		hooked: make(map[*SessionPlayerBase]bool),
+	}
+}
+
+// Register adds the registry methods to rpc, the RpcServer of the service servers connect to.
+func (r *ServiceRegistry) Register(rpc *RpcServer) {
+	rpc.Register(rpcRegistryRegister, r.rpcUpsert)
+	rpc.Register(rpcRegistryHeartbeat, r.rpcUpsert)
+	rpc.Register(rpcRegistryUnregister, r.rpcUnregister)
+	rpc.Register(rpcRegistryQuery, r.rpcQuery)
+	rpc.Register(rpcRegistrySubscribe, r.rpcSubscribe)
+}
+
+// Put adds or refreshes a local entry, like the CenterServer itself.
+func (r *ServiceRegistry) Put(e ServiceEntry) {
+	r.put(e, nil)
+}
+
+// Remove removes an entry.
+func (r *ServiceRegistry) Remove(id uint64) {
+	r.mutex.Lock()
+	item, ok := r.items[id]
+	if ok {
+		delete(r.items, id)
+	}
+	r.mutex.Unlock()
+
+	if ok {
+		r.publish(RegistryEvent{Kind: RegistryRemoved, Entry: item.entry})
+	}
+}
+
+// Get returns the entry of a server.
+func (r *ServiceRegistry) Get(id uint64) (ServiceEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	item, ok := r.items[id]
+	if !ok {
+		return ServiceEntry{}, false
+	}
+	return item.entry, true
+}
+
+// Query returns the entries of a type ordered by ID, every entry for an empty type.
+func (r *ServiceRegistry) Query(svcType string) []ServiceEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var out []ServiceEntry
+	for _, item := range r.items {
+		if svcType == "" || item.entry.Type == svcType {
+			out = append(out, item.entry)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Subscribe calls fn for every change of the entries of a type, every type if empty.
+// fn runs on the goroutine making the change. Call the returned func to unsubscribe.
+func (r *ServiceRegistry) Subscribe(svcType string, fn func(ev RegistryEvent)) (cancel func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.nextSub++
+	id := r.nextSub
+	r.subs[id] = registrySub{svcType: svcType, fn: fn}
+
+	return func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		delete(r.subs, id)
+	}
+}
+
+// Expire removes the entries whose last heartbeat is older than the TTL. Call it periodically,
+// from OnUpdate for instance.
+func (r *ServiceRegistry) Expire(now time.Time) {
+	if r.ttl <= 0 {
+		return
+	}
+
+	var expired []ServiceEntry
+
+	r.mutex.Lock()
+	for id, item := range r.items {
+		if item.owner != nil && now.Sub(item.entry.LastSeen) > r.ttl {
+			delete(r.items, id)
+			expired = append(expired, item.entry)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, e := range expired {
+		slog.Info("ServiceRegistry expired:", e.Type, e.ID)
+		r.publish(RegistryEvent{Kind: RegistryRemoved, Entry: e})
+	}
+}
+
+func (r *ServiceRegistry) put(e ServiceEntry, owner *SessionPlayerBase) {
+	e.LastSeen = time.Now()
+
+	r.mutex.Lock()
+	item, ok := r.items[e.ID]
+	if ok && item.owner != owner {
+		r.mutex.Unlock()
+		slog.Warn("ServiceRegistry: ID already registered by another session:", e.Type, e.ID)
+		return
+	}
+
+	kind := RegistryAdded
+	if ok {
+		kind = 0
+		if item.entry.Type != e.Type || item.entry.Address != e.Address ||
+			item.entry.Capacity != e.Capacity || item.entry.Load != e.Load {
+			kind = RegistryUpdated
+		}
+	}
+	r.items[e.ID] = &registryItem{entry: e, owner: owner}
+	r.mutex.Unlock()
+
+	if owner != nil {
+		r.watch(owner)
+	}
+
+	if kind != 0 {
+		r.publish(RegistryEvent{Kind: kind, Entry: e})
+	}
+}
+
+// watch drops the entries and the subscription of a session when it closes.
+func (r *ServiceRegistry) watch(p *SessionPlayerBase) {
+	r.mutex.Lock()
+	if r.hooked[p] {
+		r.mutex.Unlock()
+		return
+	}
+	r.hooked[p] = true
+	r.mutex.Unlock()
+
+	p.AddCloseHook(func() { r.dropSession(p) })
+}
+
+func (r *ServiceRegistry) dropSession(p *SessionPlayerBase) {
+	var removed []ServiceEntry
+
+	r.mutex.Lock()
+	delete(r.hooked, p)
+	delete(r.remote, p)
+	for id, item := range r.items {
+		if item.owner == p {
+			delete(r.items, id)
+			removed = append(removed, item.entry)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, e := range removed {
+		r.publish(RegistryEvent{Kind: RegistryRemoved, Entry: e})
+	}
+}
+
+func (r *ServiceRegistry) publish(ev RegistryEvent) {
+	var fns []func(ev RegistryEvent)
+	var peers []*SessionPlayerBase
+
+	r.mutex.Lock()
+	for _, sub := range r.subs {
+		if sub.svcType == "" || sub.svcType == ev.Entry.Type {
+			fns = append(fns, sub.fn)
+		}
+	}
+	for p, types := range r.remote {
+		if types[""] || types[ev.Entry.Type] {
+			peers = append(peers, p)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, fn := range fns {
+		fn(ev)
+	}
+
+	if len(peers) == 0 {
+		return
+	}
+
+	var pak Packet.Packet
+	pak.WriteUint8(uint8(ev.Kind))
+	ev.Entry.write(&pak)
+	for _, p := range peers {
+		if err := p.Notify(rpcRegistryEvent, &pak); err != nil {
+			slog.Warn("ServiceRegistry: push event failed:", err)
+		}
+	}
+}
+
+func (r *ServiceRegistry) rpcUpsert(call *RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+	var e ServiceEntry
+	if err := e.read(req); err != nil {
+		return nil, err
+	}
+	r.put(e, call.Player)
+	return nil, nil
+}
+
+func (r *ServiceRegistry) rpcUnregister(call *RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+	id := req.ReadUint64()
+
+	r.mutex.Lock()
+	item, ok := r.items[id]
+	ok = ok && item.owner == call.Player
+	r.mutex.Unlock()
+
+	if ok {
+		r.Remove(id)
+	}
+	return nil, nil
+}
+
+func (r *ServiceRegistry) rpcQuery(call *RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+	svcType, ok := readString(req)
+	if !ok {
+		return nil, ErrRegistryMalformed
+	}
+	entries := r.Query(svcType)
+
+	resp := new(Packet.Packet)
+	resp.WriteUint32(uint32(len(entries)))
+	for i := range entries {
+		entries[i].write(resp)
+	}
+	return resp, nil
+}
+
+func (r *ServiceRegistry) rpcSubscribe(call *RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+	svcType, ok := readString(req)
+	if !ok {
+		return nil, ErrRegistryMalformed
+	}
+
+	r.mutex.Lock()
+	types, ok := r.remote[call.Player]
+	if !ok {
+		types = make(map[string]bool)
+		r.remote[call.Player] = types
+	}
+	types[svcType] = true
+	r.mutex.Unlock()
+
+	r.watch(call.Player)
+	return nil, nil
+}
+
+//----------------------------------------------------------------------------
+
+// RegistryClient talks to the ServiceRegistry of the CenterServer over a session to it.
+// Register, Heartbeat and Unregister do not wait, so they are safe on any goroutine.
+type RegistryClient struct {
+	player  *SessionPlayerBase
+	mutex   sync.Mutex
+	self    *ServiceEntry
+	subs    []registrySub
+	stopped chan struct{}
+}
+
+// NewRegistryClient creates the client of a session to the CenterServer. Receiving events
+// needs an RpcServer in the SessionConfig of the service; a later client on the same service
+// takes the events over.
+func NewRegistryClient(p *SessionPlayerBase) *RegistryClient {
+	c := &RegistryClient{player: p, stopped: make(chan struct{})}
+	if p.cfg.Rpc != nil {
+		p.cfg.Rpc.Register(rpcRegistryEvent, c.rpcEvent)
+	}
+
+	p.AddCloseHook(func() { close(c.stopped) })
+	return c
+}
+
+// Register announces this server. Heartbeats repeat the entry, so it comes back after expiry.
+func (c *RegistryClient) Register(e ServiceEntry) error {
+	c.mutex.Lock()
+	c.self = &e
+	c.mutex.Unlock()
+
+	return c.send(rpcRegistryRegister, &e)
+}
+
+// Heartbeat refreshes the entry given to Register with the current load.
+func (c *RegistryClient) Heartbeat(load int) error {
+	c.mutex.Lock()
+	if c.self == nil {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.self.Load = load
+	e := *c.self
+	c.mutex.Unlock()
+
+	return c.send(rpcRegistryHeartbeat, &e)
+}
+
+// StartHeartbeat sends a heartbeat every interval until the session closes. load may be nil.
+func (c *RegistryClient) StartHeartbeat(interval time.Duration, load func() int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stopped:
+				return
+			case <-ticker.C:
+				n := 0
+				c.mutex.Lock()
+				if c.self != nil {
+					n = c.self.Load
+				}
+				c.mutex.Unlock()
+
+				if load != nil {
+					n = load()
+				}
+
+				if err := c.Heartbeat(n); err != nil {
+					slog.Warn("registry heartbeat failed:", err)
+				}
+			}
+		}
+	}()
+}
+
+// Unregister removes this server from the registry.
+func (c *RegistryClient) Unregister() error {
+	c.mutex.Lock()
+	self := c.self
+	c.self = nil
+	c.mutex.Unlock()
+
+	if self == nil {
+		return nil
+	}
+
+	var pak Packet.Packet
+	pak.WriteUint64(self.ID)
+	return c.player.Notify(rpcRegistryUnregister, &pak)
+}
+
+// Query returns the registered servers of a type, every server for an empty type.
+func (c *RegistryClient) Query(ctx context.Context, svcType string) ([]ServiceEntry, error) {
+	var req Packet.Packet
+	req.WriteString(svcType)
+
+	resp, err := c.player.Call(ctx, rpcRegistryQuery, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	// every entry takes serviceEntryMinSize bytes at least, do not trust the count further
+	if resp.Remaining() < 4 {
+		return nil, ErrRegistryMalformed
+	}
+	n := resp.ReadUint32()
+	if uint64(n) > uint64(resp.Remaining()/serviceEntryMinSize) {
+		return nil, ErrRegistryMalformed
+	}
+
+	out := make([]ServiceEntry, n)
+	for i := range out {
+		if err := out[i].read(resp); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Subscribe calls fn for every change of the servers of a type, every type if empty.
+// fn runs like RPC handlers, in OnUpdate unless RpcInline is set.
+func (c *RegistryClient) Subscribe(svcType string, fn func(ev RegistryEvent)) error {
+	if c.player.cfg.Rpc == nil {
+		return ErrRegistryNoRpc
+	}
+
+	c.mutex.Lock()
+	c.subs = append(c.subs, registrySub{svcType: svcType, fn: fn})
+	c.mutex.Unlock()
+
+	var pak Packet.Packet
+	pak.WriteString(svcType)
+	return c.player.Notify(rpcRegistrySubscribe, &pak)
+}
+
+func (c *RegistryClient) send(method string, e *ServiceEntry) error {
+	var pak Packet.Packet
+	e.write(&pak)
+	return c.player.Notify(method, &pak)
+}
+
+func (c *RegistryClient) rpcEvent(call *RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+	var ev RegistryEvent
+	if req.Remaining() < 1 {
+		return nil, ErrRegistryMalformed
+	}
+	ev.Kind = RegistryEventKind(req.ReadUint8())
+	if err := ev.Entry.read(req); err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	subs := c.subs
+	c.mutex.Unlock()
+
+	for _, sub := range subs {
+		if sub.svcType == "" || sub.svcType == ev.Entry.Type {
+			sub.fn(ev)
+		}
+	}
+	return nil, nil
+}
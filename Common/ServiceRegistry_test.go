@@ -0,0 +1,97 @@
+package Common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Packet"
+)
+
+func TestServiceRegistry(t *testing.T) {
+	registry := Common.NewServiceRegistry(time.Minute)
+	rpc := Common.NewRpcServer()
+	registry.Register(rpc)
+
+	center := newPlayer(t, "registry-center", &Common.SessionConfig{Rpc: rpc})
+	game := newPlayer(t, "registry-game", &Common.SessionConfig{Rpc: Common.NewRpcServer(), RpcTimeout: time.Second})
+	link(t, game, center)
+
+	client := Common.NewRegistryClient(&game.SessionPlayerBase)
+	events := make(chan Common.RegistryEvent, 4)
+	if err := client.Subscribe("GameServer", func(ev Common.RegistryEvent) { events <- ev }); err != nil {
+		t.Fatal(err)
+	}
+
+	// served in order, so subscribed before the registration
+	entry := Common.ServiceEntry{ID: 7, Type: "GameServer", Address: "10.0.0.7:9000", Capacity: 100}
+	if err := client.Register(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Kind != Common.RegistryAdded || ev.Entry.ID != 7 || ev.Entry.Address != entry.Address {
+			t.Fatalf("event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	entries, err := client.Query(context.Background(), "GameServer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != 7 || entries[0].Capacity != 100 || entries[0].LastSeen.IsZero() {
+		t.Fatalf("entries %+v", entries)
+	}
+	if entries, err = client.Query(context.Background(), "GMServer"); err != nil || len(entries) != 0 {
+		t.Fatalf("entries %+v, %v", entries, err)
+	}
+
+	client.Unregister()
+	waitUntil(t, time.Second, func() bool {
+		_, ok := registry.Get(7)
+		return !ok
+	})
+}
+
+func TestRegistryQueryRefusesBadCount(t *testing.T) {
+	rpc := Common.NewRpcServer()
+	var reply func(pak *Packet.Packet)
+	rpc.Register("Registry.Query", func(call *Common.RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+		return packet(reply), nil
+	})
+
+	center := newPlayer(t, "registry-bad-center", &Common.SessionConfig{Rpc: rpc})
+	game := newPlayer(t, "registry-bad-game", &Common.SessionConfig{RpcTimeout: time.Second})
+	link(t, game, center)
+	client := Common.NewRegistryClient(&game.SessionPlayerBase)
+
+	tests := []struct {
+		name  string
+		reply func(pak *Packet.Packet)
+	}{
+		{"empty", func(pak *Packet.Packet) {}},
+		{"huge count", func(pak *Packet.Packet) { pak.WriteUint32(0xffffffff) }},
+		{"count beyond the entries", func(pak *Packet.Packet) {
+			pak.WriteUint32(2)
+			pak.Write(make([]byte, 40))
+		}},
+		{"huge type", func(pak *Packet.Packet) {
+			pak.WriteUint32(1)
+			pak.WriteUint64(1)
+			pak.WriteInt32(1 << 30)
+			pak.Write(make([]byte, 30))
+		}},
+	}
+
+	for _, tt := range tests {
+		reply = tt.reply
+		if _, err := client.Query(context.Background(), ""); !errors.Is(err, Common.ErrRegistryMalformed) {
+			t.Errorf("%s: Query returned %v", tt.name, err)
+		}
+	}
+}
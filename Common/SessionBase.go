@@ -1,14 +1,12 @@
 package Common
 
 import (
-	"bytes"
 	"container/list"
-	"encoding/binary"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/gookit/slog"
-	"github.com/smallnest/ringbuffer"
 	"github.com/zhksoftGo/Cactus/Network"
 	"github.com/zhksoftGo/Packet"
 )
@@ -35,11 +33,36 @@ const (
 	/// 4 bytes body length + 2 bytes type + body(4 bytes big Packet index + 2 bytes totalCount + 2 bytes index + body)
 	/// </summary>
 	EPacketAutoSplitLarge = 0x40
+
+	/// <summary>
+	/// rpc request/response, see Rpc.go.
+	/// 1 byte kind + 4 bytes call ID + [string method] + payload
+	/// </summary>
+	EPacketRpc = 0x50
+)
+
+// EPacketNetworkInternal body: 1 byte op + data
+const (
+	netOpHello       = 1 // see Crypto.go
+	netOpHelloReply  = 2
+	netOpPing        = 3 // see Heartbeat.go
+	netOpPong        = 4
+	netOpCompress    = 5 // see Compress.go
+	netOpLogin       = 6 // see Auth.go
+	netOpLoginReply  = 7
+	netOpResumeToken = 8 // see Resume.go
+	netOpResume      = 9
+	netOpResumeReply = 10
+	netOpResumeAck   = 11
 )
 
 func isCorrectAction(actionType uint16) bool {
+	if actionType&EPacketCompressed != 0 {
+		return isCompressible(actionType &^ EPacketCompressed)
+	}
+
 	switch actionType {
-	case EPacketGameLogic, EPacketBroadcast, EPacketGameLogicEncrypted, EPacketNetworkInternal, EPacketAutoSplitLarge:
+	case EPacketGameLogic, EPacketBroadcast, EPacketGameLogicEncrypted, EPacketNetworkInternal, EPacketAutoSplitLarge, EPacketRpc:
 		return true
 	default:
 		return false
@@ -56,29 +79,73 @@ type ISessionPlayer interface {
 	GetID() uint64
 	GetName() string
 	SetName(n string)
+	GetAccountID() uint64
 	SendMsg(b []byte) error
 	SendPacket(pak Packet.Packet) error
+	SendShared(buf *Network.SharedBuffer) error
+	GetCodec() ICodec
 	Shutdown(notify bool)
 }
 
 type SessionPlayerBase struct {
 	Network.EventHandler
 	msgHandlerUpdatable IMessageHandle
-	pakRecv             *list.List
-	pakUpdate           *list.List
+	inbox               [msgPriorityCount]list.List // received messages by priority, see MsgQueue.go
+	queueStats          QueueStats
 	pakQueueMutex       sync.Mutex
-	Name                string
-	dataRecv            *ringbuffer.RingBuffer
+	name                string // guarded by indexMutex, see SetName
+	index               playerIndexState
+	indexMutex          sync.Mutex
+	dataRecv            []byte // received bytes not framed yet
+	recvErr             error  // why OnRecvMsg returned Close, see CloseCause
+	cfg                 *SessionConfig
+	codec               ICodec
+	split               splitState
+	crypto              cryptoState
+	heartbeat           heartbeatState
+	auth                authState
+	resume              resumeState
+	peerCompress        int32 // algorithms the peer decompresses, see Compress.go
+	sendMutex           sync.Mutex
+	rpc                 rpcState
+	tasks               []func() // run by OnUpdate, guarded by pakQueueMutex
+	closeHooks          []func()
+	closeMutex          sync.Mutex
+	closed              bool
 }
 
-const maxPacketCountPerUpdate = 5
+// recvBufferKeepSize is the receive buffer capacity kept between large frames.
+const recvBufferKeepSize = 4096
 
 func (s *SessionPlayerBase) Initialize(session Network.INetworkSession, handler IMessageHandle) {
 	s.Session = session
 	s.msgHandlerUpdatable = handler
-	s.pakRecv = list.New()
-	s.pakUpdate = list.New()
-	s.dataRecv = ringbuffer.New(1024)
+	s.cfg = GetSessionConfig(session.GetServiceKey())
+	s.heartbeat.lastSeen = time.Now()
+	s.codec = s.cfg.codec()
+	s.rpc.init()
+
+	if s.cfg.Crypto != nil {
+		s.crypto.started = time.Now()
+	}
+
+	if s.cfg.Compression != nil {
+		s.announceCompression()
+	}
+
+	if s.cfg.Auth != nil {
+		s.startAuth()
+	}
+}
+
+// OnOpened starts the handshake of the services with a CryptoConfig. Handlers overriding it
+// should call it.
+func (s *SessionPlayerBase) OnOpened() (opts Network.Options, action Network.Action) {
+	opts, action = s.EventHandler.OnOpened()
+	if s.cfg.Crypto != nil {
+		s.startHandshake()
+	}
+	return
 }
 
 func (s *SessionPlayerBase) GetID() uint64 {
@@ -86,108 +153,392 @@ func (s *SessionPlayerBase) GetID() uint64 {
 }
 
 func (s *SessionPlayerBase) GetName() string {
-	return s.Name
-}
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
 
-func (s *SessionPlayerBase) SetName(n string) {
-	s.Name = n
+	return s.name
 }
 
+// Shutdown closes the session for good, a resumable player is not parked.
 func (s *SessionPlayerBase) Shutdown(notify bool) {
-	s.Session.Shutdown(notify)
+	if s.kickResume() {
+		s.closeSession()
+		return
+	}
+	s.GetNetworkSession().Shutdown(notify)
 }
 
 func (ev *SessionPlayerBase) OnRecvMsg(b []byte) Network.Action {
 
-	ev.dataRecv.Write(b)
+	ev.markSeen()
+	ev.dataRecv = append(ev.dataRecv, b...)
+	maxSize := ev.cfg.maxFrameSize()
+
+	pos := 0
+	for !ev.isReadPaused() {
+		frame, n, err := ev.codec.Decode(ev.dataRecv[pos:], maxSize)
+		if err != nil {
+			slog.Warn("abnormal protocol:", ev.Session.GetServiceKey(), ev.GetID(), err)
+			ev.dataRecv = nil
+			ev.recvErr = err
+			return Network.Close
+		}
 
-	if ev.dataRecv.Length() >= DefaultHeadLength {
-		// parse header
-		headerData := make([]byte, DefaultHeadLength)
-		copy(headerData, ev.dataRecv.Bytes()[0:DefaultHeadLength])
-		headerBuffer := bytes.NewBuffer(headerData)
+		// check the protocol actionType, as soon as the header is there
+		if !isCorrectAction(frame.Type) {
+			slog.Warn("abnormal protocol:", ev.Session.GetServiceKey(), ev.GetID(), "action type", frame.Type)
+			ev.dataRecv = nil
+			ev.recvErr = fmt.Errorf("%w: action type %#x", ErrMalformedFrame, frame.Type)
+			return Network.Close
+		}
 
-		var dataLength uint32
-		var actionType uint16
-		_ = binary.Read(headerBuffer, binary.LittleEndian, &dataLength)
-		_ = binary.Read(headerBuffer, binary.LittleEndian, &actionType)
+		if n == 0 {
+			break
+		}
+		pos += n
 
-		// check the protocol actionType,
-		if !isCorrectAction(actionType) {
-			slog.Warn("abnormal protocol:", actionType, dataLength)
+		if !ev.dispatchFrame(frame) {
+			ev.dataRecv = nil
+			ev.recvErr = fmt.Errorf("%w: type %#x", ErrFrameRefused, frame.Type)
 			return Network.Close
 		}
+	}
+
+	// keep the partial frame at the front, dropping a buffer grown for a large frame
+	rest := ev.dataRecv[pos:]
+	if cap(ev.dataRecv) > recvBufferKeepSize && len(rest) <= recvBufferKeepSize {
+		ev.dataRecv = append(make([]byte, 0, recvBufferKeepSize), rest...)
+	} else {
+		ev.dataRecv = append(ev.dataRecv[:0], rest...)
+	}
+
+	return Network.None
+}
+
+// CloseCause tells the network why OnRecvMsg returned Close, for OnClosed.
+func (ev *SessionPlayerBase) CloseCause() error {
+	return ev.recvErr
+}
+
+// dispatchFrame hands a received frame over, returning false when the session must be closed.
+func (ev *SessionPlayerBase) dispatchFrame(frame Frame) bool {
+	if len(frame.Payload()) == 0 {
+		return true
+	}
 
-		if dataLength == 0 {
-			ev.dataRecv.Read(headerData)
-			return Network.None
+	if frame.Type == EPacketAutoSplitLarge {
+		data, ok := ev.onSplitPart(frame.Payload())
+		if !ok || data == nil {
+			return ok
 		}
 
-		// parse payload
-		frameLen := int(DefaultHeadLength + dataLength)
-		if ev.dataRecv.Length() >= frameLen {
+		big, n, err := ev.codec.Decode(data, ev.cfg.maxReassemblySize())
+		if err != nil || n != len(data) || big.Type == EPacketAutoSplitLarge || !isCorrectAction(big.Type) {
+			slog.Warn("abnormal split packet:", ev.Session.GetServiceKey(), ev.GetID(), len(data), err)
+			return false
+		}
+		frame = big
+	}
 
-			data := make([]byte, frameLen)
-			ev.dataRecv.Read(data)
+	compressed := frame.Type&EPacketCompressed != 0
+	if compressed && ev.cfg.Compression == nil {
+		slog.Warn("compressed packet refused:", ev.Session.GetServiceKey(), ev.GetID(), frame.Type)
+		return false
+	}
 
-			pak := new(Packet.Packet)
-			pak.FromBuff(data)
-			ev.OnRecvPacket(pak)
+	sealedType := frame.Type
+	frame.Type &^= EPacketCompressed
 
-			return Network.None
+	payload := frame.Payload()
+	if frame.Type == EPacketGameLogicEncrypted {
+		actionType, plain, ok := ev.openSealed(sealedType, payload)
+		if !ok || !isSealable(actionType) {
+			slog.Warn("abnormal encrypted packet:", ev.Session.GetServiceKey(), ev.GetID())
+			return false
 		}
+		payload = plain
+		frame = ev.makeFrame(actionType, payload)
+	} else if ev.cfg.Crypto != nil && (compressed || !isHandshake(frame.Type, payload)) {
+		slog.Warn("plain packet refused:", ev.Session.GetServiceKey(), ev.GetID(), frame.Type)
+		return false
 	}
 
-	return Network.None
+	if compressed {
+		data, err := ev.decompress(payload)
+		if err != nil {
+			slog.Warn("abnormal compressed packet:", ev.Session.GetServiceKey(), ev.GetID(), err)
+			return false
+		}
+		frame = ev.makeFrame(frame.Type, data)
+	}
+
+	if frame.Type != EPacketNetworkInternal && ev.loginRequired() {
+		slog.Warn("packet refused before login:", ev.Session.GetServiceKey(), ev.GetID(), frame.Type)
+		return false
+	}
+
+	if frame.Type == EPacketNetworkInternal {
+		return ev.onInternalPacket(frame)
+	}
+
+	if ev.resumeWithoutAuth() {
+		ev.issueResumeToken()
+	}
+
+	if frame.Type == EPacketGameLogic || frame.Type == EPacketBroadcast {
+		ev.countReceived()
+	}
+
+	pak := new(Packet.Packet)
+	pak.FromBuff(append([]byte(nil), frame.Data...))
+	pak.SetReadPos(frame.HeadLen)
+
+	if frame.Type == EPacketRpc {
+		rpc := ev
+		if owner := ev.resumeOwner(); owner != nil {
+			rpc = owner
+		}
+		if !rpc.onRpcPacket(pak) {
+			slog.Warn("abnormal rpc packet:", ev.Session.GetServiceKey(), ev.GetID())
+			return false
+		}
+		return true
+	}
+
+	return ev.queueMsg(queuedMsg{pak, frame.Type})
+}
+
+// onInternalPacket handles the ops of EPacketNetworkInternal, an unknown op closes the session.
+func (ev *SessionPlayerBase) onInternalPacket(frame Frame) bool {
+	pak := new(Packet.Packet)
+	pak.FromBuff(append([]byte(nil), frame.Data...))
+	pak.SetReadPos(frame.HeadLen)
+
+	switch op := pak.ReadUint8(); op {
+	case netOpHello, netOpHelloReply:
+		return ev.onHandshake(op, pak)
+
+	case netOpPing, netOpPong:
+		return ev.onHeartbeat(op, pak)
+
+	case netOpCompress:
+		return ev.onCompressAnnounce(pak)
+
+	case netOpLogin:
+		return ev.onLogin(pak)
+
+	case netOpLoginReply:
+		return ev.onLoginReply(pak)
+
+	case netOpResumeToken:
+		return ev.onResumeToken(pak)
+
+	case netOpResume:
+		return ev.onResume(pak)
+
+	case netOpResumeReply:
+		return ev.onResumeReply(pak)
+
+	case netOpResumeAck:
+		return ev.onResumeAck(pak)
+
+	default:
+		slog.Warn("unknown internal op:", ev.Session.GetServiceKey(), ev.GetID(), op)
+		return false
+	}
+}
+
+// makeFrame builds the frame the codec decodes for payload.
+func (s *SessionPlayerBase) makeFrame(actionType uint16, payload []byte) Frame {
+	if data, err := encodeFrame(s.codec, actionType, payload); err == nil {
+		if frame, n, err := s.codec.Decode(data, 0); err == nil && n == len(data) && len(frame.Payload()) == len(payload) {
+			return frame
+		}
+	}
+	return Frame{Type: actionType, Data: payload}
 }
 
 func (s *SessionPlayerBase) SendMsg(b []byte) error {
-	return s.Session.SendMsg(b)
+	return s.GetNetworkSession().SendMsg(b)
 }
 
-func (s *SessionPlayerBase) SendPacket(pak Packet.Packet) error {
-	return s.Session.SendMsg(pak.GetUsedBuffer())
+// SendShared sends an encoded frame shared with other sessions, as is unless the service
+// has a CryptoConfig.
+func (s *SessionPlayerBase) SendShared(buf *Network.SharedBuffer) error {
+	if s.cfg.Resume == nil {
+		return s.sendShared(buf)
+	}
+
+	return s.resumeSend(s.frameType(buf.Bytes()), func() replayEntry { return replayEntry{shared: buf} },
+		func(conn *SessionPlayerBase) error { return conn.sendShared(buf) })
 }
 
-func (s *SessionPlayerBase) OnRecvPacket(pak *Packet.Packet) {
-	s.pakQueueMutex.Lock()
-	defer s.pakQueueMutex.Unlock()
+// sendShared sends buf as is, or sealed for this session alone.
+func (s *SessionPlayerBase) sendShared(buf *Network.SharedBuffer) error {
+	if s.cfg.Crypto != nil {
+		return s.sendPacket(buf.Bytes())
+	}
+	return s.Session.SendShared(buf)
+}
 
-	defer func() {
-		if err := recover(); err != nil {
-			slog.Error(err)
+func (s *SessionPlayerBase) GetCodec() ICodec {
+	return s.codec
+}
+
+// SendPacket sends a whole frame, split into EPacketAutoSplitLarge parts when larger than
+// the SplitSize of the service. Frames are encrypted when the service has a CryptoConfig,
+// large ones compressed when it has a CompressionConfig. It fails with ErrMalformedFrame when pak
+// is not exactly one frame of the codec, as when its length field overflowed.
+func (s *SessionPlayerBase) SendPacket(pak Packet.Packet) error {
+	b := pak.GetUsedBuffer()
+	if _, n, err := s.codec.Decode(b, 0); err != nil || n != len(b) {
+		return ErrMalformedFrame
+	}
+
+	if s.cfg.Resume == nil {
+		return s.sendPacket(b)
+	}
+
+	return s.resumeSend(s.frameType(b), func() replayEntry { return replayEntry{data: append([]byte(nil), b...)} },
+		func(conn *SessionPlayerBase) error { return conn.sendPacket(b) })
+}
+
+func (s *SessionPlayerBase) sendPacket(b []byte) error {
+	if s.cfg.Crypto != nil || s.cfg.Compression != nil {
+		if frame, n, err := s.codec.Decode(b, 0); err == nil && n == len(b) {
+			if s.mustSeal(frame.Type, frame.Payload()) {
+				return s.sendSealed(frame.Type, frame.Payload())
+			}
+
+			if isCompressible(frame.Type) {
+				if body, flag := s.compress(frame.Payload()); flag != 0 {
+					if b, err = encodeFrame(s.codec, frame.Type|flag, body); err != nil {
+						return err
+					}
+				}
+			}
 		}
-	}()
+	}
 
-	//slog.Debug(pak)
-	pak.OffsetReadPos(6)
-	s.pakRecv.PushBack(pak)
+	return s.sendFrameData(b)
 }
 
-func (s *SessionPlayerBase) OnUpdate(dt time.Duration) {
-	// slog.Debug("SessionPlayerBase.OnUpdate")
-	msgCount := 0
-	for msgCount < maxPacketCountPerUpdate && s.pakUpdate.Len() != 0 {
-		e := s.pakUpdate.Front()
-		s.msgHandlerUpdatable.HandleInComingMsg(e.Value.(*Packet.Packet))
-		s.pakUpdate.Remove(e)
-		msgCount++
+// SendFrame sends body framed by the codec of the service. Frames are encrypted when the
+// service has a CryptoConfig, and held back until the handshake is done. It fails with
+// ErrFrameTooLarge when body does not fit a frame of the codec.
+func (s *SessionPlayerBase) SendFrame(actionType uint16, body []byte) error {
+	if max := maxPayload(s.codec); max > 0 && len(body) > max {
+		return ErrFrameTooLarge
+	}
+
+	if s.cfg.Resume == nil {
+		return s.sendFrame(actionType, body)
 	}
 
-	if s.pakUpdate.Len() == 0 {
-		s.pakQueueMutex.Lock()
+	return s.resumeSend(actionType, func() replayEntry { return replayEntry{data: s.codec.Encode(actionType, body)} },
+		func(conn *SessionPlayerBase) error { return conn.sendFrame(actionType, body) })
+}
+
+func (s *SessionPlayerBase) sendFrame(actionType uint16, body []byte) error {
+	if s.mustSeal(actionType, body) {
+		return s.sendSealed(actionType, body)
+	}
 
-		t := s.pakUpdate
-		s.pakUpdate = s.pakRecv
-		s.pakRecv = t
+	if isCompressible(actionType) {
+		var flag uint16
+		body, flag = s.compress(body)
+		actionType |= flag
+	}
+
+	b, err := encodeFrame(s.codec, actionType, body)
+	if err != nil {
+		return err
+	}
+	return s.Session.SendMsg(b)
+}
+
+// sendFrameData sends a whole frame, split when larger than the SplitSize of the service.
+func (s *SessionPlayerBase) sendFrameData(b []byte) error {
+	if splitSize := s.cfg.SplitSize; splitSize > 0 && len(b) > splitSize && carriesType(s.codec) {
+		return s.sendSplit(b, splitSize)
+	}
+
+	return s.Session.SendMsg(b)
+}
+
+// OnClosed fails the pending RPC calls and runs the close hooks, unless the player is parked
+// for a resume, see Resume.go. Handlers overriding it should call it.
+func (s *SessionPlayerBase) OnClosed(err error) (action Network.Action) {
+	if owner := s.resumeOwner(); owner != nil && !owner.holdForResume(s) {
+		owner.closeSession()
+	}
+
+	if !s.holdForResume(s) {
+		s.closeSession()
+	}
+	return Network.None
+}
+
+// closeSession ends the session for good.
+func (s *SessionPlayerBase) closeSession() {
+	s.endResume()
+	s.closeRpc()
+
+	s.closeMutex.Lock()
+	hooks := s.closeHooks
+	s.closeHooks = nil
+	s.closed = true
+	s.closeMutex.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// AddCloseHook registers fn to run once the session closes. It runs at once if the session is already closed.
+func (s *SessionPlayerBase) AddCloseHook(fn func()) {
+	s.closeMutex.Lock()
+	if !s.closed {
+		s.closeHooks = append(s.closeHooks, fn)
+		s.closeMutex.Unlock()
+		return
+	}
+	s.closeMutex.Unlock()
+
+	fn()
+}
+
+// OnRecvPacket queues a received frame for OnUpdate, moving its read position past the header.
+// The session is closed when the queue is full and the service kicks.
+func (s *SessionPlayerBase) OnRecvPacket(pak *Packet.Packet) {
+	m := queuedMsg{pak: pak}
+	if frame, _, err := s.codec.Decode(pak.GetUsedBuffer(), 0); err == nil {
+		m.frameType = frame.Type
+		pak.SetReadPos(frame.HeadLen)
+	}
+
+	if !s.queueMsg(m) {
+		s.GetNetworkSession().Shutdown(true)
+	}
+}
+
+func (s *SessionPlayerBase) OnUpdate(dt time.Duration) {
+	// slog.Debug("SessionPlayerBase.OnUpdate")
+	s.pakQueueMutex.Lock()
+	tasks := s.tasks
+	s.tasks = nil
+	s.pakQueueMutex.Unlock()
 
-		s.pakQueueMutex.Unlock()
+	for _, task := range tasks {
+		task()
 	}
 
-	for msgCount < maxPacketCountPerUpdate && s.pakUpdate.Len() != 0 {
-		e := s.pakUpdate.Front()
-		s.msgHandlerUpdatable.HandleInComingMsg(e.Value.(*Packet.Packet))
-		s.pakUpdate.Remove(e)
-		msgCount++
+	// the connection parts run on the connection carrying the player, none while parked
+	if conn := s.resumeConn(); conn != nil {
+		conn.checkHandshake()
+		conn.updateHeartbeat(dt)
+		conn.expireSplit(time.Now())
 	}
+	s.updateResumeAck(dt)
+	s.handleQueued()
 }
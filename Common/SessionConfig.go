@@ -0,0 +1,187 @@
+package Common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhksoftGo/Packet"
+)
+
+// SessionConfig holds the per-service settings of SessionPlayerBase.
+// Initialize looks it up by the service key of the session.
+type SessionConfig struct {
+	// Rpc serves the RPC requests received by the sessions of the service, nil rejects them.
+	Rpc *RpcServer
+
+	// RpcInline runs RPC handlers and CallAsync callbacks on the network goroutine as soon as
+	// they arrive, instead of queueing them into OnUpdate.
+	RpcInline bool
+
+	// RpcTimeout applies to calls whose context has no deadline, 0 means no timeout.
+	RpcTimeout time.Duration
+
+	// Router dispatches the game logic and broadcast messages by message ID, nil hands them
+	// all to HandleInComingMsg.
+	Router *MessageRouter
+
+	// budget of OnUpdate: messages handled per tick, 0 means DefaultMaxMsgPerUpdate, and time
+	// spent handling them, 0 means no limit. At least one message is handled per tick.
+	MaxMsgPerUpdate int
+	MaxUpdateTime   time.Duration
+
+	// MaxQueuedMsgs bounds the messages waiting for OnUpdate, 0 leaves the queue unbounded
+	// as it always was. QueueOverflow is applied to the ones received beyond.
+	MaxQueuedMsgs int
+	QueueOverflow QueueOverflowPolicy
+
+	// reading the connection pauses once QueueHighWatermark messages wait for OnUpdate, and
+	// resumes when they are down to QueueLowWatermark. 0 never pauses, unless QueueOverflow
+	// is OverflowPauseRead; the low one defaults to half the high one.
+	QueueHighWatermark int
+	QueueLowWatermark  int
+
+	// Priority classes the received messages, nil uses the priorities of the Router.
+	Priority func(pak *Packet.Packet) MsgPriority
+
+	// Codec frames the stream of the sessions, nil means DefaultCodec.
+	Codec ICodec
+
+	// MaxFrameSize is the largest payload accepted, 0 means DefaultMaxFrameSize. The session
+	// is closed when a frame announces or reaches more.
+	MaxFrameSize int
+
+	// SplitSize is the largest frame SendPacket sends in one piece, larger ones go as
+	// EPacketAutoSplitLarge parts of this size, or less if the Codec cannot frame them.
+	// 0 or negative never splits, as codecs without frame type, like DelimiterCodec, never do.
+	SplitSize int
+
+	// limits of the reassembly of received EPacketAutoSplitLarge parts, the session is closed
+	// when exceeded. 0 means the default.
+	MaxReassemblies   int           // big packets being reassembled at once
+	MaxReassemblySize int           // bytes held by all of them
+	ReassemblyTimeout time.Duration // a big packet not complete in time is dropped
+
+	// Crypto enables the handshake and the encryption of game logic frames, nil sends them plain.
+	Crypto *CryptoConfig
+
+	// HeartbeatInterval is how often a ping is sent, 0 sends none. Pings are always answered.
+	HeartbeatInterval time.Duration
+
+	// HeartbeatMaxMissed is the number of pings without pong closing the session, 0 means 3.
+	HeartbeatMaxMissed int
+
+	// Auth makes the sessions log in before anything else, nil accepts them as they come.
+	Auth *AuthConfig
+
+	// Compression enables the compression of large frames once the peer announced it can
+	// decompress them, nil sends them raw and refuses the compressed frames received.
+	// Codecs without frame type never compress.
+	Compression *CompressionConfig
+
+	// Resume parks the players whose connection drops, for a new connection to resume them,
+	// nil closes them at once.
+	Resume *ResumeConfig
+}
+
+const DefaultMaxFrameSize = 1 << 20
+
+const (
+	DefaultMaxReassemblies   = 4
+	DefaultMaxReassemblySize = 16 << 20
+	DefaultReassemblyTimeout = 30 * time.Second
+)
+
+var defaultSessionConfig = &SessionConfig{
+	RpcTimeout: 30 * time.Second,
+}
+
+var sessionConfigs = make(map[string]*SessionConfig)
+var sessionConfigMutex sync.Mutex
+
+// SetSessionConfig sets the config of a service, for the sessions initialized afterwards.
+func SetSessionConfig(svcKey string, cfg *SessionConfig) {
+	sessionConfigMutex.Lock()
+	defer sessionConfigMutex.Unlock()
+
+	sessionConfigs[svcKey] = cfg
+}
+
+func (cfg *SessionConfig) codec() ICodec {
+	if cfg.Codec == nil {
+		return DefaultCodec
+	}
+	return cfg.Codec
+}
+
+func (cfg *SessionConfig) maxFrameSize() int {
+	if cfg.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return cfg.MaxFrameSize
+}
+
+func (cfg *SessionConfig) maxMsgPerUpdate() int {
+	if cfg.MaxMsgPerUpdate <= 0 {
+		return DefaultMaxMsgPerUpdate
+	}
+	return cfg.MaxMsgPerUpdate
+}
+
+func (cfg *SessionConfig) pauseReadAt() int {
+	if cfg.QueueHighWatermark > 0 {
+		return cfg.QueueHighWatermark
+	}
+	if cfg.QueueOverflow == OverflowPauseRead {
+		return cfg.MaxQueuedMsgs
+	}
+	return 0
+}
+
+func (cfg *SessionConfig) resumeReadAt() int {
+	high := cfg.pauseReadAt()
+	if cfg.QueueLowWatermark > 0 && cfg.QueueLowWatermark < high {
+		return cfg.QueueLowWatermark
+	}
+	return high / 2
+}
+
+func (cfg *SessionConfig) heartbeatMaxMissed() int {
+	if cfg.HeartbeatMaxMissed <= 0 {
+		return 3
+	}
+	return cfg.HeartbeatMaxMissed
+}
+
+func (cfg *SessionConfig) maxReassemblies() int {
+	if cfg.MaxReassemblies <= 0 {
+		return DefaultMaxReassemblies
+	}
+	return cfg.MaxReassemblies
+}
+
+func (cfg *SessionConfig) maxReassemblySize() int {
+	if cfg.MaxReassemblySize <= 0 {
+		return DefaultMaxReassemblySize
+	}
+	return cfg.MaxReassemblySize
+}
+
+func (cfg *SessionConfig) reassemblyTimeout() time.Duration {
+	if cfg.ReassemblyTimeout <= 0 {
+		return DefaultReassemblyTimeout
+	}
+	return cfg.ReassemblyTimeout
+}
+
+// GetSessionConfig returns the config of a service, or the default one.
+func GetSessionConfig(svcKey string) *SessionConfig {
+	sessionConfigMutex.Lock()
+	defer sessionConfigMutex.Unlock()
+
+	cfg, ok := sessionConfigs[svcKey]
+	if !ok {
+		return defaultSessionConfig
+	}
+
+	return cfg
+}
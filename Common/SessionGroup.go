@@ -2,9 +2,11 @@ package Common
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/gookit/slog"
+	"github.com/zhksoftGo/Cactus/Network"
 	"github.com/zhksoftGo/Packet"
 )
 
@@ -12,34 +14,68 @@ type SessionGroup struct {
 	SessionPlayers map[uint64]ISessionPlayer
 	sMutex         RecursiveMutex
 	Running        bool
+
+	// UpdateShards splits the players updated by Update into shards updated in parallel,
+	// 0 or 1 updates them in sequence on the Update goroutine. With more shards, players of
+	// different shards must not share unlocked state in OnUpdate.
+	// UpdateWorkers is the number of shards updated in parallel, 0 means all of them.
+	// Set them before adding players.
+	UpdateShards  int
+	UpdateWorkers int
+
+	// Timers, when set, is advanced by Update at the start of each tick, so its callbacks run
+	// on the Update goroutine before globalUpdateFun.
+	Timers *TimerWheel
+
+	RoomHooks   RoomHooks
+	rooms       map[string]*Room
+	playerRooms map[uint64]map[string]*Room
+	byName      playerIndex
+	byAccount   playerIndex
+	byKey       map[string]playerIndex
+	byTag       playerIndex
+	shards      []*updateShard
+	shardsOnce  sync.Once
+	stats       UpdateStats
+	statsMutex  sync.Mutex
 }
 
+// Update ticks Timers, globalUpdateFun then every player every dtInMS, the shards of players
+// in parallel if UpdateShards asks for some.
 func (evMgr *SessionGroup) Update(ctx context.Context, dtInMS int, globalUpdateFun func(dt time.Duration)) {
 	slog.Info("SessionGroup.Update() begin")
 
 	defer slog.Info("SessionGroup.Update() end")
 
 	evMgr.Running = true
+	evMgr.initShards()
 
 	duration := time.Duration(dtInMS) * time.Millisecond
 	ticker := time.NewTicker(duration)
 	defer ticker.Stop()
 
+	var wg sync.WaitGroup
+	work, stop := evMgr.startUpdateWorkers(duration, &wg)
+	defer stop()
+
+	last := time.Now()
 	for {
 		select {
 		case <-ctx.Done():
 			slog.Info(ctx.Err())
 			return
-		case <-ticker.C:
-			globalUpdateFun(duration)
+		case t := <-ticker.C:
+			start := time.Now()
 
-			evMgr.sMutex.Lock()
-			for _, v := range evMgr.SessionPlayers {
-				v.OnUpdate(duration)
+			if evMgr.Timers != nil {
+				evMgr.Timers.Advance(t.Sub(last))
 			}
-			evMgr.sMutex.Unlock()
-		default:
-			time.Sleep(time.Millisecond)
+			last = t
+
+			globalUpdateFun(duration)
+			evMgr.updateShards(duration, work, &wg)
+
+			evMgr.recordTick(time.Since(start), start.Sub(t), duration)
 		}
 	}
 }
@@ -59,6 +95,8 @@ func (evMgr *SessionGroup) AddSessionPlayer(s ISessionPlayer) bool {
 	if !ok {
 		slog.Info("AddSessionPlayer, ID: ", id)
 		evMgr.SessionPlayers[id] = s
+		evMgr.addToIndexes(s)
+		evMgr.addToShard(s)
 		return true
 	}
 
@@ -83,27 +121,105 @@ func (evMgr *SessionGroup) RemoveSessionPlayer(s ISessionPlayer) {
 	defer evMgr.sMutex.Unlock()
 
 	id := s.GetID()
-	delete(evMgr.SessionPlayers, id)
+	if p, ok := evMgr.SessionPlayers[id]; ok {
+		evMgr.leaveAllRooms(id)
+		evMgr.removeFromIndexes(p)
+		evMgr.removeFromShard(id)
+		delete(evMgr.SessionPlayers, id)
+	}
+}
+
+func (evMgr *SessionGroup) GetSessionPlayerCount() int {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	return len(evMgr.SessionPlayers)
 }
 
+// GetSessionPlayerByName returns the oldest player of a name, set with SetName.
 func (evMgr *SessionGroup) GetSessionPlayerByName(k string) ISessionPlayer {
 	evMgr.sMutex.Lock()
 	defer evMgr.sMutex.Unlock()
 
-	for _, v := range evMgr.SessionPlayers {
-		if v.GetName() == k {
-			return v
+	return evMgr.byName.first(k)
+}
+
+// BroadcastPacket sends a whole frame to every player with SendPacket, so it is encrypted,
+// compressed or split as the service says. It returns how many players it reached.
+func (evMgr *SessionGroup) BroadcastPacket(pak Packet.Packet) int {
+	n := 0
+	for _, v := range evMgr.snapshot(nil, nil) {
+		if v.SendPacket(pak) == nil {
+			n++
 		}
 	}
+	return n
+}
+
+// Broadcast sends body as an EPacketBroadcast frame to the players accepted by filter, nil
+// accepts all, except the excluded IDs. The frame is encoded once per codec and written
+// asynchronously, encrypted for each player by the services with a CryptoConfig; broadcast
+// frames are neither compressed nor split.
+// It returns how many players it reached.
+func (evMgr *SessionGroup) Broadcast(body []byte, filter func(p ISessionPlayer) bool, exclude ...uint64) int {
+	return broadcastTo(evMgr.snapshot(filter, exclude), body)
+}
+
+func broadcastTo(players []ISessionPlayer, body []byte) int {
+	bufs := make(map[ICodec]*Network.SharedBuffer)
+	defer func() {
+		for _, buf := range bufs {
+			if buf != nil {
+				buf.Release()
+			}
+		}
+	}()
+
+	n := 0
+	for _, v := range players {
+		codec := v.GetCodec()
+		buf, ok := bufs[codec]
+		if !ok {
+			// nil for the codecs which cannot frame body
+			if data, err := encodeFrame(codec, EPacketBroadcast, body); err != nil {
+				slog.Warn("broadcast not sent:", err)
+			} else {
+				buf = Network.NewSharedBuffer(data)
+			}
+			bufs[codec] = buf
+		}
 
-	return nil
+		if buf != nil && v.SendShared(buf) == nil {
+			n++
+		}
+	}
+	return n
 }
 
-func (evMgr *SessionGroup) BroadcastPacket(pak Packet.Packet) {
+// snapshot returns the players to send to, so the lock is not held while sending.
+func (evMgr *SessionGroup) snapshot(filter func(p ISessionPlayer) bool, exclude []uint64) []ISessionPlayer {
 	evMgr.sMutex.Lock()
 	defer evMgr.sMutex.Unlock()
 
-	for _, v := range evMgr.SessionPlayers {
-		v.SendPacket(pak)
+	return filterPlayers(evMgr.SessionPlayers, filter, exclude)
+}
+
+func filterPlayers(players map[uint64]ISessionPlayer, filter func(p ISessionPlayer) bool, exclude []uint64) []ISessionPlayer {
+	out := make([]ISessionPlayer, 0, len(players))
+	for id, v := range players {
+		if containsID(exclude, id) || (filter != nil && !filter(v)) {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func containsID(ids []uint64, id uint64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,86 @@
+package Common_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zhksoftGo/Cactus/Common"
+)
+
+func newGroup(players ...*testPlayer) *Common.SessionGroup {
+	g := &Common.SessionGroup{SessionPlayers: map[uint64]Common.ISessionPlayer{}}
+	for _, p := range players {
+		g.AddSessionPlayer(p)
+	}
+	return g
+}
+
+func TestBroadcastSharesFrames(t *testing.T) {
+	a := newPlayer(t, "group-broadcast", nil)
+	b := newPlayer(t, "group-broadcast", nil)
+	c := newPlayer(t, "group-broadcast", nil)
+	g := newGroup(a, b, c)
+
+	if n := g.Broadcast([]byte("news"), nil, c.GetID()); n != 2 {
+		t.Fatalf("reached %d players", n)
+	}
+
+	for _, p := range []*testPlayer{a, b} {
+		frames := p.sentFrames(t)
+		if len(frames) != 1 || frames[0].Type != Common.EPacketBroadcast || string(frames[0].Body) != "news" {
+			t.Fatalf("player %d got %v", p.GetID(), frames)
+		}
+	}
+	if sent := c.fake.Sent(); len(sent) != 0 {
+		t.Fatal("excluded player reached")
+	}
+
+	only := func(p Common.ISessionPlayer) bool { return p.GetID() == b.GetID() }
+	if n := g.Broadcast([]byte("b only"), only); n != 1 || len(b.fake.Sent()) != 2 || len(a.fake.Sent()) != 1 {
+		t.Fatalf("filter reached %d players", n)
+	}
+}
+
+func TestBroadcastPacketUsesSendPacket(t *testing.T) {
+	cfg := &Common.SessionConfig{Compression: &Common.CompressionConfig{}}
+	a := newPlayer(t, "group-packet", cfg)
+	peer := newPlayer(t, "group-packet", nil)
+	pump(a, peer)
+	a.fake.ClearSent()
+
+	plain := newPlayer(t, "group-packet-plain", nil)
+	g := newGroup(a, plain)
+
+	payload := bytes.Repeat([]byte("everyone "), 1000)
+	if n := g.BroadcastPacket(framePacket(Common.DefaultCodec, Common.EPacketGameLogic, payload)); n != 2 {
+		t.Fatalf("reached %d players", n)
+	}
+
+	if frames := a.sentFrames(t); len(frames) != 1 || frames[0].Type != Common.EPacketGameLogic|Common.EPacketCompressed {
+		t.Fatalf("compressing player got %v", frames)
+	}
+	if frames := plain.sentFrames(t); len(frames) != 1 || !bytes.Equal(frames[0].Body, payload) {
+		t.Fatal("plain player got another frame")
+	}
+}
+
+func TestBroadcastIsSealed(t *testing.T) {
+	client, server := cryptoPair(t, "group-sealed", &Common.SessionConfig{}, &Common.SessionConfig{})
+	pump(client, server)
+	sent := len(server.fake.Sent())
+
+	if n := newGroup(server).Broadcast([]byte("secret"), nil); n != 1 {
+		t.Fatalf("reached %d players", n)
+	}
+
+	frames := server.sentFrames(t)[sent:]
+	if len(frames) != 1 || frames[0].Type != Common.EPacketGameLogicEncrypted {
+		t.Fatalf("sent %v", frames)
+	}
+
+	pump(client, server)
+	client.OnUpdate(0)
+	if msgs := client.messages(); len(msgs) != 1 || string(payloadOf(msgs[0])) != "secret" {
+		t.Fatalf("%d messages", len(msgs))
+	}
+}
@@ -0,0 +1,335 @@
+package Common
+
+import (
+	"strconv"
+)
+
+// playerIndex maps a key to the players having it. Keys are not unique: two sessions may log
+// in with the same account.
+type playerIndex map[string]map[uint64]ISessionPlayer
+
+func (ix playerIndex) add(key string, p ISessionPlayer) {
+	players, ok := ix[key]
+	if !ok {
+		players = make(map[uint64]ISessionPlayer)
+		ix[key] = players
+	}
+	players[p.GetID()] = p
+}
+
+func (ix playerIndex) remove(key string, id uint64) {
+	if players, ok := ix[key]; ok {
+		delete(players, id)
+		if len(players) == 0 {
+			delete(ix, key)
+		}
+	}
+}
+
+// first returns the player of key with the lowest ID, the oldest session.
+func (ix playerIndex) first(key string) ISessionPlayer {
+	var out ISessionPlayer
+	for id, p := range ix[key] {
+		if out == nil || id < out.GetID() {
+			out = p
+		}
+	}
+	return out
+}
+
+func (ix playerIndex) all(key string) []ISessionPlayer {
+	out := make([]ISessionPlayer, 0, len(ix[key]))
+	for _, p := range ix[key] {
+		out = append(out, p)
+	}
+	return out
+}
+
+func accountKey(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+//----------------------------------------------------------------------------
+
+// indexedPlayer is implemented by the players embedding SessionPlayerBase, the only ones the
+// group indexes.
+type indexedPlayer interface {
+	sessionBase() *SessionPlayerBase
+}
+
+func (s *SessionPlayerBase) sessionBase() *SessionPlayerBase {
+	return s
+}
+
+// playerIndexState is the indexed part of SessionPlayerBase, guarded by indexMutex.
+type playerIndexState struct {
+	group     *SessionGroup
+	accountID uint64
+	keys      map[string]string // index name -> key
+	tags      map[string]bool
+}
+
+// updateIndex runs fn with the player and its group, if any, locked. fn changes the player
+// and the indexes of the group together.
+func (s *SessionPlayerBase) updateIndex(fn func(g *SessionGroup)) {
+	for {
+		s.indexMutex.Lock()
+		g := s.index.group
+		s.indexMutex.Unlock()
+
+		if g != nil {
+			g.sMutex.Lock()
+		}
+		s.indexMutex.Lock()
+
+		same := s.index.group == g
+		if same {
+			fn(g)
+		}
+
+		s.indexMutex.Unlock()
+		if g != nil {
+			g.sMutex.Unlock()
+		}
+
+		if same {
+			return
+		}
+	}
+}
+
+// SetName sets the name, indexed by the group for GetSessionPlayerByName.
+func (s *SessionPlayerBase) SetName(n string) {
+	s.updateIndex(func(g *SessionGroup) {
+		if g != nil {
+			g.byName.remove(s.name, s.GetID())
+			if n != "" {
+				g.byName.add(n, g.SessionPlayers[s.GetID()])
+			}
+		}
+		s.name = n
+	})
+}
+
+func (s *SessionPlayerBase) GetAccountID() uint64 {
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+
+	return s.index.accountID
+}
+
+// SetAccountID sets the account logged in on the session, 0 for none.
+func (s *SessionPlayerBase) SetAccountID(id uint64) {
+	s.updateIndex(func(g *SessionGroup) {
+		if g != nil {
+			g.byAccount.remove(accountKey(s.index.accountID), s.GetID())
+			if id != 0 {
+				g.byAccount.add(accountKey(id), g.SessionPlayers[s.GetID()])
+			}
+		}
+		s.index.accountID = id
+	})
+}
+
+// SetIndexKey sets the key of the player in a custom index, like a character ID or a
+// guild, found with GetSessionPlayerByKey. An empty key removes the player from the index.
+func (s *SessionPlayerBase) SetIndexKey(index, key string) {
+	s.updateIndex(func(g *SessionGroup) {
+		old, had := s.index.keys[index]
+		if g != nil {
+			if had {
+				g.byKey[index].remove(old, s.GetID())
+			}
+			if key != "" {
+				g.keyIndex(index).add(key, g.SessionPlayers[s.GetID()])
+			}
+		}
+
+		if key == "" {
+			delete(s.index.keys, index)
+			return
+		}
+		if s.index.keys == nil {
+			s.index.keys = make(map[string]string)
+		}
+		s.index.keys[index] = key
+	})
+}
+
+func (s *SessionPlayerBase) GetIndexKey(index string) string {
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+
+	return s.index.keys[index]
+}
+
+// AddTag tags the player, found with GetSessionPlayersByTags.
+func (s *SessionPlayerBase) AddTag(tag string) {
+	s.updateIndex(func(g *SessionGroup) {
+		if s.index.tags[tag] {
+			return
+		}
+		if s.index.tags == nil {
+			s.index.tags = make(map[string]bool)
+		}
+		s.index.tags[tag] = true
+
+		if g != nil {
+			g.byTag.add(tag, g.SessionPlayers[s.GetID()])
+		}
+	})
+}
+
+func (s *SessionPlayerBase) RemoveTag(tag string) {
+	s.updateIndex(func(g *SessionGroup) {
+		if !s.index.tags[tag] {
+			return
+		}
+		delete(s.index.tags, tag)
+
+		if g != nil {
+			g.byTag.remove(tag, s.GetID())
+		}
+	})
+}
+
+func (s *SessionPlayerBase) HasTag(tag string) bool {
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+
+	return s.index.tags[tag]
+}
+
+//----------------------------------------------------------------------------
+
+func (evMgr *SessionGroup) keyIndex(index string) playerIndex {
+	ix, ok := evMgr.byKey[index]
+	if !ok {
+		ix = make(playerIndex)
+		evMgr.byKey[index] = ix
+	}
+	return ix
+}
+
+// addToIndexes runs under the group lock when a player is added.
+func (evMgr *SessionGroup) addToIndexes(p ISessionPlayer) {
+	if evMgr.byName == nil {
+		evMgr.byName = make(playerIndex)
+		evMgr.byAccount = make(playerIndex)
+		evMgr.byKey = make(map[string]playerIndex)
+		evMgr.byTag = make(playerIndex)
+	}
+
+	ip, ok := p.(indexedPlayer)
+	if !ok {
+		return
+	}
+	base := ip.sessionBase()
+	base.indexMutex.Lock()
+	defer base.indexMutex.Unlock()
+
+	base.index.group = evMgr
+	if base.name != "" {
+		evMgr.byName.add(base.name, p)
+	}
+	if base.index.accountID != 0 {
+		evMgr.byAccount.add(accountKey(base.index.accountID), p)
+	}
+	for index, key := range base.index.keys {
+		evMgr.keyIndex(index).add(key, p)
+	}
+	for tag := range base.index.tags {
+		evMgr.byTag.add(tag, p)
+	}
+}
+
+// removeFromIndexes runs under the group lock when a player is removed.
+func (evMgr *SessionGroup) removeFromIndexes(p ISessionPlayer) {
+	ip, ok := p.(indexedPlayer)
+	if !ok {
+		return
+	}
+	base := ip.sessionBase()
+	base.indexMutex.Lock()
+	defer base.indexMutex.Unlock()
+
+	if base.index.group != evMgr {
+		return
+	}
+	base.index.group = nil
+
+	id := p.GetID()
+	evMgr.byName.remove(base.name, id)
+	evMgr.byAccount.remove(accountKey(base.index.accountID), id)
+	for index, key := range base.index.keys {
+		evMgr.byKey[index].remove(key, id)
+	}
+	for tag := range base.index.tags {
+		evMgr.byTag.remove(tag, id)
+	}
+}
+
+// GetSessionPlayerByAccountID returns the oldest session of an account.
+func (evMgr *SessionGroup) GetSessionPlayerByAccountID(id uint64) ISessionPlayer {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	return evMgr.byAccount.first(accountKey(id))
+}
+
+// GetSessionPlayersByAccountID returns all the sessions of an account.
+func (evMgr *SessionGroup) GetSessionPlayersByAccountID(id uint64) []ISessionPlayer {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	return evMgr.byAccount.all(accountKey(id))
+}
+
+// GetSessionPlayerByKey returns the oldest player having key in a custom index.
+func (evMgr *SessionGroup) GetSessionPlayerByKey(index, key string) ISessionPlayer {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	return evMgr.byKey[index].first(key)
+}
+
+// GetSessionPlayersByKey returns the players having key in a custom index.
+func (evMgr *SessionGroup) GetSessionPlayersByKey(index, key string) []ISessionPlayer {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	return evMgr.byKey[index].all(key)
+}
+
+// GetSessionPlayersByTags returns the players having all the tags.
+func (evMgr *SessionGroup) GetSessionPlayersByTags(tags ...string) []ISessionPlayer {
+	evMgr.sMutex.Lock()
+	defer evMgr.sMutex.Unlock()
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	// walk the smallest set
+	smallest := tags[0]
+	for _, tag := range tags[1:] {
+		if len(evMgr.byTag[tag]) < len(evMgr.byTag[smallest]) {
+			smallest = tag
+		}
+	}
+
+	var out []ISessionPlayer
+	for id, p := range evMgr.byTag[smallest] {
+		ok := true
+		for _, tag := range tags {
+			if _, has := evMgr.byTag[tag][id]; !has {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package Common_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Packet"
+)
+
+// plainPlayer implements ISessionPlayer without SessionPlayerBase.
+type plainPlayer struct {
+	id   uint64
+	name string
+}
+
+func (p *plainPlayer) Initialize(Network.INetworkSession, Common.IMessageHandle) {}
+func (p *plainPlayer) OnUpdate(time.Duration)                                    {}
+func (p *plainPlayer) GetID() uint64                                             { return p.id }
+func (p *plainPlayer) GetName() string                                           { return p.name }
+func (p *plainPlayer) SetName(n string)                                          { p.name = n }
+func (p *plainPlayer) GetAccountID() uint64                                      { return 0 }
+func (p *plainPlayer) SendMsg([]byte) error                                      { return nil }
+func (p *plainPlayer) SendPacket(Packet.Packet) error                            { return nil }
+func (p *plainPlayer) SendShared(*Network.SharedBuffer) error                    { return nil }
+func (p *plainPlayer) GetCodec() Common.ICodec                                   { return Common.DefaultCodec }
+func (p *plainPlayer) Shutdown(bool)                                             {}
+
+func TestIndexedLookups(t *testing.T) {
+	a := newPlayer(t, "index-lookup", nil)
+	b := newPlayer(t, "index-lookup", nil)
+
+	// set before joining the group
+	a.SetName("alice")
+	a.SetAccountID(7)
+	a.AddTag("vip")
+
+	g := newGroup(a, b)
+	b.SetName("bob")
+	b.SetAccountID(7)
+	b.SetIndexKey("guild", "red")
+	b.AddTag("vip")
+	b.AddTag("gm")
+
+	if g.GetSessionPlayerByName("alice") != Common.ISessionPlayer(a) || g.GetSessionPlayerByName("bob") != Common.ISessionPlayer(b) {
+		t.Fatal("by name")
+	}
+	if g.GetSessionPlayerByAccountID(7) != Common.ISessionPlayer(a) || len(g.GetSessionPlayersByAccountID(7)) != 2 {
+		t.Fatal("by account")
+	}
+	if g.GetSessionPlayerByKey("guild", "red") != Common.ISessionPlayer(b) || len(g.GetSessionPlayersByKey("guild", "blue")) != 0 {
+		t.Fatal("by key")
+	}
+	if len(g.GetSessionPlayersByTags("vip")) != 2 || len(g.GetSessionPlayersByTags("vip", "gm")) != 1 || len(g.GetSessionPlayersByTags()) != 0 {
+		t.Fatal("by tags")
+	}
+
+	// changes follow
+	a.SetName("alicia")
+	b.SetIndexKey("guild", "")
+	b.RemoveTag("vip")
+	if g.GetSessionPlayerByName("alice") != nil || g.GetSessionPlayerByName("alicia") != Common.ISessionPlayer(a) || a.GetName() != "alicia" {
+		t.Fatal("renamed")
+	}
+	if g.GetSessionPlayerByKey("guild", "red") != nil || b.GetIndexKey("guild") != "" {
+		t.Fatal("key removed")
+	}
+	if len(g.GetSessionPlayersByTags("vip")) != 1 || b.HasTag("vip") || !b.HasTag("gm") {
+		t.Fatal("tag removed")
+	}
+
+	// removed, the player is not found but keeps its values
+	g.RemoveSessionPlayer(a)
+	if g.GetSessionPlayerByName("alicia") != nil || g.GetSessionPlayerByAccountID(7) != Common.ISessionPlayer(b) {
+		t.Fatal("removed player found")
+	}
+	if a.GetName() != "alicia" || a.GetAccountID() != 7 || !a.HasTag("vip") {
+		t.Fatal("removed player lost its values")
+	}
+}
+
+func TestGroupWithPlainPlayers(t *testing.T) {
+	p := &plainPlayer{id: 1 << 60, name: "plain"}
+	g := newGroup()
+	if !g.AddSessionPlayer(p) || g.GetSessionPlayer(p.id) != Common.ISessionPlayer(p) {
+		t.Fatal("plain player not added")
+	}
+	if g.GetSessionPlayerByName("plain") != nil {
+		t.Fatal("plain player indexed")
+	}
+	g.RemoveSessionPlayer(p)
+	if g.GetSessionPlayerCount() != 0 {
+		t.Fatal("plain player not removed")
+	}
+}
+
+func TestSetNameConcurrently(t *testing.T) {
+	p := newPlayer(t, "index-race", nil)
+	g := newGroup(p)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.SetName("a")
+				p.GetName()
+				g.GetSessionPlayerByName("a")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if g.GetSessionPlayerByName("a") != Common.ISessionPlayer(p) {
+		t.Fatal("name lost")
+	}
+}
@@ -0,0 +1,162 @@
+package Common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+)
+
+// UpdateStats describes the ticks of SessionGroup.Update.
+type UpdateStats struct {
+	Ticks        int64
+	Overruns     int64         // ticks longer than the interval
+	LastDuration time.Duration // time spent in the last tick
+	MaxDuration  time.Duration
+	LastLag      time.Duration // delay of the last tick start after its schedule
+	MaxLag       time.Duration
+}
+
+// updateShard is a part of the players of a group, updated by one worker at a time. Its lock
+// is only held to change or read the shard, never while calling out, so it can be taken
+// with the group lock held.
+type updateShard struct {
+	mutex   sync.Mutex
+	players map[uint64]ISessionPlayer
+	list    []ISessionPlayer // players in update order, rebuilt when dirty; used by the worker only
+	dirty   bool
+}
+
+func (sh *updateShard) has(id uint64) bool {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	_, ok := sh.players[id]
+	return ok
+}
+
+func (sh *updateShard) update(dt time.Duration) {
+	sh.mutex.Lock()
+	if sh.dirty {
+		sh.list = sh.list[:0]
+		for _, v := range sh.players {
+			sh.list = append(sh.list, v)
+		}
+		sh.dirty = false
+	}
+	list := sh.list
+	sh.mutex.Unlock()
+
+	for _, v := range list {
+		// an update may remove players of the shard
+		if sh.has(v.GetID()) {
+			v.OnUpdate(dt)
+		}
+	}
+}
+
+func (evMgr *SessionGroup) initShards() {
+	evMgr.shardsOnce.Do(func() {
+		n := evMgr.UpdateShards
+		if n <= 0 {
+			n = 1
+		}
+
+		evMgr.shards = make([]*updateShard, n)
+		for i := range evMgr.shards {
+			evMgr.shards[i] = &updateShard{players: make(map[uint64]ISessionPlayer)}
+		}
+	})
+}
+
+func (evMgr *SessionGroup) shardOf(id uint64) *updateShard {
+	evMgr.initShards()
+	return evMgr.shards[id%uint64(len(evMgr.shards))]
+}
+
+// addToShard and removeFromShard run under the group lock.
+func (evMgr *SessionGroup) addToShard(s ISessionPlayer) {
+	sh := evMgr.shardOf(s.GetID())
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	sh.players[s.GetID()] = s
+	sh.dirty = true
+}
+
+func (evMgr *SessionGroup) removeFromShard(id uint64) {
+	sh := evMgr.shardOf(id)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	delete(sh.players, id)
+	sh.dirty = true
+}
+
+// updateShards ticks every shard with the workers and waits for them, or ticks the only shard
+// on this goroutine.
+func (evMgr *SessionGroup) updateShards(dt time.Duration, work chan<- *updateShard, wg *sync.WaitGroup) {
+	if work == nil {
+		evMgr.shards[0].update(dt)
+		return
+	}
+
+	wg.Add(len(evMgr.shards))
+	for _, sh := range evMgr.shards {
+		work <- sh
+	}
+	wg.Wait()
+}
+
+func (evMgr *SessionGroup) startUpdateWorkers(dt time.Duration, wg *sync.WaitGroup) (chan<- *updateShard, func()) {
+	if len(evMgr.shards) == 1 {
+		return nil, func() {}
+	}
+
+	n := evMgr.UpdateWorkers
+	if n <= 0 || n > len(evMgr.shards) {
+		n = len(evMgr.shards)
+	}
+
+	work := make(chan *updateShard, len(evMgr.shards))
+	for i := 0; i < n; i++ {
+		go func() {
+			for sh := range work {
+				sh.update(dt)
+				wg.Done()
+			}
+		}()
+	}
+	return work, func() { close(work) }
+}
+
+func (evMgr *SessionGroup) recordTick(duration, lag, interval time.Duration) {
+	evMgr.statsMutex.Lock()
+	st := &evMgr.stats
+	st.Ticks++
+	st.LastDuration = duration
+	if duration > st.MaxDuration {
+		st.MaxDuration = duration
+	}
+	st.LastLag = lag
+	if lag > st.MaxLag {
+		st.MaxLag = lag
+	}
+	overrun := duration > interval
+	if overrun {
+		st.Overruns++
+	}
+	evMgr.statsMutex.Unlock()
+
+	if overrun {
+		slog.Warnf("SessionGroup.Update() tick overrun: %v > %v, lag %v", duration, interval, lag)
+	}
+}
+
+// GetUpdateStats returns the tick metrics of Update.
+func (evMgr *SessionGroup) GetUpdateStats() UpdateStats {
+	evMgr.statsMutex.Lock()
+	defer evMgr.statsMutex.Unlock()
+
+	return evMgr.stats
+}
@@ -0,0 +1,138 @@
+package Common_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+)
+
+// updatePlayer counts its updates and how many players are updated at once.
+type updatePlayer struct {
+	*testPlayer
+	updates  int32
+	active   *int32
+	parallel *int32 // highest active seen
+	onUpdate func()
+}
+
+func (p *updatePlayer) OnUpdate(dt time.Duration) {
+	n := atomic.AddInt32(p.active, 1)
+	for {
+		max := atomic.LoadInt32(p.parallel)
+		if n <= max || atomic.CompareAndSwapInt32(p.parallel, max, n) {
+			break
+		}
+	}
+
+	atomic.AddInt32(&p.updates, 1)
+	if p.onUpdate != nil {
+		p.onUpdate()
+	}
+	time.Sleep(100 * time.Microsecond)
+	p.testPlayer.OnUpdate(dt)
+
+	atomic.AddInt32(p.active, -1)
+}
+
+// runUpdate runs g.Update until the test ends.
+func runUpdate(t *testing.T, g *Common.SessionGroup, global func(dt time.Duration)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.Update(ctx, 1, global)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func updatePlayers(t *testing.T, svcKey string, n int) []*updatePlayer {
+	var active, parallel int32
+	players := make([]*updatePlayer, n)
+	for i := range players {
+		players[i] = &updatePlayer{testPlayer: newPlayer(t, svcKey, nil), active: &active, parallel: &parallel}
+	}
+	return players
+}
+
+func TestUpdateIsSequentialByDefault(t *testing.T) {
+	g := newGroup()
+	players := updatePlayers(t, "shard-default", 8)
+	for _, p := range players {
+		g.AddSessionPlayer(p)
+	}
+
+	runUpdate(t, g, func(time.Duration) {})
+
+	waitUntil(t, 2*time.Second, func() bool {
+		for _, p := range players {
+			if atomic.LoadInt32(&p.updates) < 5 {
+				return false
+			}
+		}
+		return true
+	})
+	if n := atomic.LoadInt32(players[0].parallel); n != 1 {
+		t.Fatalf("%d players updated at once", n)
+	}
+	waitUntil(t, time.Second, func() bool { return g.GetUpdateStats().Ticks >= 5 })
+}
+
+func TestParallelUpdateReachesEveryPlayer(t *testing.T) {
+	g := &Common.SessionGroup{SessionPlayers: map[uint64]Common.ISessionPlayer{}, UpdateShards: 4, UpdateWorkers: 2}
+	players := updatePlayers(t, "shard-parallel", 16)
+	for _, p := range players {
+		g.AddSessionPlayer(p)
+	}
+	runUpdate(t, g, func(time.Duration) {})
+
+	waitUntil(t, 2*time.Second, func() bool {
+		for _, p := range players {
+			if atomic.LoadInt32(&p.updates) < 3 {
+				return false
+			}
+		}
+		return true
+	})
+	if n := atomic.LoadInt32(players[0].parallel); n > 2 {
+		t.Fatalf("%d players updated at once by 2 workers", n)
+	}
+}
+
+func TestShardAddRemoveWhileUpdating(t *testing.T) {
+	g := &Common.SessionGroup{SessionPlayers: map[uint64]Common.ISessionPlayer{}, UpdateShards: 4}
+	runUpdate(t, g, func(time.Duration) {})
+
+	// players removing themselves from OnUpdate
+	for _, p := range updatePlayers(t, "shard-race", 8) {
+		p := p
+		p.onUpdate = func() { g.RemoveSessionPlayer(p) }
+		g.AddSessionPlayer(p)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		players := updatePlayers(t, "shard-race", 50)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, p := range players {
+				g.AddSessionPlayer(p)
+				time.Sleep(50 * time.Microsecond)
+			}
+			for _, p := range players[:25] {
+				g.RemoveSessionPlayer(p)
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitUntil(t, 2*time.Second, func() bool { return g.GetSessionPlayerCount() == 4*25 })
+}
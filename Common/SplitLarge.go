@@ -0,0 +1,168 @@
+package Common
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+)
+
+// EPacketAutoSplitLarge part body:
+// 4 bytes big Packet index + 2 bytes totalCount + 2 bytes index + part of the big frame
+const splitPartHeadLength = 8
+
+var ErrPacketTooLarge = errors.New("packet too large to split")
+
+type reassembly struct {
+	parts   [][]byte
+	got     int
+	size    int
+	started time.Time
+}
+
+// splitState is the EPacketAutoSplitLarge part of SessionPlayerBase.
+type splitState struct {
+	nextID  uint32 // guarded by sendMutex of SessionPlayerBase
+	mutex   sync.Mutex
+	pending map[uint32]*reassembly
+	size    int // bytes held by all the reassemblies
+}
+
+// sendSplit sends frame as EPacketAutoSplitLarge parts of at most splitSize bytes, less when
+// the codec cannot frame them. The parts go out as they are: frame was already sealed and
+// compressed, and recorded whole for a resume.
+func (s *SessionPlayerBase) sendSplit(frame []byte, splitSize int) error {
+	if max := maxPayload(s.codec); max > 0 && splitSize > max-splitPartHeadLength {
+		splitSize = max - splitPartHeadLength
+		if splitSize <= 0 {
+			return ErrPacketTooLarge
+		}
+	}
+
+	total := (len(frame) + splitSize - 1) / splitSize
+	if total > 0xFFFF {
+		return ErrPacketTooLarge
+	}
+
+	// parts of different big packets may interleave, not the order of the parts of one
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+
+	s.split.nextID++
+	id := s.split.nextID
+
+	body := make([]byte, splitPartHeadLength+splitSize)
+	for i := 0; i < total; i++ {
+		chunk := frame[i*splitSize:]
+		if len(chunk) > splitSize {
+			chunk = chunk[:splitSize]
+		}
+
+		binary.LittleEndian.PutUint32(body[0:4], id)
+		binary.LittleEndian.PutUint16(body[4:6], uint16(total))
+		binary.LittleEndian.PutUint16(body[6:8], uint16(i))
+		n := copy(body[splitPartHeadLength:], chunk)
+
+		b, err := encodeFrame(s.codec, EPacketAutoSplitLarge, body[:splitPartHeadLength+n])
+		if err != nil {
+			return err
+		}
+		if err = s.Session.SendMsg(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// onSplitPart collects a received part, on the network goroutine. It returns the big frame
+// once all its parts are there, and false when the session must be closed.
+func (s *SessionPlayerBase) onSplitPart(body []byte) (frame []byte, ok bool) {
+	if len(body) < splitPartHeadLength {
+		slog.Warn("abnormal split part:", s.Session.GetServiceKey(), s.GetID(), len(body))
+		return nil, false
+	}
+
+	id := binary.LittleEndian.Uint32(body[0:4])
+	total := int(binary.LittleEndian.Uint16(body[4:6]))
+	index := int(binary.LittleEndian.Uint16(body[6:8]))
+	data := body[splitPartHeadLength:]
+
+	st := &s.split
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	now := time.Now()
+	s.expireSplitLocked(now)
+
+	r, found := st.pending[id]
+	if !found {
+		if len(st.pending) >= s.cfg.maxReassemblies() {
+			slog.Warn("too many split packets:", s.Session.GetServiceKey(), s.GetID(), len(st.pending))
+			return nil, false
+		}
+
+		if total == 0 {
+			slog.Warn("abnormal split part:", s.Session.GetServiceKey(), s.GetID(), "no part")
+			return nil, false
+		}
+
+		r = &reassembly{parts: make([][]byte, total), started: now}
+		if st.pending == nil {
+			st.pending = make(map[uint32]*reassembly)
+		}
+		st.pending[id] = r
+	}
+
+	if total != len(r.parts) || index >= total || r.parts[index] != nil {
+		slog.Warn("abnormal split part:", s.Session.GetServiceKey(), s.GetID(), id, total, index)
+		return nil, false
+	}
+
+	if st.size+len(data) > s.cfg.maxReassemblySize() {
+		slog.Warn("split packets too large:", s.Session.GetServiceKey(), s.GetID(), st.size+len(data))
+		return nil, false
+	}
+
+	r.parts[index] = append([]byte{}, data...)
+	r.got++
+	r.size += len(data)
+	st.size += len(data)
+
+	if r.got < total {
+		return nil, true
+	}
+
+	delete(st.pending, id)
+	st.size -= r.size
+
+	frame = make([]byte, 0, r.size)
+	for _, part := range r.parts {
+		frame = append(frame, part...)
+	}
+	return frame, true
+}
+
+// expireSplit drops the reassemblies waiting for their parts longer than the timeout,
+// from OnUpdate as no part may come anymore.
+func (s *SessionPlayerBase) expireSplit(now time.Time) {
+	s.split.mutex.Lock()
+	defer s.split.mutex.Unlock()
+
+	s.expireSplitLocked(now)
+}
+
+func (s *SessionPlayerBase) expireSplitLocked(now time.Time) {
+	st := &s.split
+	timeout := s.cfg.reassemblyTimeout()
+
+	for id, r := range st.pending {
+		if now.Sub(r.started) > timeout {
+			slog.Warn("split packet timeout:", s.Session.GetServiceKey(), s.GetID(), id, r.got, len(r.parts))
+			delete(st.pending, id)
+			st.size -= r.size
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package Common_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+	"github.com/zhksoftGo/Packet"
+)
+
+// framePacket returns the frame of payload as given to SendPacket.
+func framePacket(codec Common.ICodec, actionType uint16, payload []byte) Packet.Packet {
+	var pak Packet.Packet
+	pak.Write(codec.Encode(actionType, payload))
+	return pak
+}
+
+func payloadOf(pak *Packet.Packet) []byte {
+	return pak.GetUsedBuffer()[pak.GetReadPos():]
+}
+
+func splitPart(id uint32, total, index uint16, data []byte) []byte {
+	body := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint32(body[0:4], id)
+	binary.LittleEndian.PutUint16(body[4:6], total)
+	binary.LittleEndian.PutUint16(body[6:8], index)
+	return networktest.EncodeFrame(Common.EPacketAutoSplitLarge, append(body, data...))
+}
+
+func TestNoSplitByDefault(t *testing.T) {
+	p := newPlayer(t, "split-default", nil)
+
+	payload := make([]byte, 256<<10)
+	if err := p.SendPacket(framePacket(Common.DefaultCodec, Common.EPacketGameLogic, payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := p.sentFrames(t)
+	if len(frames) != 1 || frames[0].Type != Common.EPacketGameLogic || len(frames[0].Body) != len(payload) {
+		t.Fatalf("sent %d frames", len(frames))
+	}
+}
+
+func TestSplitRoundTrip(t *testing.T) {
+	a := newPlayer(t, "split-round", &Common.SessionConfig{SplitSize: 1000})
+	b := newPlayer(t, "split-round", nil)
+
+	payload := make([]byte, 5000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	if err := a.SendPacket(framePacket(Common.DefaultCodec, Common.EPacketGameLogic, payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := a.sentFrames(t)
+	if len(frames) != 6 {
+		t.Fatalf("sent %d parts", len(frames))
+	}
+	for _, f := range frames {
+		if f.Type != Common.EPacketAutoSplitLarge || len(f.Body) > 8+1000 {
+			t.Fatalf("part type %#x, %d bytes", f.Type, len(f.Body))
+		}
+	}
+
+	pump(a, b)
+	b.OnUpdate(0)
+
+	msgs := b.messages()
+	if len(msgs) != 1 || !bytes.Equal(payloadOf(msgs[0]), payload) {
+		t.Fatalf("%d messages", len(msgs))
+	}
+	if n := Common.PendingSplits(&b.SessionPlayerBase); n != 0 {
+		t.Fatalf("%d reassemblies left", n)
+	}
+}
+
+func TestSplitClampsToCodec(t *testing.T) {
+	codec := &Common.HeaderCodec{LengthSize: 2, TypeSize: 1, ByteOrder: binary.LittleEndian}
+	a := newPlayer(t, "split-clamp", &Common.SessionConfig{Codec: codec, SplitSize: 65531})
+	b := newPlayer(t, "split-clamp", nil)
+
+	// 65533 bytes with the header, parts of 65531 bytes would overflow the length field
+	payload := bytes.Repeat([]byte{7}, 65530)
+	if err := a.SendPacket(framePacket(codec, Common.EPacketGameLogic, payload)); err != nil {
+		t.Fatal(err)
+	}
+	if sent := a.fake.Sent(); len(sent) != 2 {
+		t.Fatalf("sent %d parts", len(sent))
+	}
+
+	pump(a, b)
+	b.OnUpdate(0)
+
+	if msgs := b.messages(); len(msgs) != 1 || !bytes.Equal(payloadOf(msgs[0]), payload) {
+		t.Fatalf("%d messages", len(msgs))
+	}
+}
+
+func TestNoSplitWithTypelessCodecs(t *testing.T) {
+	codecs := map[string]Common.ICodec{
+		"lines":  Common.NewLineCodec(),
+		"header": &Common.HeaderCodec{LengthSize: 4, ByteOrder: binary.LittleEndian},
+		"varint": &Common.VarintCodec{},
+	}
+
+	for name, codec := range codecs {
+		p := newPlayer(t, "split-typeless-"+name, &Common.SessionConfig{Codec: codec, SplitSize: 10})
+
+		frame := codec.Encode(Common.EPacketGameLogic, bytes.Repeat([]byte("x"), 100))
+		var pak Packet.Packet
+		pak.Write(frame)
+		if err := p.SendPacket(pak); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if sent := p.fake.Sent(); len(sent) != 1 || !bytes.Equal(sent[0], frame) {
+			t.Fatalf("%s: sent %d buffers", name, len(sent))
+		}
+	}
+}
+
+func TestSplitExpiresOnUpdate(t *testing.T) {
+	p := newPlayer(t, "split-expire", &Common.SessionConfig{ReassemblyTimeout: 10 * time.Millisecond})
+
+	if !p.recv(splitPart(1, 2, 0, []byte("first"))) {
+		t.Fatal("session closed")
+	}
+	if n := Common.PendingSplits(&p.SessionPlayerBase); n != 1 {
+		t.Fatalf("%d reassemblies", n)
+	}
+
+	p.OnUpdate(time.Millisecond)
+	if n := Common.PendingSplits(&p.SessionPlayerBase); n != 1 {
+		t.Fatal("expired early")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	p.OnUpdate(20 * time.Millisecond)
+	if n := Common.PendingSplits(&p.SessionPlayerBase); n != 0 {
+		t.Fatalf("%d reassemblies after the timeout", n)
+	}
+}
+
+func TestSplitRefusesAbnormalParts(t *testing.T) {
+	parts := map[string][]byte{
+		"short":      networktest.EncodeFrame(Common.EPacketAutoSplitLarge, []byte{1, 2, 3}),
+		"no part":    splitPart(1, 0, 0, nil),
+		"index":      splitPart(1, 2, 2, []byte("x")),
+		"too large":  splitPart(1, 2, 0, make([]byte, 64)),
+		"split part": splitPart(1, 1, 0, splitPart(2, 1, 0, []byte("x"))),
+	}
+
+	for name, part := range parts {
+		p := newPlayer(t, "split-abnormal", &Common.SessionConfig{MaxReassemblySize: 32})
+		if p.recv(part) {
+			t.Fatalf("%s: part accepted", name)
+		}
+	}
+}
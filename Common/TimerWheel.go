@@ -0,0 +1,235 @@
+package Common
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+)
+
+// DefaultTimerTick is the resolution of a TimerWheel made with tick 0.
+const DefaultTimerTick = 10 * time.Millisecond
+
+// wheel levels: 256 slots of 1 tick, then 4 levels of 64 slots, each slot spanning the whole
+// level below. Timers further than 2^32 ticks wait in the last level and go round again.
+const (
+	wheelRootBits  = 8
+	wheelLevelBits = 6
+	wheelLevels    = 4
+	wheelRootSize  = 1 << wheelRootBits
+	wheelLevelSize = 1 << wheelLevelBits
+	wheelMaxTicks  = 1<<(wheelRootBits+wheelLevels*wheelLevelBits) - 1
+)
+
+// TimerHandle is a timer of a TimerWheel, to cancel it.
+type TimerHandle struct {
+	wheel    *TimerWheel
+	fn       func()
+	expires  uint64 // tick
+	interval uint64 // ticks between the runs of a repeating timer, 0 for a one-shot
+	slot     *list.List
+	elem     *list.Element
+}
+
+// Stop cancels the timer, returning false if it already ran or was stopped. A repeating timer
+// may stop itself from its callback.
+func (t *TimerHandle) Stop() bool {
+	w := t.wheel
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if t.elem == nil {
+		return false
+	}
+	w.unlink(t)
+	return true
+}
+
+// Active tells whether the timer is still to run.
+func (t *TimerHandle) Active() bool {
+	t.wheel.mutex.Lock()
+	defer t.wheel.mutex.Unlock()
+
+	return t.elem != nil
+}
+
+// TimerWheel schedules callbacks in ticks of a fixed resolution, in O(1) per timer. It is
+// driven by one goroutine at a time: SessionGroup.Update so callbacks run on the logic goroutine,
+// Run, or Advance. Timers may be added and stopped from any goroutine.
+type TimerWheel struct {
+	mutex  sync.Mutex
+	tick   time.Duration
+	now    uint64        // ticks elapsed
+	rest   time.Duration // part of a tick advanced
+	count  int
+	root   [wheelRootSize]list.List
+	levels [wheelLevels][wheelLevelSize]list.List
+}
+
+// NewTimerWheel returns a wheel of resolution tick, 0 means DefaultTimerTick.
+func NewTimerWheel(tick time.Duration) *TimerWheel {
+	if tick <= 0 {
+		tick = DefaultTimerTick
+	}
+	return &TimerWheel{tick: tick}
+}
+
+// AfterFunc runs fn once after d, rounded up to the tick and at least one tick.
+func (w *TimerWheel) AfterFunc(d time.Duration, fn func()) *TimerHandle {
+	return w.add(w.ticks(d), 0, fn)
+}
+
+// Every runs fn every interval, the first time after interval. Late runs are not made up for
+// by running faster, but the schedule does not drift.
+func (w *TimerWheel) Every(interval time.Duration, fn func()) *TimerHandle {
+	n := w.ticks(interval)
+	return w.add(n, n, fn)
+}
+
+// Len returns the number of timers to run.
+func (w *TimerWheel) Len() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.count
+}
+
+func (w *TimerWheel) ticks(d time.Duration) uint64 {
+	n := (d + w.tick - 1) / w.tick
+	if n < 1 {
+		return 1
+	}
+	return uint64(n)
+}
+
+func (w *TimerWheel) add(delay, interval uint64, fn func()) *TimerHandle {
+	t := &TimerHandle{wheel: w, fn: fn, interval: interval}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	t.expires = w.now + delay
+	w.link(t)
+	return t
+}
+
+// link puts a timer in the slot of its expiry, under the lock.
+func (w *TimerWheel) link(t *TimerHandle) {
+	delay := t.expires - w.now
+	if t.expires <= w.now {
+		delay = 0
+	}
+
+	var slot *list.List
+	switch {
+	case delay < wheelRootSize:
+		slot = &w.root[t.expires&(wheelRootSize-1)]
+
+	default:
+		if delay > wheelMaxTicks {
+			delay = wheelMaxTicks
+		}
+		at := w.now + delay
+		for level := 0; level < wheelLevels; level++ {
+			if delay < 1<<(wheelRootBits+(level+1)*wheelLevelBits) || level == wheelLevels-1 {
+				slot = &w.levels[level][(at>>(wheelRootBits+level*wheelLevelBits))&(wheelLevelSize-1)]
+				break
+			}
+		}
+	}
+
+	t.slot = slot
+	t.elem = slot.PushBack(t)
+	w.count++
+}
+
+func (w *TimerWheel) unlink(t *TimerHandle) {
+	t.slot.Remove(t.elem)
+	t.slot, t.elem = nil, nil
+	w.count--
+}
+
+// cascade moves the timers of a slot of a level down, returning the index of the slot.
+func (w *TimerWheel) cascade(level int) uint64 {
+	index := (w.now >> (wheelRootBits + level*wheelLevelBits)) & (wheelLevelSize - 1)
+	slot := &w.levels[level][index]
+	for e := slot.Front(); e != nil; {
+		next := e.Next()
+		t := e.Value.(*TimerHandle)
+		w.unlink(t)
+		w.link(t)
+		e = next
+	}
+	return index
+}
+
+// Advance moves the wheel by dt, running the callbacks due on the calling goroutine, in the
+// order of their expiry.
+func (w *TimerWheel) Advance(dt time.Duration) {
+	w.mutex.Lock()
+	w.rest += dt
+	n := w.rest / w.tick
+	w.rest -= n * w.tick
+	w.mutex.Unlock()
+
+	for ; n > 0; n-- {
+		w.mutex.Lock()
+		if w.count == 0 {
+			// nothing to cascade nor run
+			w.now += uint64(n)
+			w.mutex.Unlock()
+			return
+		}
+
+		w.now++
+		index := w.now & (wheelRootSize - 1)
+		for level := 0; index == 0 && level < wheelLevels; level++ {
+			index = w.cascade(level)
+		}
+
+		// one at a time, so a callback may stop the others due; the ones it adds are due later
+		slot := &w.root[w.now&(wheelRootSize-1)]
+		for e := slot.Front(); e != nil; e = slot.Front() {
+			t := e.Value.(*TimerHandle)
+			w.unlink(t)
+			if t.interval > 0 {
+				t.expires += t.interval
+				w.link(t)
+			}
+			w.mutex.Unlock()
+
+			runTimer(t)
+			w.mutex.Lock()
+		}
+		w.mutex.Unlock()
+	}
+}
+
+func runTimer(t *TimerHandle) {
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("timer panic:", err)
+		}
+	}()
+
+	t.fn()
+}
+
+// Run advances the wheel every tick on the calling goroutine, until ctx is done.
+func (w *TimerWheel) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			w.Advance(t.Sub(last))
+			last = t
+		}
+	}
+}
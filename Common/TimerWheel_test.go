@@ -0,0 +1,177 @@
+package Common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+)
+
+const tick = time.Millisecond
+
+func TestTimerWheelBoundaries(t *testing.T) {
+	delays := []int{1, 2, 255, 256, 257, 511, 512, 1<<14 - 1, 1 << 14, 1<<14 + 1, 1<<20 + 3}
+
+	for _, offset := range []int{0, 100} {
+		w := Common.NewTimerWheel(tick)
+		w.Advance(time.Duration(offset) * tick)
+
+		step := 0
+		ran := make(map[int]int)
+		for _, d := range delays {
+			d := d
+			w.AfterFunc(time.Duration(d)*tick, func() { ran[d] = step })
+		}
+
+		for step = 1; w.Len() > 0; step++ {
+			w.Advance(tick)
+		}
+
+		for _, d := range delays {
+			if ran[d] != d {
+				t.Errorf("offset %d: timer of %d ticks ran after %d", offset, d, ran[d])
+			}
+		}
+	}
+}
+
+func TestTimerWheelClampsFarTimers(t *testing.T) {
+	w := Common.NewTimerWheel(tick)
+	ran := false
+	h := w.AfterFunc((1<<33+5)*tick, func() { ran = true })
+
+	w.Advance((1 << 20) * tick)
+	if ran || !h.Active() || w.Len() != 1 {
+		t.Fatalf("ran %v, active %v, len %d", ran, h.Active(), w.Len())
+	}
+	if !h.Stop() || w.Len() != 0 {
+		t.Fatal("far timer not stopped")
+	}
+}
+
+func TestTimerWheelRoundsUp(t *testing.T) {
+	w := Common.NewTimerWheel(10 * tick)
+	ran := 0
+	w.AfterFunc(0, func() { ran++ })
+	w.AfterFunc(11*tick, func() { ran++ })
+
+	w.Advance(10 * tick)
+	if ran != 1 {
+		t.Fatalf("%d ran after one tick", ran)
+	}
+	w.Advance(5 * tick)
+	w.Advance(5 * tick)
+	if ran != 2 {
+		t.Fatalf("%d ran after two ticks", ran)
+	}
+}
+
+func TestTimerWheelEvery(t *testing.T) {
+	w := Common.NewTimerWheel(tick)
+	var runs []int
+	step := 0
+	h := w.Every(3*tick, func() { runs = append(runs, step) })
+
+	for step = 1; step <= 10; step++ {
+		w.Advance(tick)
+	}
+	if len(runs) != 3 || runs[0] != 3 || runs[1] != 6 || runs[2] != 9 {
+		t.Fatalf("ran at %v", runs)
+	}
+
+	// late, not made up for but not drifting
+	w.Advance(5 * tick)
+	if len(runs) != 5 {
+		t.Fatalf("ran %d times", len(runs))
+	}
+	if !h.Active() || w.Len() != 1 {
+		t.Fatal("repeating timer not rescheduled")
+	}
+}
+
+func TestTimerWheelStop(t *testing.T) {
+	w := Common.NewTimerWheel(tick)
+	ran := false
+	h := w.AfterFunc(300*tick, func() { ran = true })
+
+	if !h.Stop() {
+		t.Fatal("Stop of a pending timer returned false")
+	}
+	if h.Stop() || h.Active() || w.Len() != 0 {
+		t.Fatal("timer still pending once stopped")
+	}
+
+	w.Advance(400 * tick)
+	if ran {
+		t.Fatal("stopped timer ran")
+	}
+
+	h = w.AfterFunc(tick, func() {})
+	w.Advance(tick)
+	if h.Stop() {
+		t.Fatal("Stop of a timer run returned true")
+	}
+}
+
+func TestTimerWheelStopFromCallback(t *testing.T) {
+	w := Common.NewTimerWheel(tick)
+
+	runs := 0
+	var self *Common.TimerHandle
+	self = w.Every(tick, func() {
+		runs++
+		if runs == 2 && !self.Stop() {
+			t.Error("repeating timer not stopped from its callback")
+		}
+	})
+
+	// the first due stops the second, due in the same tick
+	otherRan := false
+	var other *Common.TimerHandle
+	w.AfterFunc(5*tick, func() {
+		if !other.Stop() {
+			t.Error("timer due in the same tick not stopped")
+		}
+	})
+	other = w.AfterFunc(5*tick, func() { otherRan = true })
+
+	w.Advance(10 * tick)
+	if runs != 2 || self.Active() {
+		t.Fatalf("repeating timer ran %d times", runs)
+	}
+	if otherRan {
+		t.Fatal("timer stopped by a callback ran")
+	}
+	if w.Len() != 0 {
+		t.Fatalf("%d timers left", w.Len())
+	}
+}
+
+func TestTimerWheelAddFromCallback(t *testing.T) {
+	w := Common.NewTimerWheel(tick)
+
+	step := 0
+	ran := 0
+	w.AfterFunc(tick, func() {
+		w.AfterFunc(0, func() { ran = step })
+	})
+
+	for step = 1; step <= 3; step++ {
+		w.Advance(tick)
+	}
+	if ran != 2 {
+		t.Fatalf("timer added by a callback ran at %d", ran)
+	}
+}
+
+func TestTimerWheelRecoversPanic(t *testing.T) {
+	w := Common.NewTimerWheel(tick)
+	ran := false
+	w.AfterFunc(tick, func() { panic("timer") })
+	w.AfterFunc(tick, func() { ran = true })
+
+	w.Advance(tick)
+	if !ran {
+		t.Fatal("timer after a panicking one not run")
+	}
+}
@@ -0,0 +1,9 @@
+package Common
+
+// PendingSplits returns the number of big packets p is reassembling.
+func PendingSplits(p *SessionPlayerBase) int {
+	p.split.mutex.Lock()
+	defer p.split.mutex.Unlock()
+
+	return len(p.split.pending)
+}
@@ -0,0 +1,143 @@
+package Common_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Common"
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+	"github.com/zhksoftGo/Packet"
+)
+
+// testPlayer records the messages handed to HandleInComingMsg.
+type testPlayer struct {
+	Common.SessionPlayerBase
+	fake *networktest.FakeSession
+
+	mutex sync.Mutex
+	msgs  []*Packet.Packet
+	read  int // buffers of fake forwarded to the peer
+}
+
+func (p *testPlayer) HandleInComingMsg(pak *Packet.Packet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.msgs = append(p.msgs, pak)
+}
+
+func (p *testPlayer) messages() []*Packet.Packet {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]*Packet.Packet{}, p.msgs...)
+}
+
+// recv feeds b as if read from the connection, returning false when the session asked to close.
+func (p *testPlayer) recv(b []byte) bool {
+	return p.OnRecvMsg(b) == Network.None
+}
+
+// sentFrames returns the frames sent so far, with the 6-byte header of DefaultCodec.
+func (p *testPlayer) sentFrames(t *testing.T) []networktest.Frame {
+	t.Helper()
+
+	frames, err := p.fake.SentFrames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+// newPlayer initializes a player for svcKey with cfg, on a FakeSession. The svcKey must be
+// unique among the tests, the configs being global.
+func newPlayer(t *testing.T, svcKey string, cfg *Common.SessionConfig) *testPlayer {
+	t.Helper()
+
+	if cfg != nil {
+		Common.SetSessionConfig(svcKey, cfg)
+	}
+
+	p := &testPlayer{fake: networktest.NewFakeSession(svcKey)}
+	p.Initialize(p.fake, p)
+	p.OnOpened()
+	return p
+}
+
+// forward delivers what p sent since the previous call to the peer, returning whether it moved
+// anything. A peer asking to close gets OnClosed.
+func (p *testPlayer) forward(peer *testPlayer) bool {
+	sent := p.fake.Sent()
+	if len(sent) == p.read {
+		return false
+	}
+
+	for _, b := range sent[p.read:] {
+		if shutdown, _ := peer.fake.IsShutdown(); shutdown {
+			break
+		}
+		if !peer.recv(b) {
+			peer.fake.Shutdown(true)
+			peer.OnClosed(nil)
+		}
+	}
+	p.read = len(sent)
+	return true
+}
+
+// pump moves the bytes between a and b until both are quiet.
+func pump(a, b *testPlayer) {
+	for a.forward(b) || b.forward(a) {
+	}
+}
+
+// link runs the network and the logic of a and b every millisecond until the test ends.
+// The players must not be used from the test goroutine meanwhile, except for the thread safe
+// calls like Call and SendPacket.
+func link(t *testing.T, a, b *testPlayer) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				pump(a, b)
+				a.OnUpdate(time.Millisecond)
+				b.OnUpdate(time.Millisecond)
+			}
+		}
+	}()
+
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+}
+
+// waitUntil polls cond until it holds or the timeout expires.
+func waitUntil(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func packet(write func(pak *Packet.Packet)) *Packet.Packet {
+	pak := new(Packet.Packet)
+	write(pak)
+	return pak
+}
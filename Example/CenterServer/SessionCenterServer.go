@@ -16,6 +16,7 @@ type SessionCenterServer struct {
 
 func (ev *SessionCenterServer) OnOpened() (opts Network.Options, action Network.Action) {
 	slog.Debug("OnOpened:", ev.GetID())
+	ev.SessionPlayerBase.OnOpened()
 
 	opts = Network.Options{TCPKeepAlive: time.Minute, ReuseInputBuffer: true}
 	action = Network.None
@@ -25,6 +26,7 @@ func (ev *SessionCenterServer) OnOpened() (opts Network.Options, action Network.
 func (ev *SessionCenterServer) OnClosed(err error) (action Network.Action) {
 	slog.Debug("OnClosed:", ev.GetID())
 
+	ev.SessionPlayerBase.OnClosed(err)
 	SessionMgr.RemoveSessionPlayer(ev)
 
 	action = Network.None
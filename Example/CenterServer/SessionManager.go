@@ -7,11 +7,13 @@ import (
 	"github.com/gookit/slog"
 	"github.com/zhksoftGo/Cactus/Common"
 	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Packet"
 )
 
 type EVHandlerManager struct {
 	Network.EventHandlerManager
 	Common.SessionGroup
+	Registry *Common.ServiceRegistry
 }
 
 var SessionMgr *EVHandlerManager
@@ -19,9 +21,24 @@ var SessionMgr *EVHandlerManager
 func CreateSessionManager() *EVHandlerManager {
 	m := &EVHandlerManager{}
 	m.SessionPlayers = make(map[uint64]Common.ISessionPlayer)
+	m.Registry = Common.NewServiceRegistry(15 * time.Second)
+
+	rpc := Common.NewRpcServer()
+	rpc.Register("Center.IsPlayerOnline", m.rpcIsPlayerOnline)
+	m.Registry.Register(rpc)
+	Common.SetSessionConfig("CenterGameServer", &Common.SessionConfig{Rpc: rpc, RpcTimeout: 10 * time.Second, HeartbeatInterval: 5 * time.Second})
+
 	return m
 }
 
+func (evMgr *EVHandlerManager) rpcIsPlayerOnline(call *Common.RpcCall, req *Packet.Packet) (*Packet.Packet, error) {
+	name := req.ReadString()
+
+	resp := new(Packet.Packet)
+	resp.WriteBool(evMgr.GetSessionPlayerByName(name) != nil)
+	return resp, nil
+}
+
 func (evMgr *EVHandlerManager) CreateEventHandler(session Network.INetworkSession) Network.IEventHandler {
 
 	switch session.GetServiceKey() {
@@ -47,8 +64,13 @@ func (evMgr *EVHandlerManager) CreateEventHandler(session Network.INetworkSessio
 	return nil
 }
 
-func (evMgr *EVHandlerManager) OnConnectFailed(svcKey string) {
-	slog.Info("OnConnectFailed:", svcKey)
+func (evMgr *EVHandlerManager) OnConnectFailed(svcKey string, failure *Network.ConnectFailure) {
+	slog.Info("OnConnectFailed:", failure)
+}
+
+func (evMgr *EVHandlerManager) OnHandlerPanic(session Network.INetworkSession, value interface{}, stack []byte) {
+	slog.Error("OnHandlerPanic:", session.GetServiceKey(), session.GetSessionID(), value)
+	slog.Error(string(stack))
 }
 
 func (evMgr *EVHandlerManager) OnShutdown() {
@@ -60,5 +82,11 @@ var once sync.Once
 func (ev *EVHandlerManager) OnUpdate(dt time.Duration) {
 	once.Do(func() {
 		slog.Info("OnUpdate")
+
+		ev.Registry.Subscribe("", func(e Common.RegistryEvent) {
+			slog.Info("Registry event:", e.Kind, e.Entry.Type, e.Entry.ID, e.Entry.Address, e.Entry.Load)
+		})
 	})
+
+	ev.Registry.Expire(time.Now())
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io"
 	"time"
 
@@ -12,10 +13,21 @@ import (
 
 type SessionCenterClient struct {
 	Common.SessionPlayerBase
+	Registry *Common.RegistryClient
 }
 
 func (ev *SessionCenterClient) OnOpened() (opts Network.Options, action Network.Action) {
 	slog.Debug("OnOpened:", ev.GetID())
+	ev.SessionPlayerBase.OnOpened()
+
+	ev.Registry = Common.NewRegistryClient(&ev.SessionPlayerBase)
+	ev.Registry.Register(Common.ServiceEntry{ID: 1, Type: "GameServer", Address: ":9091", Capacity: 5000})
+	ev.Registry.StartHeartbeat(5*time.Second, func() int {
+		return SessionMgr.GetSessionPlayerCount() - 1
+	})
+	ev.Registry.Subscribe("GameServer", func(e Common.RegistryEvent) {
+		slog.Info("Registry event:", e.Kind, e.Entry.ID, e.Entry.Address)
+	})
 
 	opts = Network.Options{TCPKeepAlive: time.Minute, ReuseInputBuffer: true}
 	action = Network.None
@@ -26,6 +38,7 @@ func (ev *SessionCenterClient) OnClosed(err error) (action Network.Action) {
 	slog.Debug("OnClosed:", ev.GetID())
 
 	action = Network.None
+	ev.SessionPlayerBase.OnClosed(err)
 	SessionMgr.RemoveSessionPlayer(ev)
 
 	SessionMgr.OnCenterClientShutdown(ev.Session.GetServiceKey())
@@ -52,6 +65,19 @@ func (ev *SessionCenterClient) HandleInComingMsg(pak *Packet.Packet) {
 
 }
 
+// IsPlayerOnline asks the CenterServer whether a player is online.
+func (ev *SessionCenterClient) IsPlayerOnline(ctx context.Context, name string) (bool, error) {
+	var req Packet.Packet
+	req.WriteString(name)
+
+	resp, err := ev.Call(ctx, "Center.IsPlayerOnline", &req)
+	if err != nil {
+		return false, err
+	}
+
+	return resp.ReadBool(), nil
+}
+
 func (ev *SessionCenterClient) OnUpdate(dt time.Duration) {
 	ev.SessionPlayerBase.OnUpdate(dt)
 }
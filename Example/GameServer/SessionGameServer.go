@@ -14,8 +14,29 @@ type SessionGameServer struct {
 	Common.SessionPlayerBase
 }
 
+// client message IDs
+const (
+	MsgChat uint16 = 1 // string text, relayed to the other players
+)
+
+func newGameRouter() *Common.MessageRouter {
+	router := Common.NewMessageRouter()
+	router.Use(Common.RequireAuth())
+	router.Handle(MsgChat, onChat, Common.RateLimit(2, 5))
+	return router
+}
+
+func onChat(msg *Common.Msg, pak *Packet.Packet) {
+	var out Packet.Packet
+	out.WriteUint16(MsgChat)
+	out.WriteUint64(msg.Player.GetID())
+	out.WriteString(pak.ReadString())
+	SessionMgr.Broadcast(out.GetUsedBuffer(), nil, msg.Player.GetID())
+}
+
 func (ev *SessionGameServer) OnOpened() (opts Network.Options, action Network.Action) {
 	slog.Debug("OnOpened:", ev.GetID())
+	ev.SessionPlayerBase.OnOpened()
 
 	opts = Network.Options{TCPKeepAlive: time.Minute, ReuseInputBuffer: true}
 	action = Network.None
@@ -31,7 +52,8 @@ func (ev *SessionGameServer) OnRecvMsg(b []byte) Network.Action {
 func (ev *SessionGameServer) OnClosed(err error) (action Network.Action) {
 	slog.Debug("OnClosed:", ev.GetID())
 
-	SessionMgr.RemoveSessionPlayer(ev)
+	// the player leaves SessionMgr through the close hook of its login, once not resumed in time
+	ev.SessionPlayerBase.OnClosed(err)
 
 	action = Network.None
 	return
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"sync"
 	"time"
 
@@ -12,16 +13,40 @@ import (
 type EVHandlerManager struct {
 	Network.EventHandlerManager
 	Common.SessionGroup
-	centerClient         *SessionCenterClient
-	reconnectCenterTimer Common.SimpleTimer
-	centerClientSvcKey   string
+	centerClient   *SessionCenterClient
+	reconnectMutex sync.Mutex // guards reconnectTimer, scheduled from the network goroutines
+	reconnectTimer *Common.TimerHandle
 }
 
 var SessionMgr *EVHandlerManager
 
-func CreateSessionManager() *EVHandlerManager {
+// tokenSecretEnv names the environment variable holding the secret of the login tokens,
+// shared with the login server issuing them.
+const tokenSecretEnv = "GAMESERVER_TOKEN_SECRET"
+
+// loadTokenSecret returns the secret of the login tokens, empty when not configured.
+func loadTokenSecret() []byte {
+	return []byte(os.Getenv(tokenSecretEnv))
+}
+
+func CreateSessionManager(tokenSecret []byte) *EVHandlerManager {
 	m := &EVHandlerManager{}
 	m.SessionPlayers = make(map[uint64]Common.ISessionPlayer)
+	m.Timers = Common.NewTimerWheel(0)
+
+	// the login tokens of the players, issued by the login server sharing the secret
+	gameTokenAuth := &Common.HMACTokenAuthenticator{Secret: tokenSecret}
+
+	// registry events from the CenterServer come as RPC notifications
+	Common.SetSessionConfig("CenterGameClient", &Common.SessionConfig{Rpc: Common.NewRpcServer(), RpcTimeout: 10 * time.Second, HeartbeatInterval: 5 * time.Second})
+
+	// client messages are routed by ID, see SessionGameServer.go. Players join the group once
+	// logged in, and stay in it for a while when their connection drops, to be resumed.
+	Common.SetSessionConfig("GameServer", &Common.SessionConfig{
+		Router: newGameRouter(),
+		Auth:   &Common.AuthConfig{Authenticator: gameTokenAuth, Group: &m.SessionGroup},
+		Resume: &Common.ResumeConfig{GracePeriod: time.Minute},
+	})
 	return m
 }
 
@@ -32,9 +57,6 @@ func (evMgr *EVHandlerManager) CreateEventHandler(session Network.INetworkSessio
 		slog.Info("CreateEventHandler: GameServer")
 		ev := new(SessionGameServer)
 		ev.Initialize(session, ev)
-		if !evMgr.AddSessionPlayer(ev) {
-			return nil
-		}
 		return ev
 
 	case "CenterGameClient":
@@ -50,16 +72,19 @@ func (evMgr *EVHandlerManager) CreateEventHandler(session Network.INetworkSessio
 	return nil
 }
 
-func (evMgr *EVHandlerManager) OnConnectFailed(svcKey string) {
-	slog.Info("OnConnectFailed:", svcKey)
+func (evMgr *EVHandlerManager) OnConnectFailed(svcKey string, failure *Network.ConnectFailure) {
+	slog.Info("OnConnectFailed:", failure)
 
 	if SessionMgr.Running {
-		slog.Info("Reconnecting:", svcKey)
-		evMgr.centerClientSvcKey = svcKey
-		evMgr.reconnectCenterTimer.SetTimer(3*1000, false, false)
+		evMgr.scheduleReconnect(svcKey)
 	}
 }
 
+func (evMgr *EVHandlerManager) OnHandlerPanic(session Network.INetworkSession, value interface{}, stack []byte) {
+	slog.Error("OnHandlerPanic:", session.GetServiceKey(), session.GetSessionID(), value)
+	slog.Error(string(stack))
+}
+
 func (evMgr *EVHandlerManager) OnShutdown() {
 	slog.Info("OnShutdown")
 }
@@ -70,15 +95,25 @@ func (evMgr *EVHandlerManager) OnUpdate(dt time.Duration) {
 	once.Do(func() {
 		slog.Info("OnUpdate")
 	})
+}
 
-	if evMgr.reconnectCenterTimer.OnTimer(dt.Milliseconds()) {
-		slog.Info("Reconnecting:", evMgr.centerClientSvcKey)
+// scheduleReconnect reconnects the CenterServer in 3s, from the Update goroutine.
+func (evMgr *EVHandlerManager) scheduleReconnect(svcKey string) {
+	evMgr.reconnectMutex.Lock()
+	defer evMgr.reconnectMutex.Unlock()
+
+	if evMgr.reconnectTimer != nil {
+		evMgr.reconnectTimer.Stop()
+	}
 
-		err := NetworkModule.ConnectSvc(evMgr.centerClientSvcKey, 5*time.Second)
+	evMgr.reconnectTimer = evMgr.Timers.AfterFunc(3*time.Second, func() {
+		slog.Info("Reconnecting:", svcKey)
+
+		err := NetworkModule.ConnectSvc(svcKey, 5*time.Second)
 		if err != nil {
 			slog.Error(err)
 		}
-	}
+	})
 }
 
 func (evMgr *EVHandlerManager) GetCenterClient() *SessionCenterClient {
@@ -91,7 +126,6 @@ func (evMgr *EVHandlerManager) OnCenterClientShutdown(svcKey string) {
 	evMgr.centerClient = nil
 
 	if SessionMgr.Running {
-		evMgr.centerClientSvcKey = svcKey
-		evMgr.reconnectCenterTimer.SetTimer(3*1000, false, false)
+		evMgr.scheduleReconnect(svcKey)
 	}
 }
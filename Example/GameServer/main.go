@@ -16,6 +16,12 @@ var NetworkModule Network.INetworkModule
 
 func main() {
 
+	tokenSecret := loadTokenSecret()
+	if len(tokenSecret) == 0 {
+		slog.Error("login token secret not configured, set", tokenSecretEnv)
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	slog.Configure(func(logger *slog.SugaredLogger) {
@@ -28,7 +34,7 @@ func main() {
 
 	NetworkModule = Network.NewNetworkModule()
 
-	SessionMgr = CreateSessionManager()
+	SessionMgr = CreateSessionManager(tokenSecret)
 	go SessionMgr.Update(ctx, 33, SessionMgr.OnUpdate)
 
 	go func() {
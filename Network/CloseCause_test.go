@@ -0,0 +1,96 @@
+package Network_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+var errBadInput = errors.New("bad input")
+
+// closingHandler returns Close from OnRecvMsg on "bad", with errBadInput as cause.
+type closingHandler struct {
+	*networktest.RecordingHandler
+}
+
+func (h closingHandler) CloseCause() error {
+	return errBadInput
+}
+
+type closingManager struct {
+	*networktest.RecordingManager
+}
+
+func (m closingManager) CreateEventHandler(session Network.INetworkSession) Network.IEventHandler {
+	h := m.RecordingManager.CreateEventHandler(session).(*networktest.RecordingHandler)
+	h.RecvHook = func(b []byte) Network.Action {
+		if string(b) == "bad" {
+			return Network.Close
+		}
+		return Network.None
+	}
+	return closingHandler{h}
+}
+
+func TestServerPassesCloseCause(t *testing.T) {
+	addr := freeAddr(t)
+	mod := Network.NewNetworkModule()
+	if err := mod.Listen("svc", "tcp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+	mngr := closingManager{networktest.NewRecordingManager()}
+	runModule(t, mod, mngr)
+
+	cli, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	cli.SendRaw([]byte("bad"))
+	closed, err := mngr.Recorder.WaitFor(networktest.EventClosed, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed[0].Err != errBadInput {
+		t.Fatalf("closed with %v, want %v", closed[0].Err, errBadInput)
+	}
+}
+
+func TestClientHonorsClose(t *testing.T) {
+	addr := freeAddr(t)
+	_, server := listen(t, "svc", "tcp://"+addr)
+	server.NewHandler = func(h *networktest.RecordingHandler) {
+		session := h.Session
+		h.OpenedHook = func() Network.Action {
+			session.SendMsg([]byte("bad"))
+			return Network.None
+		}
+	}
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Connect("cli", "tcp://"+addr, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	client := closingManager{networktest.NewRecordingManager()}
+	runModule(t, mod, client)
+
+	closed, err := client.Recorder.WaitFor(networktest.EventClosed, 1, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed[0].Err != errBadInput {
+		t.Fatalf("client closed with %v, want %v", closed[0].Err, errBadInput)
+	}
+
+	// the connection is really closed
+	if _, err := server.Recorder.WaitFor(networktest.EventClosed, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := mod.ConnectorState("cli"); st.Active != "" || st.LastError != errBadInput {
+		t.Fatalf("connector state %+v", st)
+	}
+}
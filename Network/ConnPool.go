@@ -0,0 +1,199 @@
+package Network
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrPoolEmpty = errors.New("no connection available in the pool")
+
+// PoolPolicy decides which member of a ConnPool Pick returns.
+type PoolPolicy int
+
+const (
+	// PoolRoundRobin cycles through the connected members.
+	PoolRoundRobin PoolPolicy = iota
+
+	// PoolLeastPending picks the member with the fewest bytes being written.
+	PoolLeastPending
+)
+
+const (
+	poolSlotDown = iota
+	poolSlotConnecting
+	poolSlotConnected
+)
+
+// poolSlotStable is how long a member must stay open for its reconnect delay to reset. One
+// closing sooner, as when its handler rejects it, counts as a failure.
+const poolSlotStable = 5 * time.Second
+
+type poolSlot struct {
+	state   int
+	session INetworkSession // the session given to the event handler
+	client  *clientSession
+	delay   time.Duration // reconnect delay, doubled on every failure
+}
+
+// ConnPool holds the connections opened to a connector service whose ServerInfo.PoolSize is
+// greater than 1. Every member is a regular session with its own event handler; members which
+// close are replaced automatically while the network module is running.
+type ConnPool struct {
+	svcKey string
+	policy PoolPolicy
+	mutex  sync.Mutex
+	slots  []poolSlot
+	next   uint64
+}
+
+func newConnPool(svcKey string, size int, policy PoolPolicy) *ConnPool {
+	return &ConnPool{svcKey: svcKey, policy: policy, slots: make([]poolSlot, size)}
+}
+
+func (p *ConnPool) GetServiceKey() string { return p.svcKey }
+
+// Size returns the number of members the pool keeps, connected or not.
+func (p *ConnPool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.slots)
+}
+
+// Active returns the number of connected members.
+func (p *ConnPool) Active() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := 0
+	for i := range p.slots {
+		if p.slots[i].state == poolSlotConnected {
+			n++
+		}
+	}
+	return n
+}
+
+// Sessions returns the connected members.
+func (p *ConnPool) Sessions() []INetworkSession {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var out []INetworkSession
+	for i := range p.slots {
+		if p.slots[i].state == poolSlotConnected {
+			out = append(out, p.slots[i].session)
+		}
+	}
+	return out
+}
+
+// Pick returns a connected member following the pool policy, nil if none is connected.
+func (p *ConnPool) Pick() INetworkSession {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := len(p.slots)
+	start := int(p.next % uint64(n))
+	p.next++
+
+	best := -1
+	var bestPending int64
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		slot := &p.slots[idx]
+		if slot.state != poolSlotConnected {
+			continue
+		}
+
+		if p.policy != PoolLeastPending {
+			return slot.session
+		}
+
+		pending := atomic.LoadInt64(&slot.client.pending)
+		if best < 0 || pending < bestPending {
+			best, bestPending = idx, pending
+		}
+	}
+
+	if best < 0 {
+		return nil
+	}
+	return p.slots[best].session
+}
+
+// PickByKey returns the member a key, like a player ID, sticks to. While that member is
+// reconnecting the key falls over to the next connected one.
+func (p *ConnPool) PickByKey(key uint64) INetworkSession {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := len(p.slots)
+	for i := 0; i < n; i++ {
+		slot := &p.slots[int((key+uint64(i))%uint64(n))]
+		if slot.state == poolSlotConnected {
+			return slot.session
+		}
+	}
+	return nil
+}
+
+// SendMsg sends b through the member returned by Pick.
+func (p *ConnPool) SendMsg(b []byte) error {
+	s := p.Pick()
+	if s == nil {
+		return ErrPoolEmpty
+	}
+	return s.SendMsg(b)
+}
+
+// SendMsgByKey sends b through the member returned by PickByKey.
+func (p *ConnPool) SendMsgByKey(key uint64, b []byte) error {
+	s := p.PickByKey(key)
+	if s == nil {
+		return ErrPoolEmpty
+	}
+	return s.SendMsg(b)
+}
+
+// takeDownSlots marks the members which are down as connecting and returns their indexes.
+func (p *ConnPool) takeDownSlots() []int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var out []int
+	for i := range p.slots {
+		if p.slots[i].state == poolSlotDown {
+			p.slots[i].state = poolSlotConnecting
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func (p *ConnPool) setConnected(idx int, session INetworkSession, client *clientSession) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.slots[idx] = poolSlot{state: poolSlotConnected, session: session, client: client}
+}
+
+// setReconnecting marks a member as connecting again and returns how long to wait before it.
+func (p *ConnPool) setReconnecting(idx int, failed bool) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	slot := &p.slots[idx]
+	slot.state = poolSlotConnecting
+	slot.session = nil
+	slot.client = nil
+
+	if !failed || slot.delay == 0 {
+		slot.delay = 100 * time.Millisecond
+	} else if slot.delay *= 2; slot.delay > 30*time.Second {
+		slot.delay = 30 * time.Second
+	}
+	return slot.delay
+}
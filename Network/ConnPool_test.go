@@ -0,0 +1,146 @@
+package Network_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolConnectsAllMembers(t *testing.T) {
+	addr := freeAddr(t)
+	_, server := listen(t, "svc", "tcp://"+addr)
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Connect("cli", "tcp://"+addr+"?pool=3", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	runModule(t, mod, networktest.NewRecordingManager())
+
+	pool := mod.GetConnPool("cli")
+	if pool == nil || pool.Size() != 3 {
+		t.Fatal("no pool of 3")
+	}
+	waitFor(t, 2*time.Second, func() bool { return pool.Active() == 3 })
+
+	if s := pool.PickByKey(7); s == nil || s != pool.PickByKey(7) {
+		t.Fatal("PickByKey does not stick")
+	}
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 3; i++ {
+		seen[pool.Pick().GetSessionID()] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("round robin picked %d members of 3", len(seen))
+	}
+
+	if err := pool.SendMsg([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Recorder.WaitForBytes(2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolPrunesClosedSessions(t *testing.T) {
+	addr := freeAddr(t)
+	_, server := listen(t, "svc", "tcp://"+addr)
+
+	// every member is closed by the server, and replaced
+	server.NewHandler = func(h *networktest.RecordingHandler) {
+		h.OpenedHook = func() Network.Action { return Network.Close }
+	}
+
+	cli := Network.NewNetworkModule()
+	if err := cli.Connect("cli", "tcp://"+addr+"?pool=2", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	client := networktest.NewRecordingManager()
+	runModule(t, cli, client)
+
+	if _, err := client.Recorder.WaitFor(networktest.EventClosed, 6, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ := Network.ClientSessions(cli); sessions > 2 {
+		t.Fatalf("%d client sessions tracked for a pool of 2", sessions)
+	}
+}
+
+func TestShutdownStopsPoolReconnects(t *testing.T) {
+	addr := freeAddr(t)
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Connect("cli", "tcp://"+addr+"?pool=4", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	mngr := networktest.NewRecordingManager()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mod.Run(mngr, 1)
+	}()
+
+	if _, err := mngr.Recorder.WaitFor(networktest.EventConnectFailed, 8, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, reconnects := Network.ClientSessions(mod); reconnects == 0 {
+		t.Fatal("no reconnect pending")
+	}
+
+	for stopped := false; !stopped; {
+		mod.Shutdown()
+		select {
+		case <-done:
+			stopped = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if _, reconnects := Network.ClientSessions(mod); reconnects != 0 {
+		t.Fatalf("%d reconnects pending after shutdown", reconnects)
+	}
+
+	failed := len(mngr.Recorder.EventsOf(networktest.EventConnectFailed))
+	time.Sleep(300 * time.Millisecond)
+	if n := len(mngr.Recorder.EventsOf(networktest.EventConnectFailed)); n != failed {
+		t.Fatalf("%d connects after shutdown", n-failed)
+	}
+}
+
+func TestPoolBacksOffRejectedMembers(t *testing.T) {
+	addr := freeAddr(t)
+	_, server := listen(t, "svc", "tcp://"+addr)
+
+	cli := Network.NewNetworkModule()
+	if err := cli.Connect("cli", "tcp://"+addr+"?pool=2", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the members connect, but their handler panics at once
+	client := networktest.NewRecordingManager()
+	client.NewHandler = func(h *networktest.RecordingHandler) {
+		h.OpenedHook = func() Network.Action { panic("rejected") }
+	}
+	runModule(t, cli, client)
+
+	// 100ms doubling: about 5 connects per member in 1.5s, 15 at a fixed delay
+	time.Sleep(1500 * time.Millisecond)
+	if n := len(server.Recorder.EventsOf(networktest.EventOpened)); n < 2 || n > 14 {
+		t.Fatalf("%d connects of 2 rejected members in 1.5s", n)
+	}
+}
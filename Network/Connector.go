@@ -1,12 +1,157 @@
 package Network
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// ErrConnectFailed matches, with errors.Is, the failure passed to OnConnectFailed.
+var ErrConnectFailed = errors.New("connect failed")
+
 type connector struct {
 	network string
 	addr    string
 	svcKey  string
 	timeOut time.Duration
+	pool    *ConnPool // nil for a single connection
+	slot    int       // index in the pool
+}
+
+// ConnectFailure describes a failed connection attempt of a connector service.
+type ConnectFailure struct {
+	SvcKey  string
+	Network string
+	Address string
+	// Attempt counts the consecutive failures of the service, starting from 1.
+	// It is reset once a connection succeeds.
+	Attempt int
+	// Elapsed is the time spent dialing.
+	Elapsed time.Duration
+	Err     error
+}
+
+func (f *ConnectFailure) Error() string {
+	return fmt.Sprintf("connect %s %s://%s failed, attempt %d after %v: %v",
+		f.SvcKey, f.Network, f.Address, f.Attempt, f.Elapsed, f.Err)
+}
+
+func (f *ConnectFailure) Unwrap() error {
+	return f.Err
+}
+
+func (f *ConnectFailure) Is(target error) bool {
+	return target == ErrConnectFailed
+}
+
+// EndpointPolicy decides the order in which a connector tries its endpoints.
+type EndpointPolicy int
+
+const (
+	// EndpointPriority tries the endpoints by ascending Priority, the one which dropped or
+	// failed last is tried last.
+	EndpointPriority EndpointPolicy = iota
+
+	// EndpointRoundRobin starts every connect from the endpoint after the previous start.
+	EndpointRoundRobin
+)
+
+// Endpoint is one address a connector service can connect to.
+type Endpoint struct {
+	Address  string
+	Priority int // lower is preferred, like DNS SRV
+}
+
+// ConnectorState reports the endpoints of a connector service and which one is in use.
+type ConnectorState struct {
+	SvcKey    string
+	Endpoints []string // candidates of the last connect, in the order they were tried
+	Active    string   // address of the connected endpoint, empty while not connected
+	LastError error    // last dial or connection error
+	Failovers int      // times the connector connected to a different endpoint than before
+}
+
+type connectorState struct {
+	endpoints []string
+	active    string
+	last      string // last connected endpoint
+	avoid     string // endpoint which dropped or failed last
+	cursor    int    // round robin start
+	lastErr   error
+	failovers int
+}
+
+// resolveEndpoints returns the endpoints of a service: Address, Endpoints and the SRV records.
+func resolveEndpoints(info *ServerInfo, timeOut time.Duration) ([]Endpoint, error) {
+	var eps []Endpoint
+	if len(info.Address) != 0 {
+		eps = append(eps, Endpoint{Address: info.Address})
+	}
+	eps = append(eps, info.Endpoints...)
+
+	if len(info.SRV) != 0 {
+		resolver := info.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+
+		if timeOut <= 0 {
+			timeOut = 5 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeOut)
+		defer cancel()
+
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", info.SRV)
+		if err != nil && len(eps) == 0 {
+			return nil, err
+		}
+
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			eps = append(eps, Endpoint{
+				Address:  net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+				Priority: int(srv.Priority),
+			})
+		}
+	}
+
+	if len(eps) == 0 {
+		return nil, errors.New("no endpoint")
+	}
+
+	return eps, nil
+}
+
+// order returns the addresses to try for the next connect, following the policy.
+func (st *connectorState) order(eps []Endpoint, policy EndpointPolicy) []string {
+	sorted := append([]Endpoint{}, eps...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+
+	addrs := make([]string, 0, len(sorted))
+	for _, ep := range sorted {
+		addrs = append(addrs, ep.Address)
+	}
+
+	switch policy {
+	case EndpointRoundRobin:
+		start := st.cursor % len(addrs)
+		st.cursor++
+		addrs = append(addrs[start:], addrs[:start]...)
+
+	default:
+		for i, addr := range addrs {
+			if addr == st.avoid && len(addrs) > 1 {
+				addrs = append(append(addrs[:i:i], addrs[i+1:]...), addr)
+				break
+			}
+		}
+	}
+
+	st.endpoints = addrs
+	return addrs
 }
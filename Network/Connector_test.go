@@ -0,0 +1,66 @@
+package Network_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+func TestConnectFailureCountsAttempts(t *testing.T) {
+	addr := freeAddr(t)
+	mod := Network.NewNetworkModule()
+	if err := mod.Connect("cli", "tcp://"+addr, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	mngr := networktest.NewRecordingManager()
+	runModule(t, mod, mngr)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		if attempt > 1 {
+			if err := mod.ConnectSvc("cli", time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		events, err := mngr.Recorder.WaitFor(networktest.EventConnectFailed, attempt, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var failure *Network.ConnectFailure
+		if !errors.As(events[attempt-1].Err, &failure) {
+			t.Fatalf("failure %T", events[attempt-1].Err)
+		}
+		if !errors.Is(failure, Network.ErrConnectFailed) || !errors.Is(failure, syscall.ECONNREFUSED) {
+			t.Fatalf("failure %v does not match ErrConnectFailed and ECONNREFUSED", failure)
+		}
+		if failure.SvcKey != "cli" || failure.Network != "tcp" || failure.Address != addr || failure.Attempt != attempt {
+			t.Fatalf("failure %+v, want attempt %d", failure, attempt)
+		}
+	}
+}
+
+func TestListenerErrorDefaults(t *testing.T) {
+	var mngr Network.EventHandlerManager
+
+	transient := &Network.ListenerError{SvcKey: "svc", Network: "tcp", Address: ":1", Err: syscall.EMFILE}
+	if !errors.Is(transient, Network.ErrListenerFailed) || !Network.IsTransientAcceptError(transient) {
+		t.Fatalf("%v is not a transient listener error", transient)
+	}
+	if action := mngr.OnListenerError("svc", transient); action != Network.None {
+		t.Fatalf("transient error returned %v, want None", action)
+	}
+
+	fatal := &Network.ListenerError{SvcKey: "svc", Err: errors.New("closed")}
+	if Network.IsTransientAcceptError(fatal) {
+		t.Fatal("closed listener reported as transient")
+	}
+	if action := mngr.OnListenerError("svc", fatal); action != Network.Close {
+		t.Fatalf("fatal error returned %v, want Close", action)
+	}
+}
@@ -0,0 +1,105 @@
+package Network_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+func TestConnectorFailsOver(t *testing.T) {
+	live := freeAddr(t)
+	dead := freeAddr(t)
+	listen(t, "svc", "tcp://"+live)
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Connect("cli", "tcp://"+dead+","+live, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mngr := networktest.NewRecordingManager()
+	runModule(t, mod, mngr)
+
+	opened, err := mngr.Recorder.WaitFor(networktest.EventOpened, 1, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer is the endpoint, not the local side
+	session := mngr.Handler(opened[0].SessionID).Session
+	if session.GetRemoteAddr().String() != live {
+		t.Fatalf("remote address %v, want %s", session.GetRemoteAddr(), live)
+	}
+	if session.GetLocalAddr().String() == live {
+		t.Fatal("local address is the endpoint")
+	}
+
+	st, ok := mod.ConnectorState("cli")
+	if !ok {
+		t.Fatal("no connector state")
+	}
+	if st.Active != live || len(st.Endpoints) != 2 || st.Endpoints[0] != dead || st.Endpoints[1] != live {
+		t.Fatalf("state %+v", st)
+	}
+	if st.LastError != nil || st.Failovers != 0 {
+		t.Fatalf("state %+v after the first connect", st)
+	}
+
+	if _, ok := mod.ConnectorState("unknown"); ok {
+		t.Fatal("state of an unknown service")
+	}
+}
+
+func TestConnectorTriesFailedEndpointLast(t *testing.T) {
+	first := freeAddr(t)
+	second := freeAddr(t)
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Connect("cli", "tcp://"+first+","+second, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mngr := networktest.NewRecordingManager()
+	runModule(t, mod, mngr)
+
+	if _, err := mngr.Recorder.WaitFor(networktest.EventConnectFailed, 1, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := mod.ConnectorState("cli")
+	if st.Endpoints[0] != first || !errors.Is(st.LastError, syscall.ECONNREFUSED) {
+		t.Fatalf("state %+v", st)
+	}
+
+	// second failed last, so it goes last again
+	mod.ConnectSvc("cli", time.Second)
+	if _, err := mngr.Recorder.WaitFor(networktest.EventConnectFailed, 2, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ = mod.ConnectorState("cli"); st.Endpoints[0] != first {
+		t.Fatalf("endpoints %v", st.Endpoints)
+	}
+}
+
+func TestConnectorRoundRobin(t *testing.T) {
+	a, b := freeAddr(t), freeAddr(t)
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Connect("cli", "tcp://"+a+","+b+"?policy=roundrobin", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mngr := networktest.NewRecordingManager()
+	runModule(t, mod, mngr)
+
+	for i, want := range []string{a, b, a} {
+		if i > 0 {
+			mod.ConnectSvc("cli", time.Second)
+		}
+		if _, err := mngr.Recorder.WaitFor(networktest.EventConnectFailed, i+1, 2*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if st, _ := mod.ConnectorState("cli"); st.Endpoints[0] != want {
+			t.Fatalf("connect %d started from %s, want %s", i, st.Endpoints[0], want)
+		}
+	}
+}
@@ -31,6 +31,19 @@ type IEventHandler interface {
 	OnDetached(rwc io.ReadWriteCloser) (action Action)
 }
 
+// ICloseCause is implemented by the handlers telling why they returned Close from OnRecvMsg,
+// the error is passed to OnClosed instead of nil.
+type ICloseCause interface {
+	CloseCause() error
+}
+
+func closeCause(h IEventHandler) error {
+	if c, ok := h.(ICloseCause); ok {
+		return c.CloseCause()
+	}
+	return nil
+}
+
 type EventHandler struct {
 	Session INetworkSession
 	ready   bool
@@ -73,7 +86,18 @@ type Options struct {
 type IEventHandlerManager interface {
 	CreateEventHandler(session INetworkSession) IEventHandler
 
-	OnConnectFailed(svcKey string)
+	// OnConnectFailed fires when a connector could not connect. failure matches ErrConnectFailed
+	// and wraps the dial error.
+	OnConnectFailed(svcKey string, failure *ConnectFailure)
+
+	// OnListenerError fires when a listener fails to accept. err is a *ListenerError matching
+	// ErrListenerFailed. Return None to keep accepting after a short backoff, or Close to
+	// shut the network module down.
+	OnListenerError(svcKey string, err error) Action
+
+	// OnHandlerPanic fires after CreateEventHandler or a callback of the session's handler
+	// panicked. The session is closed with a *HandlerPanicError, other sessions are not affected.
+	OnHandlerPanic(session INetworkSession, value interface{}, stack []byte)
 
 	OnShutdown()
 }
@@ -85,7 +109,19 @@ func (evMngr *EventHandlerManager) CreateEventHandler(session INetworkSession) I
 	panic("CreateEventHandler: You must implement this function")
 }
 
-func (evMngr *EventHandlerManager) OnConnectFailed(svcKey string) {
+func (evMngr *EventHandlerManager) OnConnectFailed(svcKey string, failure *ConnectFailure) {
+
+}
+
+// OnListenerError retries transient errors and shuts down on the others.
+func (evMngr *EventHandlerManager) OnListenerError(svcKey string, err error) Action {
+	if IsTransientAcceptError(err) {
+		return None
+	}
+	return Close
+}
+
+func (evMngr *EventHandlerManager) OnHandlerPanic(session INetworkSession, value interface{}, stack []byte) {
 
 }
 
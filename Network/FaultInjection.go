@@ -0,0 +1,285 @@
+package Network
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrFaultReset = errors.New("connection reset by fault injector")
+
+// FaultConfig describes the faults injected into the connections of a service.
+// All probabilities are in [0, 1] and are evaluated per Read/Write call.
+type FaultConfig struct {
+	// Latency is added before every read and write, plus a random jitter in [0, Jitter).
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Bandwidth limits the throughput of each connection in bytes per second, 0 means unlimited.
+	Bandwidth int
+
+	// DropRate is the probability of silently dropping an UDP datagram.
+	DropRate float64
+
+	// StallRate is the probability of stalling a TCP read or write for StallDuration.
+	StallRate     float64
+	StallDuration time.Duration
+
+	// FragmentSize splits reads into chunks of at most FragmentSize bytes, 0 disables it.
+	FragmentSize int
+
+	// ResetRate is the probability of abruptly resetting a TCP connection.
+	ResetRate float64
+
+	// Seed makes the injected faults reproducible. Every connection gets its own
+	// random source seeded with Seed plus the connection's sequence number.
+	Seed int64
+}
+
+// FaultInjector wraps the connections of a service and injects faults into them.
+// Its config can be changed at runtime and applies to existing connections as well.
+type FaultInjector struct {
+	mutex   sync.Mutex
+	cfg     FaultConfig
+	enabled bool
+	conns   int64
+}
+
+func NewFaultInjector(cfg FaultConfig) *FaultInjector {
+	return &FaultInjector{cfg: cfg, enabled: true}
+}
+
+func (f *FaultInjector) SetConfig(cfg FaultConfig) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.cfg = cfg
+}
+
+func (f *FaultInjector) GetConfig() FaultConfig {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.cfg
+}
+
+// SetEnabled turns fault injection on or off without touching the config.
+func (f *FaultInjector) SetEnabled(enabled bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.enabled = enabled
+}
+
+func (f *FaultInjector) IsEnabled() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.enabled
+}
+
+func (f *FaultInjector) snapshot() (cfg FaultConfig, enabled bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.cfg, f.enabled
+}
+
+func (f *FaultInjector) newRand() *rand.Rand {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.conns++
+	return rand.New(rand.NewSource(f.cfg.Seed + f.conns))
+}
+
+// WrapConn returns c wrapped by the injector. A nil injector returns c unchanged.
+func (f *FaultInjector) WrapConn(c net.Conn) net.Conn {
+	if f == nil {
+		return c
+	}
+
+	return &faultConn{Conn: c, injector: f, rnd: f.newRand()}
+}
+
+// WrapPacketConn returns c wrapped by the injector. A nil injector returns c unchanged.
+func (f *FaultInjector) WrapPacketConn(c net.PacketConn) net.PacketConn {
+	if f == nil {
+		return c
+	}
+
+	return &faultPacketConn{PacketConn: c, injector: f, rnd: f.newRand()}
+}
+
+// tcpConn returns the *net.TCPConn under c, looking through the fault wrapper.
+func tcpConn(c net.Conn) (*net.TCPConn, bool) {
+	if fc, ok := c.(*faultConn); ok {
+		c = fc.Conn
+	}
+
+	conn, ok := c.(*net.TCPConn)
+	return conn, ok
+}
+
+//----------------------------------------------------------------------------
+type faultConn struct {
+	net.Conn
+	injector *FaultInjector
+	rndMutex sync.Mutex
+	rnd      *rand.Rand
+}
+
+func (c *faultConn) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	c.rndMutex.Lock()
+	defer c.rndMutex.Unlock()
+
+	return c.rnd.Float64() < rate
+}
+
+func (c *faultConn) delay(cfg *FaultConfig) time.Duration {
+	d := cfg.Latency
+	if cfg.Jitter > 0 {
+		c.rndMutex.Lock()
+		d += time.Duration(c.rnd.Int63n(int64(cfg.Jitter)))
+		c.rndMutex.Unlock()
+	}
+	return d
+}
+
+// before applies the faults common to reads and writes.
+func (c *faultConn) before(cfg *FaultConfig) error {
+	if c.roll(cfg.ResetRate) {
+		c.reset()
+		return ErrFaultReset
+	}
+
+	if c.roll(cfg.StallRate) {
+		time.Sleep(cfg.StallDuration)
+	}
+
+	if d := c.delay(cfg); d > 0 {
+		time.Sleep(d)
+	}
+
+	return nil
+}
+
+func (c *faultConn) reset() {
+	if conn, ok := c.Conn.(*net.TCPConn); ok {
+		// send RST instead of FIN
+		conn.SetLinger(0)
+	}
+	c.Conn.Close()
+}
+
+func throttle(cfg *FaultConfig, n int) {
+	if cfg.Bandwidth > 0 && n > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(cfg.Bandwidth))
+	}
+}
+
+func (c *faultConn) Read(p []byte) (n int, err error) {
+	cfg, enabled := c.injector.snapshot()
+	if !enabled {
+		return c.Conn.Read(p)
+	}
+
+	if err = c.before(&cfg); err != nil {
+		return 0, err
+	}
+
+	if cfg.FragmentSize > 0 && len(p) > cfg.FragmentSize {
+		p = p[:cfg.FragmentSize]
+	}
+
+	n, err = c.Conn.Read(p)
+	throttle(&cfg, n)
+	return
+}
+
+func (c *faultConn) Write(p []byte) (n int, err error) {
+	cfg, enabled := c.injector.snapshot()
+	if !enabled {
+		return c.Conn.Write(p)
+	}
+
+	if err = c.before(&cfg); err != nil {
+		return 0, err
+	}
+
+	throttle(&cfg, len(p))
+	return c.Conn.Write(p)
+}
+
+//----------------------------------------------------------------------------
+type faultPacketConn struct {
+	net.PacketConn
+	injector *FaultInjector
+	rndMutex sync.Mutex
+	rnd      *rand.Rand
+}
+
+func (c *faultPacketConn) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	c.rndMutex.Lock()
+	defer c.rndMutex.Unlock()
+
+	return c.rnd.Float64() < rate
+}
+
+func (c *faultPacketConn) delay(cfg *FaultConfig) {
+	d := cfg.Latency
+	if cfg.Jitter > 0 {
+		c.rndMutex.Lock()
+		d += time.Duration(c.rnd.Int63n(int64(cfg.Jitter)))
+		c.rndMutex.Unlock()
+	}
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (c *faultPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+
+		cfg, enabled := c.injector.snapshot()
+		if err != nil || !enabled {
+			return
+		}
+
+		if c.roll(cfg.DropRate) {
+			continue
+		}
+
+		c.delay(&cfg)
+		throttle(&cfg, n)
+		return
+	}
+}
+
+func (c *faultPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	cfg, enabled := c.injector.snapshot()
+	if !enabled {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+
+	if c.roll(cfg.DropRate) {
+		// pretend it has been sent
+		return len(p), nil
+	}
+
+	c.delay(&cfg)
+	throttle(&cfg, len(p))
+	return c.PacketConn.WriteTo(p, addr)
+}
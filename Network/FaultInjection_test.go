@@ -0,0 +1,121 @@
+package Network_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+func TestFaultConnKeepsTCPConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	wrapped := Network.NewFaultInjector(Network.FaultConfig{Latency: time.Millisecond}).WrapConn(conn)
+	if wrapped == conn {
+		t.Fatal("the connection is not wrapped")
+	}
+
+	tcp, ok := Network.TCPConnOf(wrapped)
+	if !ok || tcp != conn {
+		t.Fatalf("TCPConnOf(wrapped) = %v, %v, want the dialed connection", tcp, ok)
+	}
+
+	// a nil injector leaves the connection as is
+	if c := (*Network.FaultInjector)(nil).WrapConn(conn); c != conn {
+		t.Fatal("nil injector wrapped the connection")
+	}
+}
+
+func TestFaultOptionsFromURL(t *testing.T) {
+	mod := Network.NewNetworkModule()
+	addr := freeAddr(t)
+	if err := mod.Connect("cli", "tcp://"+addr+"?fault.latency=50ms&fault.jitter=10ms&fault.fragment=3&fault.reset=0.5&fault.seed=7", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	info := mod.GetServerInfo("cli")
+	if info.Address != addr || info.Fault == nil {
+		t.Fatalf("server info %+v", info)
+	}
+
+	want := Network.FaultConfig{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, FragmentSize: 3, ResetRate: 0.5, Seed: 7}
+	if cfg := info.Fault.GetConfig(); cfg != want {
+		t.Fatalf("config %+v, want %+v", cfg, want)
+	}
+}
+
+func TestFaultFragmentsReads(t *testing.T) {
+	addr := freeAddr(t)
+	_, mngr := listen(t, "svc", "tcp://"+addr+"?fault.fragment=3")
+
+	cli, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	msg := []byte("0123456789abcdef")
+	if err := cli.SendRaw(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := mngr.Recorder.WaitForBytes(len(msg), time.Second)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("received %q, %v", got, err)
+	}
+
+	for _, ev := range mngr.Recorder.EventsOf(networktest.EventRecvMsg) {
+		if len(ev.Data) > 3 {
+			t.Fatalf("read of %d bytes, fragments are 3 at most", len(ev.Data))
+		}
+	}
+}
+
+func TestFaultResetClosesSession(t *testing.T) {
+	addr := freeAddr(t)
+	mod, mngr := listen(t, "svc", "tcp://"+addr+"?fault.reset=1")
+
+	cli, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	closed, err := mngr.Recorder.WaitFor(networktest.EventClosed, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(closed[0].Err, Network.ErrFaultReset) {
+		t.Fatalf("closed with %v, want %v", closed[0].Err, Network.ErrFaultReset)
+	}
+	if len(mngr.Recorder.EventsOf(networktest.EventRecvMsg)) != 0 {
+		t.Fatal("received data through a reset connection")
+	}
+
+	// turned off, connections work again
+	mod.GetServerInfo("svc").Fault.SetEnabled(false)
+	cli2, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+
+	cli2.SendRaw([]byte("ok"))
+	if _, err := mngr.Recorder.WaitFor(networktest.EventRecvMsg, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
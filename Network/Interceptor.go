@@ -0,0 +1,124 @@
+package Network
+
+import (
+	"io"
+)
+
+// IInterceptor wraps the IEventHandler callbacks and SendMsg of every session of a service.
+// Each method receives the next step of the chain: call it to continue, possibly with
+// modified arguments, or return without calling it to drop the call or short-circuit it
+// with an Action. The session passed in is the raw one, so SendMsg on it bypasses the chain.
+type IInterceptor interface {
+	InterceptOpened(session INetworkSession, next func() (Options, Action)) (opts Options, action Action)
+
+	InterceptRecvMsg(session INetworkSession, b []byte, next func(b []byte) Action) Action
+
+	InterceptClosed(session INetworkSession, err error, next func(err error) Action) Action
+
+	InterceptDetached(session INetworkSession, rwc io.ReadWriteCloser, next func(rwc io.ReadWriteCloser) Action) Action
+
+	InterceptSendMsg(session INetworkSession, b []byte, next func(b []byte) error) error
+}
+
+// InterceptorBase passes every call through. Embed it to intercept only some of them.
+type InterceptorBase struct {
+}
+
+func (ic *InterceptorBase) InterceptOpened(session INetworkSession, next func() (Options, Action)) (opts Options, action Action) {
+	return next()
+}
+
+func (ic *InterceptorBase) InterceptRecvMsg(session INetworkSession, b []byte, next func(b []byte) Action) Action {
+	return next(b)
+}
+
+func (ic *InterceptorBase) InterceptClosed(session INetworkSession, err error, next func(err error) Action) Action {
+	return next(err)
+}
+
+func (ic *InterceptorBase) InterceptDetached(session INetworkSession, rwc io.ReadWriteCloser, next func(rwc io.ReadWriteCloser) Action) Action {
+	return next(rwc)
+}
+
+func (ic *InterceptorBase) InterceptSendMsg(session INetworkSession, b []byte, next func(b []byte) error) error {
+	return next(b)
+}
+
+//----------------------------------------------------------------------------
+
+// interceptedSession is handed to CreateEventHandler, so the handler's SendMsg runs through the chain.
+type interceptedSession struct {
+	INetworkSession
+	chain []IInterceptor
+}
+
+func (s *interceptedSession) SendMsg(b []byte) error {
+	next := s.INetworkSession.SendMsg
+	for i := len(s.chain) - 1; i >= 0; i-- {
+		ic, n := s.chain[i], next
+		next = func(b []byte) error { return ic.InterceptSendMsg(s.INetworkSession, b, n) }
+	}
+	return next(b)
+}
+
+// SendShared writes buf through the chain as a regular message when there is one.
+func (s *interceptedSession) SendShared(buf *SharedBuffer) error {
+	if len(s.chain) == 0 {
+		return s.INetworkSession.SendShared(buf)
+	}
+	return s.SendMsg(buf.Bytes())
+}
+
+type interceptedHandler struct {
+	handler IEventHandler
+	session *interceptedSession
+}
+
+func (h *interceptedHandler) OnOpened() (opts Options, action Action) {
+	chain, raw := h.session.chain, h.session.INetworkSession
+
+	next := h.handler.OnOpened
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, n := chain[i], next
+		next = func() (Options, Action) { return ic.InterceptOpened(raw, n) }
+	}
+	return next()
+}
+
+func (h *interceptedHandler) OnRecvMsg(b []byte) Action {
+	chain, raw := h.session.chain, h.session.INetworkSession
+
+	next := h.handler.OnRecvMsg
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, n := chain[i], next
+		next = func(b []byte) Action { return ic.InterceptRecvMsg(raw, b, n) }
+	}
+	return next(b)
+}
+
+func (h *interceptedHandler) OnClosed(err error) (action Action) {
+	chain, raw := h.session.chain, h.session.INetworkSession
+
+	next := h.handler.OnClosed
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, n := chain[i], next
+		next = func(err error) Action { return ic.InterceptClosed(raw, err, n) }
+	}
+	return next(err)
+}
+
+// CloseCause forwards to the handler, the chain has no say in it.
+func (h *interceptedHandler) CloseCause() error {
+	return closeCause(h.handler)
+}
+
+func (h *interceptedHandler) OnDetached(rwc io.ReadWriteCloser) (action Action) {
+	chain, raw := h.session.chain, h.session.INetworkSession
+
+	next := h.handler.OnDetached
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, n := chain[i], next
+		next = func(rwc io.ReadWriteCloser) Action { return ic.InterceptDetached(raw, rwc, n) }
+	}
+	return next(rwc)
+}
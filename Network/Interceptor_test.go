@@ -0,0 +1,124 @@
+package Network_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+// tagInterceptor appends its tag to what it receives and prefixes what is sent with it.
+type tagInterceptor struct {
+	Network.InterceptorBase
+	tag   string
+	mutex *sync.Mutex
+	calls *[]string
+}
+
+func (ic *tagInterceptor) log(call string) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	*ic.calls = append(*ic.calls, ic.tag+call)
+}
+
+func (ic *tagInterceptor) InterceptOpened(session Network.INetworkSession, next func() (Network.Options, Network.Action)) (Network.Options, Network.Action) {
+	ic.log("opened")
+	return next()
+}
+
+func (ic *tagInterceptor) InterceptRecvMsg(session Network.INetworkSession, b []byte, next func(b []byte) Network.Action) Network.Action {
+	if bytes.HasPrefix(b, []byte("drop")) {
+		return Network.None
+	}
+	ic.log("recv")
+	return next(append(append([]byte{}, b...), ic.tag...))
+}
+
+func (ic *tagInterceptor) InterceptClosed(session Network.INetworkSession, err error, next func(err error) Network.Action) Network.Action {
+	ic.log("closed")
+	return next(err)
+}
+
+func (ic *tagInterceptor) InterceptSendMsg(session Network.INetworkSession, b []byte, next func(b []byte) error) error {
+	return next(append([]byte(ic.tag), b...))
+}
+
+func TestInterceptorChain(t *testing.T) {
+	addr := freeAddr(t)
+
+	var mutex sync.Mutex
+	var calls []string
+	outer := &tagInterceptor{tag: "A", mutex: &mutex, calls: &calls}
+	inner := &tagInterceptor{tag: "B", mutex: &mutex, calls: &calls}
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Listen("svc", "tcp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.AddInterceptor("svc", outer, inner); err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.AddInterceptor("nothing", outer); err == nil {
+		t.Fatal("added interceptors to an unknown service")
+	}
+
+	mngr := networktest.NewRecordingManager()
+	mngr.NewHandler = func(h *networktest.RecordingHandler) {
+		session := h.Session
+		h.RecvHook = func(b []byte) Network.Action {
+			session.SendMsg(b)
+			return Network.None
+		}
+	}
+	runModule(t, mod, mngr)
+
+	cli, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	cli.SendRaw([]byte("drop this"))
+	time.Sleep(50 * time.Millisecond)
+	cli.SendRaw([]byte("x"))
+
+	// received through A then B, sent back through A then B, B being nearer the socket
+	msgs, err := mngr.Recorder.WaitForMessages(1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msgs[0]) != "xAB" {
+		t.Fatalf("handler received %q, want %q", msgs[0], "xAB")
+	}
+
+	cli.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(cli.Conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "BAxAB" {
+		t.Fatalf("client received %q, want %q", reply, "BAxAB")
+	}
+
+	cli.Close()
+	if _, err := mngr.Recorder.WaitFor(networktest.EventClosed, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{"Aopened", "Bopened", "Arecv", "Brecv", "Aclosed", "Bclosed"}
+	if len(calls) != len(want) {
+		t.Fatalf("calls %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("calls %v, want %v", calls, want)
+		}
+	}
+}
@@ -2,10 +2,15 @@ package Network
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"os"
+	"syscall"
 )
 
+// ErrListenerFailed matches, with errors.Is, the error passed to OnListenerError.
+var ErrListenerFailed = errors.New("listener failed")
+
 type listener struct {
 	ln          net.Listener             //tcp listener
 	lnaddr      net.Addr                 //address listen on
@@ -42,3 +47,34 @@ func reuseportListen(proto, addr string) (l net.Listener, err error) {
 type newListener struct {
 	ln *listener
 }
+
+// ListenerError is reported to OnListenerError when accepting (or reading, for UDP) fails.
+type ListenerError struct {
+	SvcKey  string
+	Network string
+	Address string
+	Err     error
+}
+
+func (e *ListenerError) Error() string {
+	return fmt.Sprintf("listener %s %s://%s: %v", e.SvcKey, e.Network, e.Address, e.Err)
+}
+
+func (e *ListenerError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ListenerError) Is(target error) bool {
+	return target == ErrListenerFailed
+}
+
+// IsTransientAcceptError reports whether an accept error is likely to go away by itself,
+// like running out of file descriptors, so accepting should be retried.
+func IsTransientAcceptError(err error) bool {
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
@@ -3,6 +3,7 @@ package Network
 import (
 	"errors"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,11 +28,20 @@ const (
 
 type addrOpts struct {
 	reusePort bool
+	fault     *FaultConfig
+	policy    EndpointPolicy
+	srv       string
+	pool      int
+	leastPend bool
 }
 
 // Network://Address
 // like `tcp://192.168.0.10:9851` or `unix://socket`.
 //		`tcp://localhost:5000?reuseport=1`
+//		`tcp://localhost:5000?fault.latency=50ms&fault.jitter=10ms&fault.seed=7`
+//		`tcp://10.0.0.1:5000,10.0.0.2:5000?policy=roundrobin` several endpoints for a connector
+//		`tcp://?srv=_center._tcp.example.com` endpoints from DNS SRV records
+//		`tcp://localhost:5000?pool=4&poolpolicy=leastpending` a pool of 4 connections
 // Valid network schemes:
 //  tcp   - bind to both IPv4 and IPv6
 //  tcp4  - IPv4
@@ -48,6 +58,20 @@ type ServerInfo struct {
 	ReusePort bool
 	//Valid client IP range, for a server. example: "192.168.1.0/24"
 	IPRange string
+	//Inject faults into the connections of this service, for chaos testing. nil disables it.
+	Fault *FaultInjector
+	//Wrap the event handlers and SendMsg of the sessions, the first one is the outermost.
+	Interceptors []IInterceptor
+	//More endpoints for a connector, tried after Address according to EndpointPolicy.
+	Endpoints      []Endpoint
+	EndpointPolicy EndpointPolicy
+	//DNS SRV name resolving to more endpoints for a connector, looked up on every connect.
+	SRV string
+	//Resolver for SRV, nil uses net.DefaultResolver.
+	Resolver *net.Resolver
+	//Connections ConnectSvc opens to the service as a ConnPool, 0 or 1 for a single connection.
+	PoolSize   int
+	PoolPolicy PoolPolicy
 }
 
 type INetworkModule interface {
@@ -60,6 +84,9 @@ type INetworkModule interface {
 	ListenSvc(svcKey string) error
 	Connect(svcKey, url string, timeOut time.Duration) error
 	ConnectSvc(svcKey string, timeOut time.Duration) error
+	AddInterceptor(svcKey string, interceptors ...IInterceptor) error
+	ConnectorState(svcKey string) (ConnectorState, bool)
+	GetConnPool(svcKey string) *ConnPool
 }
 
 type NetworkModuleBase struct {
@@ -93,6 +120,50 @@ func (m *NetworkModuleBase) GetServerInfo(svcKey string) *ServerInfo {
 	return info
 }
 
+// AddInterceptor appends interceptors to the chain of a service.
+// Sessions already opened keep the chain they were created with.
+func (m *NetworkModuleBase) AddInterceptor(svcKey string, interceptors ...IInterceptor) error {
+	m.serverInfoMutex.Lock()
+	defer m.serverInfoMutex.Unlock()
+
+	info, ok := m.severInfoes[svcKey]
+	if !ok {
+		return errors.New("service not exist")
+	}
+
+	info.Interceptors = append(info.Interceptors, interceptors...)
+	return nil
+}
+
+func (m *NetworkModuleBase) getInterceptors(svcKey string) []IInterceptor {
+	m.serverInfoMutex.Lock()
+	defer m.serverInfoMutex.Unlock()
+
+	info, ok := m.severInfoes[svcKey]
+	if !ok || len(info.Interceptors) == 0 {
+		return nil
+	}
+
+	return append([]IInterceptor{}, info.Interceptors...)
+}
+
+// createEventHandler asks the manager for a handler, wrapped by the interceptors of the service.
+// Returns the session given to the manager as well.
+func (m *NetworkModuleBase) createEventHandler(session INetworkSession) (IEventHandler, INetworkSession) {
+	chain := m.getInterceptors(session.GetServiceKey())
+	if len(chain) == 0 {
+		return m.evManager.CreateEventHandler(session), session
+	}
+
+	is := &interceptedSession{INetworkSession: session, chain: chain}
+	handler := m.evManager.CreateEventHandler(is)
+	if handler == nil {
+		return nil, is
+	}
+
+	return &interceptedHandler{handler: handler, session: is}, is
+}
+
 func (m *NetworkModuleBase) IsClientIPInRange(svcKey, clientip string) bool {
 	svcInfo := m.GetServerInfo(svcKey)
 	if svcInfo == nil {
@@ -139,14 +210,7 @@ func (m *NetworkModuleBase) Shutdown() error {
 
 func (m *NetworkModuleBase) Listen(svcKey string, url string) error {
 
-	network, addr, opts := parseAddr(url)
-
-	svcInfo := &ServerInfo{
-		Key:       svcKey,
-		Network:   network,
-		Address:   addr,
-		IsServer:  false,
-		ReusePort: opts.reusePort}
+	svcInfo := newServerInfo(svcKey, url)
 
 	err := m.AddServerInfo(svcInfo)
 	if err != nil {
@@ -163,14 +227,7 @@ func (m *NetworkModuleBase) ListenSvc(svcKey string) error {
 
 func (m *NetworkModuleBase) Connect(svcKey, url string, timeOut time.Duration) error {
 
-	network, addr, opts := parseAddr(url)
-
-	svcInfo := &ServerInfo{
-		Key:       svcKey,
-		Network:   network,
-		Address:   addr,
-		IsServer:  false,
-		ReusePort: opts.reusePort}
+	svcInfo := newServerInfo(svcKey, url)
 
 	err := m.AddServerInfo(svcInfo)
 	if err != nil {
@@ -185,6 +242,48 @@ func (m *NetworkModuleBase) ConnectSvc(svcKey string, timeOut time.Duration) err
 	return nil
 }
 
+func (m *NetworkModuleBase) ConnectorState(svcKey string) (ConnectorState, bool) {
+	panic("ConnectorState: You must implement this function")
+}
+
+func (m *NetworkModuleBase) GetConnPool(svcKey string) *ConnPool {
+	panic("GetConnPool: You must implement this function")
+}
+
+// newServerInfo builds the ServerInfo of a service from an url.
+func newServerInfo(svcKey, url string) *ServerInfo {
+	network, addr, opts := parseAddr(url)
+
+	svcInfo := &ServerInfo{
+		Key:            svcKey,
+		Network:        network,
+		Address:        addr,
+		IsServer:       false,
+		ReusePort:      opts.reusePort,
+		EndpointPolicy: opts.policy,
+		SRV:            opts.srv,
+		PoolSize:       opts.pool}
+
+	if opts.leastPend {
+		svcInfo.PoolPolicy = PoolLeastPending
+	}
+
+	// "10.0.0.1:5000,10.0.0.2:5000" -> Address and Endpoints, prioritized by order
+	if strings.Contains(addr, ",") {
+		addrs := strings.Split(addr, ",")
+		svcInfo.Address = addrs[0]
+		for i, item := range addrs[1:] {
+			svcInfo.Endpoints = append(svcInfo.Endpoints, Endpoint{Address: item, Priority: i + 1})
+		}
+	}
+
+	if opts.fault != nil {
+		svcInfo.Fault = NewFaultInjector(*opts.fault)
+	}
+
+	return svcInfo
+}
+
 //"tcp://localhost:5000?reuseport=1" -> tcp, localhost:5000, true
 func parseAddr(addr string) (network, address string, opts addrOpts) {
 	network = "tcp"
@@ -212,6 +311,23 @@ func parseAddr(addr string) (network, address string, opts addrOpts) {
 							opts.reusePort = true
 						}
 					}
+				case "policy":
+					if kv[1] == "roundrobin" {
+						opts.policy = EndpointRoundRobin
+					}
+				case "srv":
+					opts.srv = kv[1]
+				case "pool":
+					opts.pool, _ = strconv.Atoi(kv[1])
+				case "poolpolicy":
+					opts.leastPend = kv[1] == "leastpending"
+				default:
+					if strings.HasPrefix(kv[0], "fault.") {
+						if opts.fault == nil {
+							opts.fault = &FaultConfig{}
+						}
+						parseFaultOpt(opts.fault, kv[0][len("fault."):], kv[1])
+					}
 				}
 			}
 		}
@@ -219,3 +335,27 @@ func parseAddr(addr string) (network, address string, opts addrOpts) {
 	}
 	return
 }
+
+//"latency", "50ms" -> cfg.Latency = 50ms. Invalid values are ignored.
+func parseFaultOpt(cfg *FaultConfig, key, value string) {
+	switch key {
+	case "latency":
+		cfg.Latency, _ = time.ParseDuration(value)
+	case "jitter":
+		cfg.Jitter, _ = time.ParseDuration(value)
+	case "bandwidth":
+		cfg.Bandwidth, _ = strconv.Atoi(value)
+	case "drop":
+		cfg.DropRate, _ = strconv.ParseFloat(value, 64)
+	case "stall":
+		cfg.StallRate, _ = strconv.ParseFloat(value, 64)
+	case "stallfor":
+		cfg.StallDuration, _ = time.ParseDuration(value)
+	case "fragment":
+		cfg.FragmentSize, _ = strconv.Atoi(value)
+	case "reset":
+		cfg.ResetRate, _ = strconv.ParseFloat(value, 64)
+	case "seed":
+		cfg.Seed, _ = strconv.ParseInt(value, 10, 64)
+	}
+}
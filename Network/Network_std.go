@@ -17,14 +17,20 @@ type stdloop struct {
 	idx   int                  // loop index
 	ch    chan interface{}     // command channel
 	conns map[*tcpSession]bool // track all the conns bound to this loop
+	wch   chan sharedWrite     // buffers for the writer of the loop
+	quit  chan struct{}        // stops the writer
 }
 
 type NetworkModuleStd struct {
 	NetworkModuleBase
-	loops          []*stdloop       // all the loops
-	lns            []*listener      // all the listeners
-	connects       []*connector     // all the connectors
-	clientSessions []*clientSession // all the clients
+	loops          []*stdloop           // all the loops
+	lns            []*listener          // all the listeners
+	connects       []*connector         // all the connectors
+	clientSessions []*clientSession     // all the clients
+	reconnects     map[*time.Timer]bool // pending reconnects of pool members
+	connectFails   map[string]int       // consecutive connect failures per service
+	connStates     map[string]*connectorState
+	pools          map[string]*ConnPool
 	clientMutex    sync.Mutex
 	loopwg         sync.WaitGroup // loop close waitgroup
 	lnwg           sync.WaitGroup // listener close waitgroup
@@ -49,6 +55,8 @@ func (m *NetworkModuleStd) Run(evMngr IEventHandlerManager, numLoops int) error
 			idx:   i,
 			ch:    make(chan interface{}),
 			conns: make(map[*tcpSession]bool),
+			wch:   make(chan sharedWrite, sharedWriteQueueSize),
+			quit:  make(chan struct{}),
 		})
 	}
 
@@ -78,9 +86,18 @@ func (m *NetworkModuleStd) Run(evMngr IEventHandlerManager, numLoops int) error
 		}
 		m.loopwg.Wait()
 
-		// close all connectors
+		for _, l := range m.loops {
+			close(l.quit)
+		}
+
+		// close all connectors, the pending reconnects first as they would add to connectwg
 		m.clientMutex.Lock()
+		for timer := range m.reconnects {
+			timer.Stop()
+		}
+		m.reconnects = nil
 		for i := 0; i < len(m.clientSessions); i++ {
+			m.clientSessions[i].gate.close()
 			m.clientSessions[i].conn.Close()
 		}
 		m.clientMutex.Unlock()
@@ -92,6 +109,7 @@ func (m *NetworkModuleStd) Run(evMngr IEventHandlerManager, numLoops int) error
 	m.loopwg.Add(numLoops)
 	for i := 0; i < numLoops; i++ {
 		go stdLoopRun(m, m.loops[i])
+		go stdloopWriter(m.loops[i])
 	}
 
 	m.lnwg.Add(len(m.lns))
@@ -115,14 +133,7 @@ func (m *NetworkModuleStd) Shutdown() error {
 
 func (m *NetworkModuleStd) Listen(svcKey string, url string) error {
 
-	network, addr, opts := parseAddr(url)
-
-	svcInfo := &ServerInfo{
-		Key:       svcKey,
-		Network:   network,
-		Address:   addr,
-		IsServer:  false,
-		ReusePort: opts.reusePort}
+	svcInfo := newServerInfo(svcKey, url)
 
 	err := m.AddServerInfo(svcInfo)
 	if err != nil {
@@ -169,6 +180,10 @@ func (m *NetworkModuleStd) ListenSvc(svcKey string) error {
 		return err
 	}
 
+	if ln.pconn != nil {
+		ln.pconn = svcInfo.Fault.WrapPacketConn(ln.pconn)
+	}
+
 	if ln.pconn != nil {
 		ln.lnaddr = ln.pconn.LocalAddr()
 	} else {
@@ -193,21 +208,66 @@ func connecting(m *NetworkModuleStd, c *connector) {
 	go func() {
 		defer m.connectwg.Done()
 
-		conn, err := net.DialTimeout(c.network, c.addr, c.timeOut)
+		// pool members are replaced whenever they fail or close, the ones closing soon after
+		// they opened count as failures
+		var opened time.Time
+		if c.pool != nil {
+			defer func() { m.reconnectPoolSlot(c, opened.IsZero() || time.Since(opened) < poolSlotStable) }()
+		}
+
+		start := time.Now()
+		conn, err := m.dialEndpoints(c)
 		if err != nil {
-			m.evManager.OnConnectFailed(c.svcKey)
+			failure := &ConnectFailure{
+				SvcKey:  c.svcKey,
+				Network: c.network,
+				Address: c.addr,
+				Attempt: m.countConnectFail(c.svcKey, false),
+				Elapsed: time.Since(start),
+				Err:     err,
+			}
+			m.evManager.OnConnectFailed(c.svcKey, failure)
 			return
 		}
+		m.countConnectFail(c.svcKey, true)
+		m.setConnectorActive(c.svcKey, c.addr)
+
+		if svcInfo := m.GetServerInfo(c.svcKey); svcInfo != nil {
+			conn = svcInfo.Fault.WrapConn(conn)
+		}
 
 		session := &clientSession{
 			conn:      conn,
 			svcKey:    c.svcKey,
 			sessionID: atomic.AddUint64(&allSessionID, 1),
 		}
-		session.eventHandler = m.evManager.CreateEventHandler(session)
-		opts, _ := session.eventHandler.OnOpened()
+
+		var handler IEventHandler
+		var hsession INetworkSession
+		perr := m.protect(session, func() { handler, hsession = m.createEventHandler(session) })
+		if perr != nil || handler == nil {
+			if perr == nil {
+				fmt.Println("no event handler, session rejected:", c.svcKey, session.sessionID)
+			}
+			conn.Close()
+			return
+		}
+		session.eventHandler = handler
+
+		var opts Options
+		if perr := m.protect(session, func() { opts, _ = handler.OnOpened() }); perr != nil {
+			conn.Close()
+			m.protect(session, func() { handler.OnClosed(perr) })
+			return
+		}
+		opened = time.Now()
+
+		if c.pool != nil {
+			c.pool.setConnected(c.slot, hsession, session)
+		}
+
 		if opts.TCPKeepAlive > 0 {
-			if conn, ok := session.conn.(*net.TCPConn); ok {
+			if conn, ok := tcpConn(session.conn); ok {
 				conn.SetKeepAlive(true)
 				conn.SetKeepAlivePeriod(opts.TCPKeepAlive)
 			}
@@ -216,31 +276,154 @@ func connecting(m *NetworkModuleStd, c *connector) {
 		m.clientMutex.Lock()
 		m.clientSessions = append(m.clientSessions, session)
 		m.clientMutex.Unlock()
+		defer m.removeClientSession(session)
 
 		var packet [0xFFFF]byte
 		for {
-			n, err := conn.Read(packet[:])
-			if err != nil {
-				conn.SetReadDeadline(time.Time{})
-				session.eventHandler.OnClosed(err)
+			var in []byte
+
+			// let the handler go on with the data it held while paused, it may pause again
+			if !session.gate.wait() {
+				n, err := conn.Read(packet[:])
+				if err != nil {
+					conn.SetReadDeadline(time.Time{})
+					m.setConnectorDropped(c.svcKey, c.addr, err)
+					m.protect(session, func() { handler.OnClosed(err) })
+					return
+				}
+				in = packet[:n]
+			}
+
+			var action Action
+			if perr := m.protect(session, func() { action = handler.OnRecvMsg(in) }); perr != nil {
+				conn.Close()
+				m.protect(session, func() { handler.OnClosed(perr) })
 				return
 			}
 
-			session.eventHandler.OnRecvMsg(packet[:n])
+			if action == Close {
+				conn.Close()
+				err := closeCause(handler)
+				m.setConnectorDropped(c.svcKey, c.addr, err)
+				m.protect(session, func() { handler.OnClosed(err) })
+				return
+			}
 		}
 	}()
 }
 
-func (m *NetworkModuleStd) Connect(svcKey, url string, timeOut time.Duration) error {
+// dialEndpoints tries the endpoints of the connector's service in order and
+// returns the first connection established. c.addr is set to the last endpoint tried.
+func (m *NetworkModuleStd) dialEndpoints(c *connector) (net.Conn, error) {
+	svcInfo := m.GetServerInfo(c.svcKey)
+	if svcInfo == nil {
+		return nil, errors.New("service not exist")
+	}
+
+	eps, err := resolveEndpoints(svcInfo, c.timeOut)
+	if err != nil {
+		return nil, err
+	}
+
+	m.clientMutex.Lock()
+	addrs := m.getConnectorState(c.svcKey).order(eps, svcInfo.EndpointPolicy)
+	m.clientMutex.Unlock()
 
-	network, addr, opts := parseAddr(url)
+	for _, addr := range addrs {
+		c.addr = addr
 
-	svcInfo := &ServerInfo{
-		Key:       svcKey,
-		Network:   network,
-		Address:   addr,
-		IsServer:  false,
-		ReusePort: opts.reusePort}
+		var conn net.Conn
+		conn, err = net.DialTimeout(c.network, addr, c.timeOut)
+		if err == nil {
+			return conn, nil
+		}
+
+		m.setConnectorDropped(c.svcKey, addr, err)
+	}
+
+	return nil, err
+}
+
+// getConnectorState must be called with clientMutex locked.
+func (m *NetworkModuleStd) getConnectorState(svcKey string) *connectorState {
+	if m.connStates == nil {
+		m.connStates = make(map[string]*connectorState)
+	}
+
+	st, ok := m.connStates[svcKey]
+	if !ok {
+		st = &connectorState{}
+		m.connStates[svcKey] = st
+	}
+	return st
+}
+
+func (m *NetworkModuleStd) setConnectorActive(svcKey, addr string) {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	st := m.getConnectorState(svcKey)
+	if len(st.last) != 0 && st.last != addr {
+		st.failovers++
+	}
+	st.active = addr
+	st.last = addr
+	st.lastErr = nil
+}
+
+// setConnectorDropped records that an endpoint failed, so it is tried last next time.
+func (m *NetworkModuleStd) setConnectorDropped(svcKey, addr string, err error) {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	st := m.getConnectorState(svcKey)
+	if st.active == addr {
+		st.active = ""
+	}
+	st.avoid = addr
+	st.lastErr = err
+}
+
+func (m *NetworkModuleStd) ConnectorState(svcKey string) (ConnectorState, bool) {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	st, ok := m.connStates[svcKey]
+	if !ok {
+		return ConnectorState{}, false
+	}
+
+	return ConnectorState{
+		SvcKey:    svcKey,
+		Endpoints: append([]string{}, st.endpoints...),
+		Active:    st.active,
+		LastError: st.lastErr,
+		Failovers: st.failovers,
+	}, true
+}
+
+// countConnectFail resets the failure count of a service on success,
+// otherwise increments it. Returns the new count.
+func (m *NetworkModuleStd) countConnectFail(svcKey string, succeeded bool) int {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	if m.connectFails == nil {
+		m.connectFails = make(map[string]int)
+	}
+
+	if succeeded {
+		delete(m.connectFails, svcKey)
+		return 0
+	}
+
+	m.connectFails[svcKey]++
+	return m.connectFails[svcKey]
+}
+
+func (m *NetworkModuleStd) Connect(svcKey, url string, timeOut time.Duration) error {
+
+	svcInfo := newServerInfo(svcKey, url)
 
 	err := m.AddServerInfo(svcInfo)
 	if err != nil {
@@ -257,19 +440,103 @@ func (m *NetworkModuleStd) ConnectSvc(svcKey string, timeOut time.Duration) erro
 		return errors.New("service not exist")
 	}
 
+	if svcInfo.PoolSize > 1 {
+		// only the members which are down get connected
+		pool := m.getConnPool(svcInfo)
+		for _, slot := range pool.takeDownSlots() {
+			m.startConnector(&connector{
+				svcKey:  svcInfo.Key,
+				timeOut: timeOut,
+				network: svcInfo.Network,
+				pool:    pool,
+				slot:    slot,
+			})
+		}
+		return nil
+	}
+
 	var c connector
 	c.svcKey = svcInfo.Key
 	c.timeOut = timeOut
 	c.network = svcInfo.Network
-	c.addr = svcInfo.Address
 
+	m.startConnector(&c)
+	return nil
+}
+
+func (m *NetworkModuleStd) startConnector(c *connector) {
 	if atomic.LoadInt32(&m.status) == 1 {
-		connecting(m, &c)
+		connecting(m, c)
 	} else {
-		m.connects = append(m.connects, &c)
+		m.connects = append(m.connects, c)
 	}
+}
 
-	return nil
+func (m *NetworkModuleStd) getConnPool(svcInfo *ServerInfo) *ConnPool {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	if m.pools == nil {
+		m.pools = make(map[string]*ConnPool)
+	}
+
+	pool, ok := m.pools[svcInfo.Key]
+	if !ok {
+		pool = newConnPool(svcInfo.Key, svcInfo.PoolSize, svcInfo.PoolPolicy)
+		m.pools[svcInfo.Key] = pool
+	}
+	return pool
+}
+
+// GetConnPool returns the pool of a service opened by ConnectSvc, nil if the service has no pool.
+func (m *NetworkModuleStd) GetConnPool(svcKey string) *ConnPool {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	return m.pools[svcKey]
+}
+
+func (m *NetworkModuleStd) removeClientSession(session *clientSession) {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	for i, s := range m.clientSessions {
+		if s == session {
+			m.clientSessions = append(m.clientSessions[:i], m.clientSessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// reconnectPoolSlot connects a pool member again after a delay, unless the module is shutting down.
+// The timers are tracked under clientMutex so the shutdown can stop them before waiting for the
+// connectors.
+func (m *NetworkModuleStd) reconnectPoolSlot(c *connector, failed bool) {
+	delay := c.pool.setReconnecting(c.slot, failed)
+
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	if atomic.LoadInt32(&m.status) != 1 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		m.clientMutex.Lock()
+		defer m.clientMutex.Unlock()
+
+		if !m.reconnects[timer] || atomic.LoadInt32(&m.status) != 1 {
+			return
+		}
+		delete(m.reconnects, timer)
+		connecting(m, c)
+	})
+
+	if m.reconnects == nil {
+		m.reconnects = make(map[*time.Timer]bool)
+	}
+	m.reconnects[timer] = true
 }
 
 // waitForShutdown waits for a signal to shutdown
@@ -293,27 +560,49 @@ func (m *NetworkModuleStd) signalShutdown(err error) {
 	m.cond.L.Unlock()
 }
 
-func stdListenerRun(m *NetworkModuleStd, ln *listener, lnidx int) {
-	var ferr error
+// stdListenerFailed asks the manager how to handle an accept error.
+// Returns true when the listener should keep accepting.
+func stdListenerFailed(m *NetworkModuleStd, ln *listener, err error, tempDelay *time.Duration) bool {
+	if atomic.LoadInt32(&m.status) >= 2 || errors.Is(err, net.ErrClosed) {
+		// closed by shutdown
+		return false
+	}
 
-	defer func() {
+	lerr := &ListenerError{SvcKey: ln.svcKey, Network: ln.network, Address: ln.addr, Err: err}
+	if m.evManager.OnListenerError(ln.svcKey, lerr) == Close {
+		m.signalShutdown(lerr)
+		return false
+	}
 
-		if ferr != nil {
-			m.signalShutdown(ferr)
-		}
+	if *tempDelay == 0 {
+		*tempDelay = 5 * time.Millisecond
+	} else {
+		*tempDelay *= 2
+	}
+	if *tempDelay > time.Second {
+		*tempDelay = time.Second
+	}
+	time.Sleep(*tempDelay)
 
-		m.lnwg.Done()
-	}()
+	return true
+}
 
+func stdListenerRun(m *NetworkModuleStd, ln *listener, lnidx int) {
+	defer m.lnwg.Done()
+
+	var tempDelay time.Duration // how long to sleep on accept failure
 	var packet [0xFFFF]byte
 	for {
 		if ln.pconn != nil {
 			// udp
 			n, addr, err := ln.pconn.ReadFrom(packet[:])
 			if err != nil {
-				ferr = err
+				if stdListenerFailed(m, ln, err, &tempDelay) {
+					continue
+				}
 				return
 			}
+			tempDelay = 0
 
 			ip := addr.String()
 			if strings.Contains(ip, ":") {
@@ -327,7 +616,7 @@ func stdListenerRun(m *NetworkModuleStd, ln *listener, lnidx int) {
 			l := m.loops[int(atomic.AddUintptr(&m.accepted, 1))%len(m.loops)]
 
 			s, ok := ln.udpSessions[addr]
-			if !ok {
+			if !ok || atomic.LoadInt32(&s.done) == 1 {
 				s = &udpSession{
 					pconn:      ln.pconn,
 					svcKey:     ln.svcKey,
@@ -336,7 +625,16 @@ func stdListenerRun(m *NetworkModuleStd, ln *listener, lnidx int) {
 					remoteAddr: addr,
 					in:         append([]byte{}, packet[:n]...),
 				}
-				s.eventHandler = m.evManager.CreateEventHandler(s)
+
+				var handler IEventHandler
+				perr := m.protect(s, func() { handler, _ = m.createEventHandler(s) })
+				if perr != nil || handler == nil {
+					if perr == nil {
+						fmt.Println("no event handler, session rejected:", ln.svcKey, s.sessionID)
+					}
+					continue
+				}
+				s.eventHandler = handler
 			} else {
 				s.in = append([]byte{}, packet[:n]...)
 			}
@@ -346,9 +644,12 @@ func stdListenerRun(m *NetworkModuleStd, ln *listener, lnidx int) {
 			// tcp
 			conn, err := ln.ln.Accept()
 			if err != nil {
-				ferr = err
+				if stdListenerFailed(m, ln, err, &tempDelay) {
+					continue
+				}
 				return
 			}
+			tempDelay = 0
 
 			ip := conn.RemoteAddr().String()
 			if strings.Contains(ip, ":") {
@@ -360,6 +661,10 @@ func stdListenerRun(m *NetworkModuleStd, ln *listener, lnidx int) {
 				continue
 			}
 
+			if svcInfo := m.GetServerInfo(ln.svcKey); svcInfo != nil {
+				conn = svcInfo.Fault.WrapConn(conn)
+			}
+
 			l := m.loops[int(atomic.AddUintptr(&m.accepted, 1))%len(m.loops)]
 			s := &tcpSession{
 				svcKey:    ln.svcKey,
@@ -368,12 +673,24 @@ func stdListenerRun(m *NetworkModuleStd, ln *listener, lnidx int) {
 				loop:      l,
 				lnidx:     lnidx,
 			}
-			s.eventHandler = m.evManager.CreateEventHandler(s)
+
+			var handler IEventHandler
+			perr := m.protect(s, func() { handler, _ = m.createEventHandler(s) })
+			if perr != nil || handler == nil {
+				if perr == nil {
+					fmt.Println("no event handler, session rejected:", ln.svcKey, s.sessionID)
+				}
+				conn.Close()
+				continue
+			}
+			s.eventHandler = handler
 			l.ch <- s
 
 			go func(session *tcpSession) {
 				var packet [0xFFFF]byte
 				for {
+					session.gate.wait()
+
 					n, err := session.conn.Read(packet[:])
 					if err != nil {
 						session.conn.SetReadDeadline(time.Time{})
@@ -424,6 +741,9 @@ func stdLoopRun(m *NetworkModuleStd, l *stdloop) {
 			case wakeReq:
 				err = stdloopRead(m, l, v.c, nil)
 
+			case resumeReq:
+				err = stdloopResume(m, l, v.c)
+
 			case *newListener:
 				err = stdloopNewListener(m, l, v.ln)
 			}
@@ -473,16 +793,18 @@ func stdloopError(m *NetworkModuleStd, l *stdloop, session *tcpSession, err erro
 
 	case 1: // closed
 		session.conn.Close()
-		err = nil
+		err = session.closeErr
 
 	case 2: // detached
 		err = nil
 		closeEvent = false
-		session.eventHandler.OnDetached(&stddetachedConn{session.conn, session.donein})
+		m.protect(session, func() {
+			session.eventHandler.OnDetached(&stddetachedConn{session.conn, session.donein})
+		})
 	}
 
 	if closeEvent {
-		session.eventHandler.OnClosed(err)
+		m.protect(session, func() { session.eventHandler.OnClosed(err) })
 	}
 
 	return nil
@@ -495,12 +817,25 @@ func stdloopRead(m *NetworkModuleStd, l *stdloop, session *tcpSession, in []byte
 		return nil
 	}
 
-	action := session.eventHandler.OnRecvMsg(in)
+	// hold the data read before the session paused, delivered first on resume
+	if len(in) > 0 && (session.gate.isPaused() || len(session.pendingIn) > 0) {
+		session.pendingIn = append(session.pendingIn, in...)
+		if session.gate.isPaused() {
+			return nil
+		}
+		in, session.pendingIn = session.pendingIn, nil
+	}
+
+	var action Action
+	if perr := m.protect(session, func() { action = session.eventHandler.OnRecvMsg(in) }); perr != nil {
+		return stdloopAbort(m, l, session, perr)
+	}
 
 	switch action {
 	case Detach:
 		return stdloopDetach(m, l, session)
 	case Close:
+		session.closeErr = closeCause(session.eventHandler)
 		return stdloopClose(m, l, session)
 	}
 
@@ -508,29 +843,64 @@ func stdloopRead(m *NetworkModuleStd, l *stdloop, session *tcpSession, in []byte
 }
 
 func stdloopReadUDP(m *NetworkModuleStd, l *stdloop, session *udpSession) error {
-	session.eventHandler.OnRecvMsg(session.in)
+	if atomic.LoadInt32(&session.done) == 1 {
+		return nil
+	}
+
+	if perr := m.protect(session, func() { session.eventHandler.OnRecvMsg(session.in) }); perr != nil {
+		// the listener replaces the session on the next datagram from this address
+		atomic.StoreInt32(&session.done, 1)
+		m.protect(session, func() { session.eventHandler.OnClosed(perr) })
+	}
 
 	return nil
 }
 
+// stdloopResume delivers the data held while the session was paused, if any.
+func stdloopResume(m *NetworkModuleStd, l *stdloop, session *tcpSession) error {
+	if session.gate.isPaused() || atomic.LoadInt32(&session.done) != 0 {
+		return nil
+	}
+
+	in := session.pendingIn
+	session.pendingIn = nil
+	return stdloopRead(m, l, session, in)
+}
+
 func stdloopDetach(m *NetworkModuleStd, l *stdloop, session *tcpSession) error {
 	atomic.StoreInt32(&session.done, 2)
+	session.donein = append(session.pendingIn, session.donein...)
+	session.pendingIn = nil
+	session.gate.close()
 	session.conn.SetReadDeadline(time.Now())
 	return nil
 }
 
 func stdloopClose(m *NetworkModuleStd, l *stdloop, session *tcpSession) error {
 	atomic.StoreInt32(&session.done, 1)
+	session.pendingIn = nil
+	session.gate.close()
 	session.conn.SetReadDeadline(time.Now())
 	return nil
 }
 
+// stdloopAbort closes a session whose handler panicked, the error is reported to OnClosed.
+func stdloopAbort(m *NetworkModuleStd, l *stdloop, session *tcpSession, perr *HandlerPanicError) error {
+	session.closeErr = perr
+	return stdloopClose(m, l, session)
+}
+
 func stdloopAccept(m *NetworkModuleStd, l *stdloop, session *tcpSession) error {
 	l.conns[session] = true
 
-	opts, action := session.eventHandler.OnOpened()
+	var opts Options
+	var action Action
+	if perr := m.protect(session, func() { opts, action = session.eventHandler.OnOpened() }); perr != nil {
+		return stdloopAbort(m, l, session, perr)
+	}
+
 	if opts.TCPKeepAlive > 0 {
-		if conn, ok := session.conn.(*net.TCPConn); ok {
+		if conn, ok := tcpConn(session.conn); ok {
 			conn.SetKeepAlive(true)
 			conn.SetKeepAlivePeriod(opts.TCPKeepAlive)
 		}
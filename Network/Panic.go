@@ -0,0 +1,49 @@
+package Network
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrHandlerPanic matches, with errors.Is, the error a session is closed with
+// after one of its callbacks panicked.
+var ErrHandlerPanic = errors.New("event handler panic")
+
+// HandlerPanicError carries the recovered value and the stack of a panicking callback.
+type HandlerPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("event handler panic: %v", e.Value)
+}
+
+func (e *HandlerPanicError) Is(target error) bool {
+	return target == ErrHandlerPanic
+}
+
+// protect runs fn, recovering a panic into a *HandlerPanicError which is also
+// reported to the manager's OnHandlerPanic.
+func (m *NetworkModuleBase) protect(session INetworkSession, fn func()) (perr *HandlerPanicError) {
+	defer func() {
+		if v := recover(); v != nil {
+			perr = &HandlerPanicError{Value: v, Stack: debug.Stack()}
+			m.notifyPanic(session, perr)
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+func (m *NetworkModuleBase) notifyPanic(session INetworkSession, perr *HandlerPanicError) {
+	defer func() {
+		if v := recover(); v != nil {
+			fmt.Println("OnHandlerPanic panicked:", v)
+		}
+	}()
+
+	m.evManager.OnHandlerPanic(session, perr.Value, perr.Stack)
+}
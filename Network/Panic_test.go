@@ -0,0 +1,125 @@
+package Network_test
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+func TestHandlerPanicClosesOnlyItsSession(t *testing.T) {
+	addr := freeAddr(t)
+	mod := Network.NewNetworkModule()
+	if err := mod.Listen("svc", "tcp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+
+	mngr := networktest.NewRecordingManager()
+	mngr.NewHandler = func(h *networktest.RecordingHandler) {
+		session := h.Session
+		h.RecvHook = func(b []byte) Network.Action {
+			if string(b) == "boom" {
+				panic("boom")
+			}
+			session.SendMsg(b)
+			return Network.None
+		}
+	}
+	runModule(t, mod, mngr)
+
+	bad, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	good, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+
+	if _, err := mngr.Recorder.WaitFor(networktest.EventOpened, 2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	bad.SendRaw([]byte("boom"))
+	panics, err := mngr.Recorder.WaitFor(networktest.EventHandlerPanic, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if panics[0].Value != "boom" || len(panics[0].Stack) == 0 {
+		t.Fatalf("panic event %+v", panics[0])
+	}
+
+	closed, err := mngr.Recorder.WaitFor(networktest.EventClosed, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(closed[0].Err, Network.ErrHandlerPanic) || closed[0].SessionID != panics[0].SessionID {
+		t.Fatalf("closed event %+v", closed[0])
+	}
+
+	bad.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bad.Conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the panicking session is still open")
+	}
+
+	good.SendRaw([]byte("ok"))
+	good.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(good.Conn, reply); err != nil || string(reply) != "ok" {
+		t.Fatalf("other session got %q, %v", reply, err)
+	}
+}
+
+// nilManager creates no handler for the first session.
+type nilManager struct {
+	*networktest.RecordingManager
+	created int32
+}
+
+func (m *nilManager) CreateEventHandler(session Network.INetworkSession) Network.IEventHandler {
+	if atomic.AddInt32(&m.created, 1) == 1 {
+		return nil
+	}
+	return m.RecordingManager.CreateEventHandler(session)
+}
+
+func TestNilHandlerRejectsSession(t *testing.T) {
+	addr := freeAddr(t)
+	mod := Network.NewNetworkModule()
+	if err := mod.Listen("svc", "tcp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+
+	mngr := &nilManager{RecordingManager: networktest.NewRecordingManager()}
+	runModule(t, mod, mngr)
+
+	rejected, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+
+	rejected.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from a rejected session returned %v, want EOF", err)
+	}
+
+	accepted, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	if _, err := mngr.Recorder.WaitFor(networktest.EventOpened, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(mngr.Recorder.EventsOf(networktest.EventOpened)); n != 1 {
+		t.Fatalf("%d sessions opened, want 1", n)
+	}
+}
@@ -0,0 +1,79 @@
+package Network
+
+import (
+	"sync"
+)
+
+// readGate holds the reader of a connection while its session pauses reading.
+type readGate struct {
+	mutex   sync.Mutex
+	paused  bool
+	closed  bool
+	resumed bool          // reopened since the last wait
+	resume  chan struct{} // closed on resume, while paused
+}
+
+// pause returns false if already paused, or the gate closed.
+func (g *readGate) pause() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.paused || g.closed {
+		return false
+	}
+	g.paused = true
+	g.resume = make(chan struct{})
+	return true
+}
+
+// open returns false if not paused.
+func (g *readGate) open() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.paused {
+		return false
+	}
+	g.paused = false
+	g.resumed = true
+	close(g.resume)
+	return true
+}
+
+// close opens the gate for good, so the reader sees the connection closing.
+func (g *readGate) close() {
+	g.mutex.Lock()
+	g.closed = true
+	g.mutex.Unlock()
+
+	g.open()
+}
+
+func (g *readGate) isPaused() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.paused
+}
+
+// wait blocks while the gate is paused. It returns true when the gate was reopened since the
+// last call: the session may hold data it did not handle while paused.
+func (g *readGate) wait() bool {
+	g.mutex.Lock()
+	if g.paused {
+		ch := g.resume
+		g.mutex.Unlock()
+		<-ch
+		g.mutex.Lock()
+	}
+	defer g.mutex.Unlock()
+
+	resumed := g.resumed && !g.closed
+	g.resumed = false
+	return resumed
+}
+
+// resumeReq delivers the data a loop held for a paused session, or just wakes it.
+type resumeReq struct {
+	c *tcpSession
+}
@@ -0,0 +1,55 @@
+package Network_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+func TestPauseReadHoldsData(t *testing.T) {
+	addr := freeAddr(t)
+	mod := Network.NewNetworkModule()
+	if err := mod.Listen("svc", "tcp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+
+	mngr := networktest.NewRecordingManager()
+	var paused int32
+	mngr.NewHandler = func(h *networktest.RecordingHandler) {
+		session := h.Session
+		h.RecvHook = func(b []byte) Network.Action {
+			if atomic.CompareAndSwapInt32(&paused, 0, 1) {
+				session.PauseRead()
+			}
+			return Network.None
+		}
+	}
+	runModule(t, mod, mngr)
+
+	cli, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	cli.SendRaw([]byte("first"))
+	if _, err := mngr.Recorder.WaitForBytes(5, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing more delivered while paused
+	cli.SendRaw([]byte("second"))
+	time.Sleep(100 * time.Millisecond)
+	if b, _ := mngr.Recorder.WaitForBytes(0, 0); string(b) != "first" {
+		t.Fatalf("received %q while paused", b)
+	}
+
+	mngr.Handlers()[0].Session.ResumeRead()
+	b, err := mngr.Recorder.WaitForBytes(11, time.Second)
+	if err != nil || string(b) != "firstsecond" {
+		t.Fatalf("received %q after resume, %v", b, err)
+	}
+}
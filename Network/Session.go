@@ -2,6 +2,8 @@ package Network
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 type INetworkSession interface {
@@ -12,6 +14,10 @@ type INetworkSession interface {
 	/// 发送消息
 	SendMsg(b []byte) error
 
+	/// 发送共享消息, 会话持有一个引用直到写完, 可能异步写入.
+	/// 新增的方法: 自行实现INetworkSession的类型需要加上, 最简单是SendMsg(buf.Bytes()).
+	SendShared(buf *SharedBuffer) error
+
 	/// 关闭会话.
 	Shutdown(notify bool)
 
@@ -22,6 +28,12 @@ type INetworkSession interface {
 	GetLocalAddr() net.Addr
 
 	Wake()
+
+	/// 暂停读取连接, 直到ResumeRead. UDP会话不支持.
+	PauseRead()
+
+	/// 恢复读取连接, 并以已读到的数据(可能为空)调用OnRecvMsg, 让处理者继续处理它保留的数据.
+	ResumeRead()
 }
 
 var allSessionID uint64
@@ -31,11 +43,15 @@ type tcpSession struct {
 	svcKey       string
 	sessionID    uint64
 	eventHandler IEventHandler
-	conn         net.Conn // original connection
-	loop         *stdloop // owner loop
-	lnidx        int      // index of listener
-	donein       []byte   // extra data for done connection
-	done         int32    // 0: attached, 1: closed, 2: detached
+	conn         net.Conn   // original connection
+	loop         *stdloop   // owner loop
+	lnidx        int        // index of listener
+	donein       []byte     // extra data for done connection
+	done         int32      // 0: attached, 1: closed, 2: detached
+	closeErr     error      // reported to OnClosed when closed by the loop
+	gate         readGate   // holds the reader while paused
+	pendingIn    []byte     // data the loop holds while paused
+	writeMutex   sync.Mutex // one write at a time, so a shared write keeps its deadline to itself
 }
 
 type wakeReq struct {
@@ -45,13 +61,49 @@ type wakeReq struct {
 func (s *tcpSession) GetServiceKey() string { return s.svcKey }
 func (s *tcpSession) GetSessionID() uint64  { return s.sessionID }
 func (s *tcpSession) SendMsg(b []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
 	_, err := s.conn.Write(b)
 	return err
 }
-func (s *tcpSession) Shutdown(notify bool)    { s.conn.Close() }
-func (s *tcpSession) GetRemoteAddr() net.Addr { return s.conn.LocalAddr() }
-func (s *tcpSession) GetLocalAddr() net.Addr  { return s.conn.RemoteAddr() }
+
+// SendShared queues buf to the writer of the loop, a message sent with SendMsg afterwards
+// may go out before it.
+func (s *tcpSession) SendShared(buf *SharedBuffer) error {
+	if atomic.LoadInt32(&s.done) != 0 {
+		return ErrSessionClosed
+	}
+
+	select {
+	case s.loop.wch <- sharedWrite{s, buf.Retain()}:
+		return nil
+	case <-s.loop.quit:
+		buf.Release()
+		return ErrSessionClosed
+	default:
+		buf.Release()
+		return ErrSendQueueFull
+	}
+}
+
+func (s *tcpSession) Shutdown(notify bool)    { s.gate.close(); s.conn.Close() }
+func (s *tcpSession) GetRemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+func (s *tcpSession) GetLocalAddr() net.Addr  { return s.conn.LocalAddr() }
 func (s *tcpSession) Wake()                   { s.loop.ch <- wakeReq{s} }
+func (s *tcpSession) PauseRead()              { s.gate.pause() }
+
+// ResumeRead reopens the reader, the loop delivers the data it held first.
+func (s *tcpSession) ResumeRead() {
+	if s.gate.open() {
+		go func() {
+			select {
+			case s.loop.ch <- resumeReq{s}:
+			case <-s.loop.quit:
+			}
+		}()
+	}
+}
 
 type stdin struct {
 	c  *tcpSession
@@ -72,6 +124,7 @@ type udpSession struct {
 	remoteAddr   net.Addr
 	lnidx        int // index of listener
 	in           []byte
+	done         int32 // 0: attached, 1: closed
 }
 
 func (s *udpSession) GetServiceKey() string { return s.svcKey }
@@ -80,10 +133,15 @@ func (s *udpSession) SendMsg(b []byte) error {
 	_, err := s.pconn.WriteTo(b, s.remoteAddr)
 	return err
 }
+func (s *udpSession) SendShared(buf *SharedBuffer) error {
+	return s.SendMsg(buf.Bytes())
+}
 func (s *udpSession) Shutdown(notify bool)    {}
-func (s *udpSession) GetRemoteAddr() net.Addr { return s.pconn.LocalAddr() }
-func (s *udpSession) GetLocalAddr() net.Addr  { return s.remoteAddr }
+func (s *udpSession) GetRemoteAddr() net.Addr { return s.remoteAddr }
+func (s *udpSession) GetLocalAddr() net.Addr  { return s.pconn.LocalAddr() }
 func (s *udpSession) Wake()                   {}
+func (s *udpSession) PauseRead()              {}
+func (s *udpSession) ResumeRead()             {}
 
 //----------------------------------------------------------------------------
 type clientSession struct {
@@ -91,18 +149,28 @@ type clientSession struct {
 	sessionID    uint64
 	eventHandler IEventHandler
 	conn         net.Conn
+	pending      int64    // bytes being written
+	gate         readGate // holds the reader while paused
 }
 
 func (s *clientSession) GetServiceKey() string { return s.svcKey }
 func (s *clientSession) GetSessionID() uint64  { return s.sessionID }
 func (s *clientSession) SendMsg(b []byte) error {
+	atomic.AddInt64(&s.pending, int64(len(b)))
+	defer atomic.AddInt64(&s.pending, -int64(len(b)))
+
 	_, err := s.conn.Write(b)
 	return err
 }
+func (s *clientSession) SendShared(buf *SharedBuffer) error {
+	return s.SendMsg(buf.Bytes())
+}
 func (s *clientSession) Shutdown(notify bool)    {}
-func (s *clientSession) GetRemoteAddr() net.Addr { return s.conn.LocalAddr() }
-func (s *clientSession) GetLocalAddr() net.Addr  { return s.conn.RemoteAddr() }
+func (s *clientSession) GetRemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+func (s *clientSession) GetLocalAddr() net.Addr  { return s.conn.LocalAddr() }
 func (s *clientSession) Wake()                   {}
+func (s *clientSession) PauseRead()              { s.gate.pause() }
+func (s *clientSession) ResumeRead()             { s.gate.open() }
 
 //----------------------------------------------------------------------------
 type stddetachedConn struct {
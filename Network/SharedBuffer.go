@@ -0,0 +1,105 @@
+package Network
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSendQueueFull = errors.New("send queue full")
+var ErrSessionClosed = errors.New("session closed")
+
+var sharedBufferPool = sync.Pool{New: func() interface{} { return new(SharedBuffer) }}
+
+// SharedBuffer is a message written to many sessions without copying it. Whoever holds a
+// reference calls Release once done with it; the storage is reused after the last one.
+type SharedBuffer struct {
+	data []byte
+	refs int32
+}
+
+// NewSharedBuffer copies b into a buffer holding one reference, the caller's.
+func NewSharedBuffer(b []byte) *SharedBuffer {
+	buf := sharedBufferPool.Get().(*SharedBuffer)
+	buf.data = append(buf.data[:0], b...)
+	buf.refs = 1
+	return buf
+}
+
+// Bytes returns the message, valid until the reference is released.
+func (b *SharedBuffer) Bytes() []byte {
+	return b.data
+}
+
+// Retain adds a reference, for a session writing it asynchronously.
+func (b *SharedBuffer) Retain() *SharedBuffer {
+	atomic.AddInt32(&b.refs, 1)
+	return b
+}
+
+// Release drops a reference.
+func (b *SharedBuffer) Release() {
+	n := atomic.AddInt32(&b.refs, -1)
+	if n == 0 {
+		if cap(b.data) <= 64<<10 {
+			sharedBufferPool.Put(b)
+		}
+		return
+	}
+
+	if n < 0 {
+		panic("SharedBuffer released too many times")
+	}
+}
+
+//----------------------------------------------------------------------------
+
+// sharedWrite is a buffer queued to the writer of a loop.
+type sharedWrite struct {
+	session *tcpSession
+	buf     *SharedBuffer
+}
+
+const sharedWriteQueueSize = 1024
+
+// sharedWriteTimeout bounds a write of the writer, a session whose peer does not read is
+// closed rather than stalling the other sessions of the loop.
+var sharedWriteTimeout = 5 * time.Second
+
+// writeShared writes buf within sharedWriteTimeout, after the direct write in progress if any,
+// so the deadline applies to this write alone.
+func (s *tcpSession) writeShared(buf *SharedBuffer) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(sharedWriteTimeout))
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		// a part may have been written, the stream is lost
+		s.Shutdown(true)
+	}
+	s.conn.SetWriteDeadline(time.Time{})
+}
+
+// stdloopWriter writes the shared buffers of the sessions of a loop, in queue order.
+func stdloopWriter(l *stdloop) {
+	for {
+		select {
+		case w := <-l.wch:
+			if atomic.LoadInt32(&w.session.done) == 0 {
+				w.session.writeShared(w.buf)
+			}
+			w.buf.Release()
+
+		case <-l.quit:
+			for {
+				select {
+				case w := <-l.wch:
+					w.buf.Release()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package Network_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+func TestSharedBufferRefs(t *testing.T) {
+	buf := Network.NewSharedBuffer([]byte("shared"))
+	buf.Retain()
+	buf.Release()
+	if string(buf.Bytes()) != "shared" {
+		t.Fatalf("bytes %q after a release", buf.Bytes())
+	}
+	buf.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic on an extra release")
+		}
+	}()
+	buf.Release()
+}
+
+func TestSharedSendReachesPeer(t *testing.T) {
+	addr := freeAddr(t)
+	_, mngr := listen(t, "svc", "tcp://"+addr)
+
+	cli, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	opened, err := mngr.Recorder.WaitFor(networktest.EventOpened, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := Network.NewSharedBuffer(networktest.EncodeFrame(0x10, []byte("hello")))
+	if err := mngr.Handler(opened[0].SessionID).Session.SendShared(buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.Release()
+
+	f, err := cli.ReadFrame(time.Second)
+	if err != nil || string(f.Body) != "hello" {
+		t.Fatalf("read %q, %v", f.Body, err)
+	}
+}
+
+func TestSharedWriteTimeoutClosesSession(t *testing.T) {
+	t.Cleanup(Network.SetSharedWriteTimeout(100 * time.Millisecond))
+
+	addr := freeAddr(t)
+	_, mngr := listen(t, "svc", "tcp://"+addr)
+
+	// never reads
+	cli, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	opened, err := mngr.Recorder.WaitFor(networktest.EventOpened, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := mngr.Handler(opened[0].SessionID).Session
+
+	buf := Network.NewSharedBuffer(make([]byte, 1<<20))
+	defer buf.Release()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mngr.Recorder.EventsOf(networktest.EventClosed)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled session not closed")
+		}
+
+		err := session.SendShared(buf)
+		if errors.Is(err, Network.ErrSendQueueFull) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestSharedWriteKeepsDeadlineToItself(t *testing.T) {
+	t.Cleanup(Network.SetSharedWriteTimeout(100 * time.Millisecond))
+
+	addr := freeAddr(t)
+	_, mngr := listen(t, "svc", "tcp://"+addr)
+
+	cli, err := networktest.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	opened, err := mngr.Recorder.WaitFor(networktest.EventOpened, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := mngr.Handler(opened[0].SessionID).Session
+
+	// a direct write blocked on a peer not reading yet, then a shared one
+	direct := make(chan error, 1)
+	go func() { direct <- session.SendMsg(make([]byte, 32<<20)) }()
+	time.Sleep(50 * time.Millisecond)
+
+	buf := Network.NewSharedBuffer([]byte("shared"))
+	if err := session.SendShared(buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.Release()
+
+	// longer than the shared write timeout
+	select {
+	case err := <-direct:
+		t.Fatal("direct write ended while the peer does not read:", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	go io.Copy(io.Discard, cli.Conn)
+	select {
+	case err := <-direct:
+		if err != nil {
+			t.Fatal("direct write failed:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("direct write blocked")
+	}
+}
@@ -0,0 +1,33 @@
+package Network
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// TCPConnOf exposes tcpConn to the tests.
+func TCPConnOf(c net.Conn) (*net.TCPConn, bool) {
+	return tcpConn(c)
+}
+
+// IsRunning tells whether Run has started the loops of m.
+func IsRunning(m INetworkModule) bool {
+	return atomic.LoadInt32(&m.(*NetworkModuleStd).status) == 1
+}
+
+// ClientSessions returns the number of tracked client sessions and pending reconnects of m.
+func ClientSessions(m INetworkModule) (sessions, reconnects int) {
+	std := m.(*NetworkModuleStd)
+	std.clientMutex.Lock()
+	defer std.clientMutex.Unlock()
+
+	return len(std.clientSessions), len(std.reconnects)
+}
+
+// SetSharedWriteTimeout changes the write timeout of the shared buffers, returning the restore.
+func SetSharedWriteTimeout(d time.Duration) func() {
+	old := sharedWriteTimeout
+	sharedWriteTimeout = d
+	return func() { sharedWriteTimeout = old }
+}
@@ -0,0 +1,65 @@
+package Network_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+)
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+// runModule runs mod until the end of the test, returning once its loops are started.
+func runModule(t *testing.T, mod Network.INetworkModule, evMngr Network.IEventHandlerManager) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mod.Run(evMngr, 1)
+	}()
+
+	for !Network.IsRunning(mod) {
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Cleanup(func() {
+		// a signal sent before Run waits for it is lost, send it again
+		for i := 0; i < 50; i++ {
+			mod.Shutdown()
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		t.Error("module did not shut down")
+	})
+}
+
+// listen starts a module serving svcKey at url with a RecordingManager.
+func listen(t *testing.T, svcKey, url string) (Network.INetworkModule, *networktest.RecordingManager) {
+	t.Helper()
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Listen(svcKey, url); err != nil {
+		t.Fatal(err)
+	}
+
+	mngr := networktest.NewRecordingManager()
+	runModule(t, mod, mngr)
+	return mod, mngr
+}
@@ -0,0 +1,223 @@
+package networktest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+)
+
+var ErrSessionClosed = errors.New("networktest: session is shut down")
+
+var fakeSessionID uint64 = 1 << 62
+
+// FakeSession is an INetworkSession which captures everything sent through it,
+// so handlers can be driven directly without sockets.
+type FakeSession struct {
+	SvcKey     string
+	SessionID  uint64
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+
+	// SendErr is returned by SendMsg when set.
+	SendErr error
+
+	mutex    sync.Mutex
+	sent     [][]byte
+	shutdown bool
+	notified bool
+	wakes    int
+	paused   bool
+	notify   chan struct{}
+}
+
+// NewFakeSession returns a session with a unique ID and loopback addresses.
+func NewFakeSession(svcKey string) *FakeSession {
+	return &FakeSession{
+		SvcKey:     svcKey,
+		SessionID:  atomic.AddUint64(&fakeSessionID, 1),
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000},
+		LocalAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000},
+		notify:     make(chan struct{}),
+	}
+}
+
+func (s *FakeSession) GetServiceKey() string   { return s.SvcKey }
+func (s *FakeSession) GetSessionID() uint64    { return s.SessionID }
+func (s *FakeSession) GetRemoteAddr() net.Addr { return s.RemoteAddr }
+func (s *FakeSession) GetLocalAddr() net.Addr  { return s.LocalAddr }
+
+func (s *FakeSession) SendMsg(b []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.SendErr != nil {
+		return s.SendErr
+	}
+	if s.shutdown {
+		return ErrSessionClosed
+	}
+
+	s.sent = append(s.sent, append([]byte{}, b...))
+	s.signal()
+	return nil
+}
+
+// SendShared records the bytes of buf like SendMsg, the reference is not kept.
+func (s *FakeSession) SendShared(buf *Network.SharedBuffer) error {
+	return s.SendMsg(buf.Bytes())
+}
+
+func (s *FakeSession) Shutdown(notify bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.shutdown = true
+	s.notified = notify
+	s.signal()
+}
+
+func (s *FakeSession) Wake() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.wakes++
+	s.signal()
+}
+
+func (s *FakeSession) PauseRead() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.paused = true
+}
+
+func (s *FakeSession) ResumeRead() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.paused = false
+}
+
+// IsReadPaused tells whether the handler paused reading.
+func (s *FakeSession) IsReadPaused() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.paused
+}
+
+func (s *FakeSession) signal() {
+	if s.notify == nil {
+		s.notify = make(chan struct{})
+	}
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// Sent returns copies of all the buffers passed to SendMsg.
+func (s *FakeSession) Sent() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([][]byte{}, s.sent...)
+}
+
+// SentBytes returns everything passed to SendMsg concatenated.
+func (s *FakeSession) SentBytes() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var b []byte
+	for _, msg := range s.sent {
+		b = append(b, msg...)
+	}
+	return b
+}
+
+// SentFrames splits everything sent so far into 6-byte header frames.
+func (s *FakeSession) SentFrames() ([]Frame, error) {
+	frames, _, err := SplitFrames(s.SentBytes())
+	return frames, err
+}
+
+func (s *FakeSession) ClearSent() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sent = nil
+}
+
+// IsShutdown reports whether Shutdown was called, and the notify flag it was called with.
+func (s *FakeSession) IsShutdown() (shutdown bool, notify bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.shutdown, s.notified
+}
+
+func (s *FakeSession) WakeCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.wakes
+}
+
+// WaitForSent waits until SendMsg has been called at least n times and returns the sent buffers.
+func (s *FakeSession) WaitForSent(n int, timeout time.Duration) ([][]byte, error) {
+	err := s.waitUntil(timeout, func() bool { return len(s.sent) >= n })
+	return s.Sent(), err
+}
+
+// WaitForFrames waits until at least n complete frames have been sent and returns them.
+func (s *FakeSession) WaitForFrames(n int, timeout time.Duration) ([]Frame, error) {
+	err := s.waitUntil(timeout, func() bool {
+		var b []byte
+		for _, msg := range s.sent {
+			b = append(b, msg...)
+		}
+		frames, _, _ := SplitFrames(b)
+		return len(frames) >= n
+	})
+
+	frames, ferr := s.SentFrames()
+	if err == nil {
+		err = ferr
+	}
+	return frames, err
+}
+
+// WaitForShutdown waits until Shutdown has been called.
+func (s *FakeSession) WaitForShutdown(timeout time.Duration) error {
+	return s.waitUntil(timeout, func() bool { return s.shutdown })
+}
+
+func (s *FakeSession) waitUntil(timeout time.Duration, cond func() bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mutex.Lock()
+		if s.notify == nil {
+			s.notify = make(chan struct{})
+		}
+		ok := cond()
+		notify := s.notify
+		s.mutex.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
+}
+
+var _ Network.INetworkSession = (*FakeSession)(nil)
@@ -0,0 +1,146 @@
+package networktest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/zhksoftGo/Packet"
+)
+
+// HeadLength is the size of the SessionPlayerBase frame header:
+// 4 bytes little-endian body length + 2 bytes little-endian type.
+const HeadLength = 6
+
+var ErrShortFrame = errors.New("networktest: incomplete frame")
+
+// Frame is one decoded SessionPlayerBase frame.
+type Frame struct {
+	Type uint16
+	Body []byte
+}
+
+// EncodeFrame builds a frame with the 6-byte header in front of body.
+func EncodeFrame(actionType uint16, body []byte) []byte {
+	b := make([]byte, HeadLength+len(body))
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(body)))
+	binary.LittleEndian.PutUint16(b[4:6], actionType)
+	copy(b[HeadLength:], body)
+	return b
+}
+
+// SplitFrames decodes all complete frames at the head of b and returns the unconsumed rest.
+func SplitFrames(b []byte) (frames []Frame, rest []byte, err error) {
+	for len(b) >= HeadLength {
+		bodyLen := int(binary.LittleEndian.Uint32(b[0:4]))
+		if len(b) < HeadLength+bodyLen {
+			break
+		}
+
+		frames = append(frames, Frame{
+			Type: binary.LittleEndian.Uint16(b[4:6]),
+			Body: append([]byte{}, b[HeadLength:HeadLength+bodyLen]...),
+		})
+		b = b[HeadLength+bodyLen:]
+	}
+
+	if len(b) != 0 {
+		err = ErrShortFrame
+	}
+	return frames, b, err
+}
+
+// FrameClient is a client connection speaking the SessionPlayerBase frame format.
+type FrameClient struct {
+	Conn net.Conn
+}
+
+// Dial connects to a `tcp://host:port` style url or a plain address.
+func Dial(url string, timeout time.Duration) (*FrameClient, error) {
+	network, address := "tcp", url
+	if i := strings.Index(url, "://"); i >= 0 {
+		network, address = url[:i], url[i+3:]
+	}
+
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FrameClient{Conn: conn}, nil
+}
+
+func (c *FrameClient) Close() error {
+	return c.Conn.Close()
+}
+
+// SendFrame writes one frame of the given type.
+func (c *FrameClient) SendFrame(actionType uint16, body []byte) error {
+	_, err := c.Conn.Write(EncodeFrame(actionType, body))
+	return err
+}
+
+// SendPacket writes the unread part of pak as the body of a frame of the given type.
+func (c *FrameClient) SendPacket(actionType uint16, pak *Packet.Packet) error {
+	b := pak.GetUsedBuffer()[pak.GetReadPos():]
+	return c.SendFrame(actionType, b)
+}
+
+// SendRaw writes b as is, to produce partial or malformed frames.
+func (c *FrameClient) SendRaw(b []byte) error {
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// ReadFrame reads one complete frame, waiting at most timeout.
+func (c *FrameClient) ReadFrame(timeout time.Duration) (Frame, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	var head [HeadLength]byte
+	if _, err := io.ReadFull(c.Conn, head[:]); err != nil {
+		return Frame{}, err
+	}
+
+	body := make([]byte, binary.LittleEndian.Uint32(head[0:4]))
+	if _, err := io.ReadFull(c.Conn, body); err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{Type: binary.LittleEndian.Uint16(head[4:6]), Body: body}, nil
+}
+
+// ReadPacket reads one frame and returns its body as a Packet.
+func (c *FrameClient) ReadPacket(timeout time.Duration) (actionType uint16, pak *Packet.Packet, err error) {
+	f, err := c.ReadFrame(timeout)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	pak = new(Packet.Packet)
+	pak.FromBuff(f.Body)
+	return f.Type, pak, nil
+}
+
+// WaitForFrames reads until n frames have been received or the timeout expires.
+func (c *FrameClient) WaitForFrames(n int, timeout time.Duration) ([]Frame, error) {
+	deadline := time.Now().Add(timeout)
+
+	var frames []Frame
+	for len(frames) < n {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return frames, ErrTimeout
+		}
+
+		f, err := c.ReadFrame(left)
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, f)
+	}
+	return frames, nil
+}
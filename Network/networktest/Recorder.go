@@ -0,0 +1,332 @@
+// Package networktest provides helpers for testing code built on the Network package:
+// recording event handlers and managers, a fake INetworkSession and a client speaking
+// the SessionPlayerBase frame format.
+package networktest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+)
+
+var ErrTimeout = errors.New("networktest: timed out")
+
+type EventKind int
+
+const (
+	EventOpened EventKind = iota
+	EventRecvMsg
+	EventClosed
+	EventDetached
+	EventConnectFailed
+	EventHandlerPanic
+	EventListenerError
+	EventShutdown
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventOpened:
+		return "Opened"
+	case EventRecvMsg:
+		return "RecvMsg"
+	case EventClosed:
+		return "Closed"
+	case EventDetached:
+		return "Detached"
+	case EventConnectFailed:
+		return "ConnectFailed"
+	case EventHandlerPanic:
+		return "HandlerPanic"
+	case EventListenerError:
+		return "ListenerError"
+	case EventShutdown:
+		return "Shutdown"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event is one recorded callback.
+type Event struct {
+	Kind      EventKind
+	Time      time.Time
+	SvcKey    string
+	SessionID uint64
+	Data      []byte      // copy of the received bytes, for EventRecvMsg
+	Err       error       // for EventClosed, EventConnectFailed and EventListenerError
+	Value     interface{} // recovered value, for EventHandlerPanic
+	Stack     []byte      // stack of the panic, for EventHandlerPanic
+}
+
+// Recorder collects events in the order they happened. It is safe for concurrent use.
+type Recorder struct {
+	mutex  sync.Mutex
+	events []Event
+	notify chan struct{}
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{notify: make(chan struct{})}
+}
+
+func (r *Recorder) Record(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events = append(r.events, ev)
+	close(r.notify)
+	r.notify = make(chan struct{})
+}
+
+// Events returns a copy of all recorded events.
+func (r *Recorder) Events() []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]Event{}, r.events...)
+}
+
+// EventsOf returns the recorded events of the given kind.
+func (r *Recorder) EventsOf(kind EventKind) []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var out []Event
+	for _, ev := range r.events {
+		if ev.Kind == kind {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// Kinds returns the sequence of recorded event kinds, handy for asserting on order.
+func (r *Recorder) Kinds() []EventKind {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	kinds := make([]EventKind, len(r.events))
+	for i, ev := range r.events {
+		kinds[i] = ev.Kind
+	}
+	return kinds
+}
+
+func (r *Recorder) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events = nil
+}
+
+// WaitUntil blocks until cond returns true for the recorded events, or the timeout expires.
+func (r *Recorder) WaitUntil(timeout time.Duration, cond func(events []Event) bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		r.mutex.Lock()
+		ok := cond(r.events)
+		notify := r.notify
+		r.mutex.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
+}
+
+// WaitFor waits until at least n events of the given kind have been recorded and returns them.
+func (r *Recorder) WaitFor(kind EventKind, n int, timeout time.Duration) ([]Event, error) {
+	err := r.WaitUntil(timeout, func(events []Event) bool {
+		count := 0
+		for _, ev := range events {
+			if ev.Kind == kind {
+				count++
+			}
+		}
+		return count >= n
+	})
+
+	events := r.EventsOf(kind)
+	if err != nil {
+		return events, fmt.Errorf("waiting for %d %v events, got %d: %w", n, kind, len(events), err)
+	}
+	return events, nil
+}
+
+// WaitForMessages waits until at least n OnRecvMsg events have been recorded and returns their data.
+func (r *Recorder) WaitForMessages(n int, timeout time.Duration) ([][]byte, error) {
+	events, err := r.WaitFor(EventRecvMsg, n, timeout)
+
+	msgs := make([][]byte, len(events))
+	for i, ev := range events {
+		msgs[i] = ev.Data
+	}
+	return msgs, err
+}
+
+// WaitForBytes waits until the OnRecvMsg events add up to at least n bytes and returns them
+// concatenated, since TCP may deliver a message in several reads.
+func (r *Recorder) WaitForBytes(n int, timeout time.Duration) ([]byte, error) {
+	concat := func(events []Event) []byte {
+		var b []byte
+		for _, ev := range events {
+			if ev.Kind == EventRecvMsg {
+				b = append(b, ev.Data...)
+			}
+		}
+		return b
+	}
+
+	err := r.WaitUntil(timeout, func(events []Event) bool {
+		return len(concat(events)) >= n
+	})
+	return concat(r.Events()), err
+}
+
+//----------------------------------------------------------------------------
+
+// RecordingHandler is an IEventHandler which records every callback.
+// The optional hooks decide the returned actions, None is returned otherwise.
+type RecordingHandler struct {
+	Session  Network.INetworkSession
+	Recorder *Recorder
+	Options  Network.Options
+
+	OpenedHook func() Network.Action
+	RecvHook   func(b []byte) Network.Action
+}
+
+func (h *RecordingHandler) event(kind EventKind) Event {
+	return Event{Kind: kind, SvcKey: h.Session.GetServiceKey(), SessionID: h.Session.GetSessionID()}
+}
+
+func (h *RecordingHandler) OnOpened() (opts Network.Options, action Network.Action) {
+	h.Recorder.Record(h.event(EventOpened))
+
+	opts = h.Options
+	if h.OpenedHook != nil {
+		action = h.OpenedHook()
+	}
+	return
+}
+
+func (h *RecordingHandler) OnRecvMsg(b []byte) Network.Action {
+	ev := h.event(EventRecvMsg)
+	ev.Data = append([]byte{}, b...)
+	h.Recorder.Record(ev)
+
+	if h.RecvHook != nil {
+		return h.RecvHook(b)
+	}
+	return Network.None
+}
+
+func (h *RecordingHandler) OnClosed(err error) (action Network.Action) {
+	ev := h.event(EventClosed)
+	ev.Err = err
+	h.Recorder.Record(ev)
+	return Network.None
+}
+
+func (h *RecordingHandler) OnDetached(rwc io.ReadWriteCloser) (action Network.Action) {
+	h.Recorder.Record(h.event(EventDetached))
+	rwc.Close()
+	return Network.None
+}
+
+// RecordingManager is an IEventHandlerManager creating a RecordingHandler per session,
+// all sharing the same Recorder.
+type RecordingManager struct {
+	Recorder *Recorder
+
+	// NewHandler customizes the created handlers, it may be nil.
+	NewHandler func(h *RecordingHandler)
+
+	// ListenerAction is returned by OnListenerError, None keeps the listener accepting.
+	ListenerAction Network.Action
+
+	mutex    sync.Mutex
+	handlers map[uint64]*RecordingHandler
+}
+
+func NewRecordingManager() *RecordingManager {
+	return &RecordingManager{
+		Recorder: NewRecorder(),
+		handlers: make(map[uint64]*RecordingHandler),
+	}
+}
+
+func (m *RecordingManager) CreateEventHandler(session Network.INetworkSession) Network.IEventHandler {
+	h := &RecordingHandler{Session: session, Recorder: m.Recorder}
+	if m.NewHandler != nil {
+		m.NewHandler(h)
+	}
+
+	m.mutex.Lock()
+	m.handlers[session.GetSessionID()] = h
+	m.mutex.Unlock()
+
+	return h
+}
+
+func (m *RecordingManager) OnConnectFailed(svcKey string, failure *Network.ConnectFailure) {
+	m.Recorder.Record(Event{Kind: EventConnectFailed, SvcKey: svcKey, Err: failure})
+}
+
+func (m *RecordingManager) OnListenerError(svcKey string, err error) Network.Action {
+	m.Recorder.Record(Event{Kind: EventListenerError, SvcKey: svcKey, Err: err})
+	return m.ListenerAction
+}
+
+func (m *RecordingManager) OnHandlerPanic(session Network.INetworkSession, value interface{}, stack []byte) {
+	m.Recorder.Record(Event{
+		Kind:      EventHandlerPanic,
+		SvcKey:    session.GetServiceKey(),
+		SessionID: session.GetSessionID(),
+		Value:     value,
+		Stack:     stack,
+	})
+}
+
+func (m *RecordingManager) OnShutdown() {
+	m.Recorder.Record(Event{Kind: EventShutdown})
+}
+
+// Handler returns the handler created for the session, or nil.
+func (m *RecordingManager) Handler(sessionID uint64) *RecordingHandler {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.handlers[sessionID]
+}
+
+// Handlers returns all the handlers created so far.
+func (m *RecordingManager) Handlers() []*RecordingHandler {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	out := make([]*RecordingHandler, 0, len(m.handlers))
+	for _, h := range m.handlers {
+		out = append(out, h)
+	}
+	return out
+}
+
+var _ Network.IEventHandler = (*RecordingHandler)(nil)
+var _ Network.IEventHandlerManager = (*RecordingManager)(nil)
@@ -0,0 +1,238 @@
+package networktest_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zhksoftGo/Cactus/Network"
+	"github.com/zhksoftGo/Cactus/Network/networktest"
+	"github.com/zhksoftGo/Packet"
+)
+
+func TestSplitFrames(t *testing.T) {
+	b := append(networktest.EncodeFrame(1, []byte("abc")), networktest.EncodeFrame(0x1234, nil)...)
+	b = append(b, networktest.EncodeFrame(7, []byte("partial"))[:8]...)
+
+	frames, rest, err := networktest.SplitFrames(b)
+	if !errors.Is(err, networktest.ErrShortFrame) {
+		t.Fatalf("err %v, want ErrShortFrame", err)
+	}
+	if len(rest) != 8 {
+		t.Fatalf("rest of %d bytes, want 8", len(rest))
+	}
+	if len(frames) != 2 || frames[0].Type != 1 || string(frames[0].Body) != "abc" || frames[1].Type != 0x1234 || len(frames[1].Body) != 0 {
+		t.Fatalf("frames %+v", frames)
+	}
+
+	frames, rest, err = networktest.SplitFrames(networktest.EncodeFrame(2, []byte("x")))
+	if err != nil || len(rest) != 0 || len(frames) != 1 {
+		t.Fatalf("frames %+v, rest %v, err %v", frames, rest, err)
+	}
+}
+
+func TestFakeSession(t *testing.T) {
+	s := networktest.NewFakeSession("svc")
+	other := networktest.NewFakeSession("svc")
+	if s.GetSessionID() == other.GetSessionID() {
+		t.Fatal("fake sessions share an ID")
+	}
+	if s.GetServiceKey() != "svc" || s.GetRemoteAddr() == nil || s.GetLocalAddr() == nil {
+		t.Fatal("fake session not set up")
+	}
+
+	go func() {
+		s.SendMsg(networktest.EncodeFrame(1, []byte("hello"))[:4])
+		s.SendMsg(networktest.EncodeFrame(1, []byte("hello"))[4:])
+		s.SendShared(Network.NewSharedBuffer(networktest.EncodeFrame(2, nil)))
+	}()
+
+	frames, err := s.WaitForFrames(2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames[0].Type != 1 || string(frames[0].Body) != "hello" || frames[1].Type != 2 {
+		t.Fatalf("frames %+v", frames)
+	}
+	if n := len(s.Sent()); n != 3 {
+		t.Fatalf("%d sends recorded, want 3", n)
+	}
+
+	s.ClearSent()
+	if len(s.SentBytes()) != 0 {
+		t.Fatal("ClearSent kept data")
+	}
+
+	s.PauseRead()
+	if !s.IsReadPaused() {
+		t.Fatal("not paused")
+	}
+	s.ResumeRead()
+	s.Wake()
+	if s.IsReadPaused() || s.WakeCount() != 1 {
+		t.Fatal("not resumed or not woken")
+	}
+
+	s.SendErr = errors.New("broken")
+	if err := s.SendMsg([]byte("x")); err != s.SendErr {
+		t.Fatalf("SendMsg returned %v", err)
+	}
+	s.SendErr = nil
+
+	if err := s.WaitForShutdown(10 * time.Millisecond); !errors.Is(err, networktest.ErrTimeout) {
+		t.Fatalf("WaitForShutdown returned %v before Shutdown", err)
+	}
+
+	go s.Shutdown(true)
+	if err := s.WaitForShutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if shutdown, notify := s.IsShutdown(); !shutdown || !notify {
+		t.Fatal("shutdown not recorded")
+	}
+	if err := s.SendMsg([]byte("x")); !errors.Is(err, networktest.ErrSessionClosed) {
+		t.Fatalf("SendMsg after Shutdown returned %v", err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := networktest.NewRecorder()
+
+	go func() {
+		r.Record(networktest.Event{Kind: networktest.EventOpened})
+		r.Record(networktest.Event{Kind: networktest.EventRecvMsg, Data: []byte("ab")})
+		r.Record(networktest.Event{Kind: networktest.EventRecvMsg, Data: []byte("cd")})
+		r.Record(networktest.Event{Kind: networktest.EventClosed})
+	}()
+
+	if _, err := r.WaitFor(networktest.EventClosed, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := r.Kinds()
+	want := []networktest.EventKind{networktest.EventOpened, networktest.EventRecvMsg, networktest.EventRecvMsg, networktest.EventClosed}
+	if len(kinds) != len(want) {
+		t.Fatalf("kinds %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Fatalf("kinds %v, want %v", kinds, want)
+		}
+	}
+
+	msgs, err := r.WaitForMessages(2, time.Second)
+	if err != nil || len(msgs) != 2 || string(msgs[1]) != "cd" {
+		t.Fatalf("messages %q, %v", msgs, err)
+	}
+	if b, err := r.WaitForBytes(4, time.Second); err != nil || string(b) != "abcd" {
+		t.Fatalf("bytes %q, %v", b, err)
+	}
+	if r.Events()[0].Time.IsZero() {
+		t.Fatal("event time not set")
+	}
+
+	if _, err := r.WaitFor(networktest.EventShutdown, 1, 10*time.Millisecond); !errors.Is(err, networktest.ErrTimeout) {
+		t.Fatalf("WaitFor returned %v, want a timeout", err)
+	}
+
+	r.Reset()
+	if len(r.Events()) != 0 {
+		t.Fatal("Reset kept events")
+	}
+	if networktest.EventHandlerPanic.String() != "HandlerPanic" {
+		t.Fatal(networktest.EventHandlerPanic.String())
+	}
+}
+
+// TestRecordingManager drives a server through a real module and a FrameClient.
+func TestRecordingManager(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	mngr := networktest.NewRecordingManager()
+	mngr.NewHandler = func(h *networktest.RecordingHandler) {
+		// echo every read back
+		session := h.Session
+		h.RecvHook = func(b []byte) Network.Action {
+			session.SendMsg(b)
+			return Network.None
+		}
+	}
+
+	mod := Network.NewNetworkModule()
+	if err := mod.Listen("svc", "tcp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mod.Run(mngr, 1)
+	}()
+	defer func() {
+		for {
+			mod.Shutdown()
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	var cli *networktest.FrameClient
+	for i := 0; ; i++ {
+		if cli, err = networktest.Dial("tcp://"+addr, time.Second); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer cli.Close()
+
+	opened, err := mngr.Recorder.WaitFor(networktest.EventOpened, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := mngr.Handler(opened[0].SessionID); h == nil || len(mngr.Handlers()) != 1 {
+		t.Fatal("handler not tracked")
+	}
+
+	var pak Packet.Packet
+	pak.WriteUint32(42)
+	pak.WriteString("hello")
+	if err := cli.SendPacket(3, &pak); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.SendFrame(4, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	actionType, reply, err := cli.ReadPacket(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actionType != 3 || reply.ReadUint32() != 42 || reply.ReadString() != "hello" {
+		t.Fatal("echoed packet differs")
+	}
+	frames, err := cli.WaitForFrames(1, time.Second)
+	if err != nil || frames[0].Type != 4 || !bytes.Equal(frames[0].Body, []byte("second")) {
+		t.Fatalf("frames %+v, %v", frames, err)
+	}
+
+	cli.Close()
+	closed, err := mngr.Recorder.WaitFor(networktest.EventClosed, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed[0].SessionID != opened[0].SessionID || closed[0].SvcKey != "svc" {
+		t.Fatalf("closed event %+v", closed[0])
+	}
+}
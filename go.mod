@@ -1,9 +1,13 @@
 module github.com/zhksoftGo/Cactus
 
-go 1.16
+go 1.20
 
 require (
 	github.com/gookit/slog v0.1.3
-	github.com/smallnest/ringbuffer v0.0.0-20210227121335-0a58434b36f2
 	github.com/zhksoftGo/Packet v1.1.0
 )
+
+require (
+	github.com/gookit/color v1.3.6 // indirect
+	github.com/gookit/goutil v0.3.7 // indirect
+)